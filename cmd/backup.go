@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/spf13/cobra"
+	"log"
+	"strconv"
+	"time"
+)
+
+var backupInterval time.Duration
+var backupKeep int
+var backupMaxAge time.Duration
+
+//backuper uploads etcd snapshots of the local member to the secret store
+type backuper struct {
+	store  pkg.SecretStore
+	kp     pkg.KeyProvider
+	policy pkg.RetentionPolicy
+	etcd   func() (*pkg.EtcdClient, error)
+}
+
+//backup takes a snapshot, uploads it and prunes the old ones
+func (b *backuper) backup(ctx context.Context) error {
+	client, err := b.etcd()
+	if err != nil {
+		return err
+	}
+	var snapshot bytes.Buffer
+	if err := client.Snapshot(ctx, &snapshot); err != nil {
+		return err
+	}
+	pointer, err := pkg.UploadBackup(b.store, b.kp, snapshot.Bytes(), time.Now())
+	if err != nil {
+		return err
+	}
+	log.Println("Uploaded backup " + pointer.Key + " with " + strconv.Itoa(pointer.Size) + " bytes")
+	pruned, err := pkg.PruneBackups(b.store, b.policy, time.Now())
+	if err != nil {
+		return errors.New("could not prune the backups: " + err.Error())
+	}
+	log.Println("Pruned " + strconv.Itoa(len(pruned)) + " backups")
+	return nil
+}
+
+//run takes a single backup or, with an interval, one every interval till
+//the context is cancelled. Failed backups of the daemon are logged and
+//retried at the next interval.
+func (b *backuper) run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return b.backup(ctx)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := b.backup(ctx); err != nil {
+			log.Println("Backup failed: " + err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func backupCluster() {
+	sess, region, _ := cloudSession()
+	kp, err := newKeyProvider(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the key provider: " + err.Error())
+	}
+	store, err := newSecretStore(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
+	}
+	if _, ok := store.(pkg.DeleteStore); !ok {
+		log.Fatalln("The secret store can't keep backups, use a s3:// or file:// store")
+	}
+
+	b := &backuper{
+		store:  store,
+		kp:     kp,
+		policy: pkg.RetentionPolicy{Keep: backupKeep, MaxAge: backupMaxAge},
+		etcd:   func() (*pkg.EtcdClient, error) { return newEtcdClient(caKeys, etcdEndpoint) },
+	}
+	ctx, cancel := signalContext(0)
+	defer cancel()
+	if err := b.run(ctx, backupInterval); err != nil {
+		log.Fatalln("Could not back up etcd: " + err.Error())
+	}
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up etcd to the secret store",
+	Long: `Takes a snapshot of the local etcd member on a controller and uploads it
+compressed, and encrypted with --key-file or --kms-key-id, below ` + pkg.BackupPrefix + `.
+` + pkg.LatestBackupKey + ` points to the newest snapshot. With --interval it runs
+as a daemon.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		backupCluster()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(backupCmd)
+	backupCmd.Flags().DurationVar(&backupInterval, "interval", 0, "Interval of the backups, 0 takes a single backup")
+	backupCmd.Flags().IntVar(&backupKeep, "keep", 7, "Number of backups to keep, 0 keeps all")
+	backupCmd.Flags().DurationVar(&backupMaxAge, "max-age", 0, "Age after which backups are pruned, 0 keeps them regardless of age")
+}
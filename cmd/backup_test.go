@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var snapshots int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/maintenance/snapshot" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&snapshots, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"blob": []byte("snapshot")}})
+	}))
+	defer srv.Close()
+	store := pkg.NewFileStore(filepath.Join(dir, "store"))
+	for _, day := range []int{1, 2, 3} {
+		pkg.UploadBackup(store, nil, []byte("old"), time.Date(2026, 10, day, 3, 0, 0, 0, time.UTC))
+	}
+	b := &backuper{
+		store:  store,
+		policy: pkg.RetentionPolicy{Keep: 2},
+		etcd:   func() (*pkg.EtcdClient, error) { return pkg.NewEtcdClient(srv.URL, nil), nil },
+	}
+
+	if err := b.run(context.Background(), 0); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	pointer, err := pkg.GetLatestBackup(store)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if dat, _ := pkg.DownloadBackup(store, nil, pointer); string(dat) != "snapshot" {
+		t.Errorf("expect the latest backup to be the snapshot, got %s", dat)
+	}
+	if keys, _ := pkg.ListBackups(store); len(keys) != 2 {
+		t.Errorf("expect 2 backups to be kept, got %v", keys)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	atomic.StoreInt32(&snapshots, 0)
+	if err := b.run(ctx, time.Millisecond*10); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&snapshots); n < 2 {
+		t.Errorf("expect a snapshot every interval, got %v", n)
+	}
+
+	b.etcd = func() (*pkg.EtcdClient, error) { return nil, errors.New("no etcd ca") }
+	if err := b.run(context.Background(), 0); err == nil {
+		t.Errorf("expect error")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := b.run(ctx, time.Millisecond*5); err != nil {
+		t.Errorf("expect the daemon to keep running after failed backups, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+//listClusters only asks the instance metadata for what the environment
+//doesn't provide, off EC2 it works with AWS_REGION and credentials from the
+//environment or without both for file stores
+func listClusters() {
+	u, err := secretStoreURL("")
+	if err != nil {
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
+	}
+	var metaSvc *pkg.IMDS
+	sess, err := newSession(nil)
+	if err != nil {
+		log.Fatalln("Could not initialize aws session: " + err.Error())
+	}
+	if u.Scheme == "file" {
+		printClusters(sess, "")
+		return
+	}
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		metaSvc = pkg.NewIMDS("")
+		if sess, err = newSession(metaSvc); err != nil {
+			log.Fatalln("Could not initialize aws session: " + err.Error())
+		}
+	}
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		if metaSvc == nil {
+			metaSvc = pkg.NewIMDS("")
+		}
+		if region, err = pkg.GetRegion(metaSvc); err != nil {
+			log.Fatalln("Could not get the region, set AWS_REGION: " + err.Error())
+		}
+	}
+	printClusters(sess, region)
+}
+
+func printClusters(sess *session.Session, region string) {
+	store, err := newStore(sess, region, "")
+	if err != nil {
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
+	}
+	clusters, err := pkg.ListClusters(store)
+	if err != nil {
+		log.Fatalln("Could not list the clusters: " + err.Error())
+	}
+	for _, cluster := range clusters {
+		fmt.Println(cluster)
+	}
+}
+
+var clustersCmd = &cobra.Command{
+	Use:   "clusters",
+	Short: "Manage clusters",
+	Long:  `Manages the clusters kept in the secret store.`,
+}
+
+var clustersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List clusters",
+	Long:  `Lists the clusters found below the prefix of the secret store.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listClusters()
+	},
+}
+
+func init() {
+	clustersCmd.AddCommand(clustersListCmd)
+	RootCmd.AddCommand(clustersCmd)
+}
@@ -1,81 +1,220 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/base64"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/autoscaling"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"context"
+	"errors"
 	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
 	"github.com/spf13/cobra"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-func getKubeVersion() ([]byte, error) {
-	retry := 0
-	for {
-		out, err := exec.Command(
+const (
+	leaderLockKey      = "leader.lock"
+	leaseDuration      = time.Second * 30
+	leaseRenewInterval = time.Second * 10
+
+	//pkiModeStore copies the pki through the secret store
+	pkiModeStore = "store"
+	//pkiModeUploadCerts lets kubeadm share the pki in the cluster, only the
+	//certificate key is kept in the secret store
+	pkiModeUploadCerts = "upload-certs"
+
+	//restorePolicyNever inits an empty cluster even if there is a backup
+	restorePolicyNever = "never"
+	//restorePolicyLatest restores the latest backup if there is one
+	restorePolicyLatest = "latest"
+	//restorePolicyRequired refuses to init a cluster without a backup
+	restorePolicyRequired = "required"
+
+	capacityTimeout    = time.Minute * 10
+	capacityInterval   = time.Second * 5
+	kubeVersionTimeout = time.Minute * 2
+	//etcdJoinTimeout limits the wait for a healthy etcd before the join and
+	//for the learner to catch up after it
+	etcdJoinTimeout = time.Minute * 10
+)
+
+var cniName string
+var tokenTTL time.Duration
+var pkiMode string
+var allowEvenEtcd bool
+var restorePolicy string
+
+type controller struct {
+	node
+	instanceID       string
+	pki              map[string]string
+	pkiMode          string
+	kp               pkg.KeyProvider
+	cni              pkg.NetworkPlugin
+	tokenTTL         time.Duration
+	restorePolicy    string
+	nodeName         string
+	lockStore        pkg.LockStore
+	provider         pkg.CloudProvider
+	etcd             func(ctx context.Context, instances []pkg.InstanceAddress) (*pkg.EtcdClient, error)
+	allowEvenEtcd    bool
+	etcdJoinTimeout  time.Duration
+	capacityInterval time.Duration
+	leaseRenew       time.Duration
+	lock             *pkg.LeaderLock
+	token            int64
+	stopLease        chan struct{}
+	leaseDone        <-chan struct{}
+	cancelInit       context.CancelFunc
+	leaseMu          sync.Mutex
+	leaseErr         error
+}
+
+func (c *controller) getKubeVersion(ctx context.Context) ([]byte, error) {
+	var out []byte
+	err := retry.Do(ctx, "get the kubernetes version", c.backoff.WithTimeout(kubeVersionTimeout), func(ctx context.Context) error {
+		var err error
+		out, err = c.runner.Run(
 			"kubectl",
 			"--kubeconfig",
-			"/etc/kubernetes/admin.conf",
+			c.kubeconfig,
 			"version",
-		).Output()
-		if retry > 10 && err != nil {
-			return nil, err
-		} else if err == nil {
-			return out, nil
+		)
+		return err
+	})
+	return out, err
+}
+
+//initCluster runs kubeadm init. With uploaded certs the certificate key is
+//published right away, a crash before the publish phase would lose it.
+func (c *controller) initCluster() error {
+	if err := pkg.Download(c.store, "kubeadm-cfg-init.yaml", c.files["kubeadm-cfg-init.yaml"]); err != nil {
+		return errors.New("could not download from the secret store : " + err.Error())
+	}
+	log.Println("Downloaded kubeadm.cfg")
+	if _, err := c.networkParams(); err != nil {
+		return err
+	}
+
+	args := []string{"init", "--config", c.files["kubeadm-cfg-init.yaml"]}
+	check, err := c.restoreEtcd()
+	if err != nil {
+		return err
+	}
+	if check != "" {
+		args = append(args, "--ignore-preflight-errors="+check)
+	}
+	var key *pkg.CertificateKey
+	if c.pkiMode == pkiModeUploadCerts {
+		raw, err := pkg.GenerateCertificateKey()
+		if err != nil {
+			return err
+		}
+		key = &pkg.CertificateKey{Key: raw, Expires: time.Now().Add(pkg.CertificateKeyTTL)}
+		args = append(args, "--upload-certs", "--certificate-key", key.Key)
+	}
+	if _, err := c.runner.Run("kubeadm", args...); err != nil {
+		return errors.New("couldn't run kubeadm: " + err.Error())
+	}
+	if key != nil {
+		store, err := c.leaderStore()
+		if err != nil {
+			return err
+		}
+		if err := pkg.PublishCertificateKey(store, c.kp, key); err != nil {
+			return errors.New("could not publish the certificate key : " + err.Error())
 		}
-		retry++
-		time.Sleep(time.Second * 1)
 	}
+	return nil
 }
 
-func createController() {
-	log.Println("---- kubeadm init ----")
-	kubeadmCmd := exec.Command(
-		"kubeadm",
-		"init",
-		"--config",
-		clusterConfig["kubeadm-cfg-init.yaml"],
-	)
-	kubeadmCmd.Stdout = os.Stdout
-	if err := kubeadmCmd.Run(); err != nil {
-		log.Panic("Couldn't run kubeadm: " + err.Error())
+//restoreEtcd restores etcd from the latest backup before kubeadm init as
+//--restore-policy asks and records the decision in the store. It returns
+//the preflight check kubeadm has to skip for the restored data dir.
+func (c *controller) restoreEtcd() (string, error) {
+	record := &pkg.RestoreRecord{Policy: c.restorePolicy, InstanceID: c.instanceID, Time: time.Now().UTC()}
+	check := ""
+	pointer, err := pkg.GetLatestBackup(c.store)
+	switch {
+	case err == pkg.ErrNotFound:
+		if c.restorePolicy == restorePolicyRequired {
+			return "", errors.New("--restore-policy=" + restorePolicyRequired + ", but there is no backup in " + pkg.BackupPrefix)
+		}
+		log.Println("No backup found, init an empty cluster")
+		record.Decision = pkg.RestoreDecisionNoBackup
+	case err != nil:
+		return "", errors.New("could not look for a backup: " + err.Error())
+	case c.restorePolicy == restorePolicyNever:
+		log.Println("Backup " + pointer.Key + " exists, but --restore-policy=" + restorePolicyNever + ", init an empty cluster")
+		record.Decision = pkg.RestoreDecisionSkipped
+		record.Backup = pointer.Key
+	default:
+		if check, err = c.restoreBackup(pointer); err != nil {
+			return "", err
+		}
+		record.Decision = pkg.RestoreDecisionRestored
+		record.Backup = pointer.Key
 	}
+	if err := pkg.RecordRestore(c.store, record); err != nil {
+		return "", errors.New("could not record the restore decision: " + err.Error())
+	}
+	return check, nil
+}
 
-	log.Println("---- Deploy weavnet ----")
-	kubeVersionRaw, err := getKubeVersion()
+//restoreBackup restores the data dir of the etcd member kubeadm is going to
+//create from a backup
+func (c *controller) restoreBackup(pointer *pkg.BackupPointer) (string, error) {
+	if c.pkiMode != pkiModeStore {
+		return "", errors.New("can't restore backup " + pointer.Key + " with --pki-mode=" + c.pkiMode + ", a new pki invalidates the service account tokens and kubelet credentials of the restored cluster, use --pki-mode=" + pkiModeStore)
+	}
+	tool, err := pkg.EtcdRestoreTool(c.runner)
 	if err != nil {
-		log.Fatalln("Couldn't get kubernetes version: " + err.Error())
+		return "", errors.New("can't restore backup " + pointer.Key + ": " + err.Error())
 	}
-	kubeVersion := base64.StdEncoding.EncodeToString(kubeVersionRaw)
-	deployWeaveCmd := exec.Command(
-		"kubectl",
-		"apply",
-		"--kubeconfig",
-		"/etc/kubernetes/admin.conf",
-		"-f",
-		"https://cloud.weave.works/k8s/net?k8s-version="+kubeVersion,
-	)
-	deployWeaveCmd.Stdout = os.Stdout
-	if err := deployWeaveCmd.Run(); err != nil {
-		log.Panic("Couldn't deploy weavenet: " + err.Error())
+	log.Println("Restore etcd from backup " + pointer.Key + " taken at " + pointer.Created.Format(time.RFC3339) + " with " + strings.Join(tool, " "))
+	dat, err := ioutil.ReadFile(c.files["kubeadm-cfg-init.yaml"])
+	if err != nil {
+		return "", err
+	}
+	ip, err := pkg.OutboundIP(c.apiDNS + ":" + strconv.Itoa(c.apiPort))
+	if err != nil {
+		log.Println("Could not get the address kubeadm advertises: " + err.Error())
+	}
+	member, err := pkg.LocalEtcdConfig(dat, c.nodeName, ip)
+	if err != nil {
+		return "", errors.New("could not read the etcd member from the kubeadm config: " + err.Error())
+	}
+	snapshot, err := pkg.DownloadBackup(c.store, c.kp, pointer)
+	if err != nil {
+		return "", errors.New("could not download the backup: " + err.Error())
+	}
+	f, err := ioutil.TempFile("", "etcd-snapshot")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(snapshot)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
 	}
+	if err := pkg.RestoreSnapshot(c.runner, tool, f.Name(), member); err != nil {
+		return "", err
+	}
+	return member.PreflightCheck(), nil
+}
 
-	log.Println("---- Write cluster info ----")
-	clusterInfoCmd := exec.Command(
+func (c *controller) writeClusterInfo() error {
+	clusterInfo, err := c.runner.Run(
 		"kubectl",
 		"--kubeconfig",
-		"/etc/kubernetes/admin.conf",
+		c.kubeconfig,
 		"get",
 		"cm",
 		"-n",
@@ -84,176 +223,733 @@ func createController() {
 		"-o",
 		"jsonpath={.data.kubeconfig}",
 	)
-	var clusterInfoBuffer bytes.Buffer
-	mw := io.MultiWriter(os.Stdout, &clusterInfoBuffer)
-	clusterInfoCmd.Stdout = mw
-	clusterInfoCmd.Stderr = mw
-	if err := clusterInfoCmd.Run(); err != nil {
-		log.Panic("Couldn't get cluster info: " + err.Error())
+	if err != nil {
+		return errors.New("couldn't get cluster info: " + err.Error())
 	}
-	if err := ioutil.WriteFile(clusterConfig["cluster-info.yaml"], clusterInfoBuffer.Bytes(), 0644); err != nil {
-		log.Panic("Couldn't write cluster info: " + err.Error())
+	if err := ioutil.WriteFile(c.files["cluster-info.yaml"], clusterInfo, 0644); err != nil {
+		return errors.New("couldn't write cluster info: " + err.Error())
 	}
+	return nil
 }
 
-func joinController(svc s3iface.S3API, apiDNS string, apiPort int, bucket string) {
-	err := os.MkdirAll("/etc/kubernetes/pki/etcd", 0777)
+func (c *controller) networkParams() (pkg.ManifestParams, error) {
+	dat, err := ioutil.ReadFile(c.files["kubeadm-cfg-init.yaml"])
+	if err != nil {
+		return pkg.ManifestParams{}, err
+	}
+	params, err := pkg.ClusterNetworking(dat)
 	if err != nil {
-		log.Fatalln("Could not create directory : " + err.Error())
+		return params, errors.New("could not read the kubeadm config: " + err.Error())
+	}
+	if err := c.cni.CheckCIDR(params); err != nil {
+		return params, err
 	}
+	return params, nil
+}
 
-	for {
-		if err := pkg.DownloadMapFromS3(svc, bucket, &caKeys); err == nil {
-			break
-		}
+func (c *controller) deployNetwork(ctx context.Context) error {
+	params, err := c.networkParams()
+	if err != nil {
+		return err
 	}
-	for {
-		if err := pkg.DownloadFromS3(svc, bucket, "cluster-info.yaml", clusterConfig["cluster-info.yaml"]); err == nil {
-			break
-		}
+	kubeVersion, err := c.getKubeVersion(ctx)
+	if err != nil {
+		return errors.New("couldn't get kubernetes version: " + err.Error())
+	}
+	params.KubeVersion = string(kubeVersion)
+	var manifest []byte
+	if c.airGapped {
+		manifest, err = c.store.Get(pkg.AddonKey(c.cni.Name()))
+		manifest = c.cni.Render(manifest, params)
+	} else {
+		manifest, err = c.cni.Manifest(c.store, params)
+	}
+	if err != nil {
+		return errors.New("couldn't render the " + c.cni.Name() + " manifest: " + err.Error())
 	}
-	for {
-		if err := pkg.DownloadFromS3(svc, bucket, "kubeadm-cfg-join.yaml", clusterConfig["kubeadm-cfg-join.yaml"]); err == nil {
-			break
+	manifestFile := c.files["kubeadm-cfg-init.yaml"] + "." + c.cni.Name() + ".yaml"
+	if err := ioutil.WriteFile(manifestFile, manifest, 0644); err != nil {
+		return err
+	}
+	if _, err := c.runner.Run(
+		"kubectl",
+		"apply",
+		"--kubeconfig",
+		c.kubeconfig,
+		"-f",
+		manifestFile,
+	); err != nil {
+		return errors.New("couldn't deploy " + c.cni.Name() + ": " + err.Error())
+	}
+	return nil
+}
+
+func (c *controller) createPkiDirs() error {
+	for _, p := range c.pki {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	joinCmd := exec.Command(
-		"kubeadm",
-		"join",
-		apiDNS+":"+strconv.Itoa(apiPort),
-		"--config",
-		clusterConfig["kubeadm-cfg-join.yaml"],
-		"--control-plane",
-	)
-	joinCmd.Stdout = os.Stdout
-	if err := joinCmd.Run(); err != nil {
-		log.Fatalln("Kubeadm join failed: " + err.Error())
+//fetchPki gets the pki from the secret store. The leader only finds one if
+//an earlier cluster stored it, the others wait for it.
+func (c *controller) fetchPki(ctx context.Context, state *pkg.BootstrapState) error {
+	if c.pkiMode == pkiModeUploadCerts {
+		log.Println("The pki is shared by kubeadm with the certificate key")
+		return nil
+	}
+	if err := c.createPkiDirs(); err != nil {
+		return errors.New("could not create directory : " + err.Error())
+	}
+	if state.Action == pkg.ActionJoin {
+		return retry.Do(ctx, "download the pki", c.backoff, func(ctx context.Context) error {
+			return pkg.DownloadMap(c.store, &c.pki, c.kp)
+		})
+	}
+	if val, err := pkg.ExistsInStore(c.store, &c.pki); err != nil {
+		return errors.New("could not check if package exists: " + err.Error())
+	} else if !val {
+		log.Println("Pki doesn't  exist create ite during kube setup")
+		return nil
 	}
+	log.Println("Pki does exist download it")
+	if err := pkg.DownloadMap(c.store, &c.pki, c.kp); err != nil {
+		return errors.New("could not download pki : " + err.Error())
+	}
+	return nil
 }
 
-func initController(svc s3iface.S3API, bucket string) {
-	if val, err := pkg.ExistsOnS3(svc, bucket, &caKeys); err != nil {
-		log.Fatalln("Could not check if package exists: " + err.Error())
-	} else if val {
-		log.Println("Pki does exist download it")
-		err := os.MkdirAll("/etc/kubernetes/pki/etcd", 0777)
+//reconcileBeforeJoin removes the etcd members of terminated controllers so
+//they don't count against the quorum the join needs. The etcd ca is only
+//there before the join if the pki is copied through the secret store.
+func (c *controller) reconcileBeforeJoin(ctx context.Context) {
+	if _, err := os.Stat(c.pki["etcd-ca.key"]); err != nil {
+		log.Println("The etcd ca isn't available before the join, skip the reconcile")
+		return
+	}
+	r := &reconciler{
+		runner:     c.runner,
+		kubeconfig: c.kubeconfig,
+		provider:   c.provider,
+		etcd:       c.etcd,
+	}
+	if err := r.reconcile(ctx); err != nil {
+		log.Println("Could not reconcile the cluster before the join: " + err.Error())
+	}
+}
+
+//prepareEtcdJoin waits till etcd has a leader and all members are healthy
+//and adds this controller as a learner, kubeadm join reuses the member with
+//its peer url. That needs etcd 3.4 for the learner and kubeadm 1.19 which
+//finds the member by its peer url instead of adding another one. A learner
+//of an interrupted join is reused. With an older etcd or without the etcd ca
+//kubeadm adds a voting member on its own.
+func (c *controller) prepareEtcdJoin(ctx context.Context) (*pkg.EtcdClient, *pkg.EtcdMember, error) {
+	if _, err := os.Stat(c.pki["etcd-ca.key"]); err != nil {
+		log.Println("The etcd ca isn't available before the join, skip the etcd quorum check")
+		return nil, nil, nil
+	}
+	var client *pkg.EtcdClient
+	var members []pkg.EtcdMember
+	var peerURL string
+	err := retry.Do(ctx, "check the etcd quorum", c.backoff.WithTimeout(c.etcdJoinTimeout), func(ctx context.Context) error {
+		instances, err := c.provider.Peers(ctx)
 		if err != nil {
-			log.Fatalln("Could not create directory : " + err.Error())
+			return err
+		}
+		for _, i := range instances {
+			if i.ID == c.instanceID {
+				peerURL = "https://" + i.PrivateIP + ":2380"
+			}
 		}
-		err = pkg.DownloadMapFromS3(svc, bucket, &caKeys)
+		if peerURL == "" {
+			return errors.New("this controller isn't among the active " + c.provider.Name() + " peers")
+		}
+		target, err := c.provider.DesiredCapacity(ctx)
 		if err != nil {
-			log.Fatalln("Download create directory : " + err.Error())
+			return err
 		}
-	} else {
-		log.Println("Pki doesn't  exist create ite during kube setup")
+		if client, err = c.etcd(ctx, instances); err != nil {
+			return err
+		}
+		members, err = pkg.CheckEtcdJoin(ctx, client, pkg.EtcdJoinCheck{
+			PeerURL:   peerURL,
+			Target:    target,
+			AllowEven: c.allowEvenEtcd,
+		})
+		if _, ok := err.(*pkg.EvenMembersError); ok {
+			return retry.Permanent(errors.New(err.Error() + ", remove stale members or pass --allow-even-etcd"))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Println("etcd has a leader and all " + strconv.Itoa(len(members)) + " members are healthy")
+	for _, m := range members {
+		if m.HasPeerURL(peerURL) {
+			if !m.IsLearner {
+				log.Println("This controller is already a voting etcd member")
+				return client, nil, nil
+			}
+			log.Println("Reuse the etcd learner " + strconv.FormatUint(m.ID, 16) + " of an interrupted join")
+			learner := m
+			return client, &learner, nil
+		}
+	}
+	status, err := client.Status(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
+	if !pkg.EtcdSupportsLearners(status.Version) {
+		log.Println("etcd " + status.Version + " doesn't know learners, kubeadm adds a voting member")
+		return client, nil, nil
+	}
+	learner, err := client.MemberAddLearner(ctx, []string{peerURL})
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Println("Added the etcd learner " + strconv.FormatUint(learner.ID, 16) + " for " + peerURL)
+	return client, learner, nil
+}
 
-	err := pkg.DownloadFromS3(svc, bucket, "kubeadm-cfg-init.yaml", clusterConfig["kubeadm-cfg-init.yaml"])
+//promoteLearner makes the learner a voting member once it caught up
+func (c *controller) promoteLearner(ctx context.Context, client *pkg.EtcdClient, learner *pkg.EtcdMember) error {
+	err := retry.Do(ctx, "promote the etcd learner", c.backoff.WithTimeout(c.etcdJoinTimeout), func(ctx context.Context) error {
+		return client.MemberPromote(ctx, learner.ID)
+	})
 	if err != nil {
-		log.Fatalln("Could not download from S3 : " + err.Error())
-	} else {
-		log.Println("Downloaded kubeadm.cfg")
+		return err
 	}
-	createController()
-	if val, err := pkg.ExistsOnS3(svc, bucket, &caKeys); err != nil {
-		log.Fatalln("Could not check if package exists: " + err.Error())
-	} else if !val {
-		err = pkg.UploadMapToS3(svc, bucket, &caKeys)
+	log.Println("Promoted the etcd learner " + strconv.FormatUint(learner.ID, 16))
+	return nil
+}
+
+func (c *controller) joinCluster(ctx context.Context) error {
+	if err := c.download(ctx, "cluster-info.yaml"); err != nil {
+		return err
+	}
+	c.reconcileBeforeJoin(ctx)
+	etcdClient, learner, err := c.prepareEtcdJoin(ctx)
+	if err != nil {
+		return errors.New("etcd isn't ready for another member: " + err.Error())
+	}
+	if err := c.waitJoinConfig(ctx, true); err != nil {
+		return errors.New("could not write the join config: " + err.Error())
+	}
+
+	args := []string{
+		"join",
+		c.apiDNS + ":" + strconv.Itoa(c.apiPort),
+		"--config",
+		c.files["kubeadm-cfg-join.yaml"],
+	}
+	if c.pkiMode == pkiModeUploadCerts {
+		key, err := c.waitCertificateKey(ctx)
 		if err != nil {
-			log.Fatalln("Could not upload pki to S3 : " + err.Error())
+			return err
 		}
+		args = append(args, "--certificate-key", key.Key)
 	}
-	err = pkg.UploadToS3(svc, bucket, "cluster-info.yaml", clusterConfig["cluster-info.yaml"])
-	if err != nil {
-		log.Fatalln("Could not upload cluster info to S3 : " + err.Error())
+	if _, err := c.runner.Run("kubeadm", append(args, "--control-plane")...); err != nil {
+		return errors.New("kubeadm join failed: " + err.Error())
 	}
+	if learner != nil {
+		return c.promoteLearner(ctx, etcdClient, learner)
+	}
+	return nil
 }
 
-func deployController(apiDNS string, apiPort int, bucket string) {
-	sess, err := session.NewSession()
+//waitCertificateKey waits till a certificate key that isn't stale is published
+func (c *controller) waitCertificateKey(ctx context.Context) (*pkg.CertificateKey, error) {
+	var key *pkg.CertificateKey
+	err := retry.Do(ctx, "wait for a certificate key", c.backoff, func(ctx context.Context) error {
+		var err error
+		key, err = pkg.GetCertificateKey(c.store, c.kp, joinConfigMinValidity, time.Now())
+		if err == pkg.ErrCertificateKeyStale {
+			return errors.New("the certificate key expires at " + key.Expires.Format(time.RFC3339) + ", wait for a refreshed one")
+		}
+		return err
+	})
+	return key, err
+}
+
+//refreshCertificateKey uploads the certificates with a new certificate key
+//and publishes the key. Unless forced, a published key that is valid for
+//more than half of its ttl is kept. Nothing is done if the pki is copied
+//through the secret store.
+func (c *controller) refreshCertificateKey(force bool) error {
+	if c.pkiMode != pkiModeUploadCerts {
+		return nil
+	}
+	if !force {
+		if _, err := pkg.GetCertificateKey(c.store, c.kp, pkg.CertificateKeyTTL/2, time.Now()); err == nil {
+			return nil
+		}
+	}
+	key, err := pkg.GenerateCertificateKey()
 	if err != nil {
-		log.Fatalln("Could not initialize aws session: " + err.Error())
-	} else {
-		log.Println("AWS Session started")
+		return err
+	}
+	expires := time.Now().Add(pkg.CertificateKeyTTL)
+	if err := pkg.UploadCerts(c.runner, c.kubeconfig, key); err != nil {
+		return err
 	}
-	metaSvc := ec2metadata.New(sess)
-	instanceID, err := pkg.GetInstanceID(metaSvc)
+	store, err := c.leaderStore()
 	if err != nil {
-		log.Fatalln("Could not get instance id: " + err.Error())
-	} else {
-		log.Println("Got instance ec2 instance id: " + instanceID)
+		return err
 	}
+	log.Println("Publish a certificate key that expires at " + expires.Format(time.RFC3339))
+	return pkg.PublishCertificateKey(store, c.kp, &pkg.CertificateKey{Key: key, Expires: expires})
+}
 
-	region, err := pkg.GetRegion(metaSvc)
+//pkiPublished checks if the secret store holds what controllers need to join
+func (c *controller) pkiPublished() (bool, error) {
+	if c.pkiMode == pkiModeUploadCerts {
+		return c.store.Exists(pkg.CertificateKeyKey)
+	}
+	return pkg.ExistsInStore(c.store, &c.pki)
+}
+
+//refreshJoinConfig creates a bootstrap token and publishes a join config
+//for it. Unless forced, a published config that is valid for more than half
+//of the token ttl is kept.
+func (c *controller) refreshJoinConfig(force bool) error {
+	if !force {
+		if _, err := pkg.GetJoinConfig(c.store, c.tokenTTL/2, time.Now()); err == nil {
+			return nil
+		}
+	}
+	caCert, err := ioutil.ReadFile(c.pki["ca.crt"])
 	if err != nil {
-		log.Fatalln("Could not get the region: " + err.Error())
-	} else {
-		log.Println("Got the region: " + region)
+		return err
 	}
-	autoSvc := autoscaling.New(sess, aws.NewConfig().WithRegion(region))
-	s3Svc := s3.New(sess, aws.NewConfig().WithRegion(region))
-	groupName, err := pkg.GetAutoscalingGroupName(autoSvc, instanceID)
+	hash, err := pkg.CACertHash(caCert)
 	if err != nil {
-		log.Fatalln("Could not get the autoscaling group name: " + err.Error())
-	} else {
-		log.Println("Got the autoscaling group name: " + groupName)
+		return errors.New("could not hash ca.crt: " + err.Error())
+	}
+	expires := time.Now().Add(c.tokenTTL)
+	token, err := pkg.CreateBootstrapToken(c.runner, c.kubeconfig, c.tokenTTL)
+	if err != nil {
+		return err
+	}
+	store, err := c.leaderStore()
+	if err != nil {
+		return err
+	}
+	log.Println("Publish a join config that expires at " + expires.Format(time.RFC3339))
+	return pkg.PublishJoinConfig(store, &pkg.JoinConfig{
+		APIEndpoint: c.apiDNS + ":" + strconv.Itoa(c.apiPort),
+		Token:       token,
+		CACertHash:  hash,
+		Expires:     expires,
+	})
+}
+
+//publish stores what the other controllers need to join. Joined
+//controllers only refresh an expiring join config or certificate key.
+func (c *controller) publish(ctx context.Context, state *pkg.BootstrapState) error {
+	if state.Action == pkg.ActionJoin {
+		if err := c.refreshJoinConfig(false); err != nil {
+			log.Println("Could not refresh the join config: " + err.Error())
+		}
+		if err := c.refreshCertificateKey(false); err != nil {
+			log.Println("Could not refresh the certificate key: " + err.Error())
+		}
+		return nil
+	}
+
+	if err := c.writeClusterInfo(); err != nil {
+		return err
+	}
+	store, err := c.leaderStore()
+	if err != nil {
+		return err
+	}
+	if c.pkiMode == pkiModeStore {
+		if val, err := pkg.ExistsInStore(store, &c.pki); err != nil {
+			return errors.New("could not check if package exists: " + err.Error())
+		} else if !val {
+			if err := pkg.UploadMap(store, &c.pki, c.kp); err != nil {
+				return errors.New("could not upload pki to the secret store : " + err.Error())
+			}
+		}
+	}
+	if err := pkg.Upload(store, "cluster-info.yaml", c.files["cluster-info.yaml"]); err != nil {
+		return errors.New("could not upload cluster info to the secret store : " + err.Error())
 	}
-	group, err := pkg.GetAutoscalingGroup(autoSvc, groupName)
+	if err := c.refreshJoinConfig(true); err != nil {
+		return errors.New("could not publish the join config: " + err.Error())
+	}
+	c.releaseLease()
+	return nil
+}
+
+//lead keeps the leader lease alive till the init is published. Losing the
+//lease cancels the init, the fenced writes of a stale leader fail anyway.
+func (c *controller) lead(lock *pkg.LeaderLock) {
+	c.lock = lock
+	c.token = lock.Token()
+	c.stopLease = make(chan struct{})
+	lost, done := lock.KeepAlive(c.leaseRenew, c.stopLease)
+	c.leaseDone = done
+	go func() {
+		for err := range lost {
+			log.Println("Lost the leader lease during init: " + err.Error())
+			c.leaseMu.Lock()
+			c.leaseErr = err
+			c.leaseMu.Unlock()
+			if c.cancelInit != nil {
+				c.cancelInit()
+			}
+		}
+	}()
+}
+
+//lostLease returns why the leader lease was lost, nil while it is held
+func (c *controller) lostLease() error {
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	return c.leaseErr
+}
+
+//leaderStore returns the secret store with the writes fenced by the token
+//of the leader lease while it is held, so a controller that lost the lease
+//can't overwrite what the next leader published. Joined controllers fence
+//their writes with the token of the last lease.
+func (c *controller) leaderStore() (pkg.SecretStore, error) {
+	if c.lock != nil {
+		return pkg.NewFencedStore(c.store, c.token)
+	}
+	if c.lockStore == nil {
+		return nil, errors.New("the secret store does not support fenced writes")
+	}
+	token, err := pkg.LeaseToken(c.lockStore, leaderLockKey)
 	if err != nil {
-		log.Fatalln("Could not get the autoscaling group : " + err.Error())
+		return nil, errors.New("could not read the leader lease: " + err.Error())
 	}
+	return pkg.NewFencedStore(c.store, token)
+}
 
-	if pkg.KubeUp("127.0.0.1", apiPort) {
-		log.Println("Kubernetes is already running")
+func (c *controller) releaseLease() {
+	if c.lock == nil {
 		return
 	}
+	close(c.stopLease)
+	<-c.leaseDone
+	if err := c.lock.Release(); err != nil {
+		log.Println("Could not release the leader lease: " + err.Error())
+	}
+	c.lock = nil
+}
 
+func (c *controller) discover(ctx context.Context, state *pkg.BootstrapState) error {
+	if health := c.apiHealth("127.0.0.1", c.apiPort); health != pkg.APIUnreachable {
+		log.Println("Kubernetes is already running, the local api server is " + health.String())
+		state.Phase = pkg.PhaseDone
+		return nil
+	}
+	if err := c.prepareAirGap(c.cni.Name()); err != nil {
+		return err
+	}
 	log.Println("Wait till DNS resolves")
-	pkg.DNSResolves(apiDNS)
+	return c.dnsResolves(ctx, c.apiDNS)
+}
 
+//elect decides if this controller inits the cluster as the holder of the
+//leader lease or joins it
+func (c *controller) elect(ctx context.Context, state *pkg.BootstrapState) error {
 	log.Println("Start deployment loop")
-	for {
-		kubeStatus := pkg.KubeUp(apiDNS, apiPort)
-		if kubeStatus {
-			log.Println("k8s is running")
-		} else {
-			log.Println("k8s isn't running")
+	return retry.Do(ctx, "elect the leader", c.backoff, func(ctx context.Context) error {
+		health := c.apiHealth(c.apiDNS, c.apiPort)
+		log.Println("k8s api server is " + health.String())
+		switch health {
+		case pkg.APIUnhealthy:
+			return errors.New("k8s is running, but isn't healthy yet")
+		case pkg.APITLSFailure:
+			return errors.New("the api server at " + c.apiDNS + " isn't trusted, it doesn't belong to this cluster or isn't ready yet")
 		}
+		kubeStatus := health == pkg.APIHealthy
 
 		if !kubeStatus {
-			err = pkg.WaitTillCapacityReached(group, 600)
+			if err := pkg.WaitTillCapacityReached(ctx, c.provider, c.capacityInterval, capacityTimeout); err != nil {
+				return retry.Permanent(errors.New("capacity of the controllers was not reached : " + err.Error()))
+			}
+			lock := pkg.NewLeaderLock(c.lockStore, leaderLockKey, c.instanceID, leaseDuration)
+			acquired, err := lock.TryAcquire()
 			if err != nil {
-				log.Fatalln("Capacity of autoscaling group was not reached : " + err.Error())
+				return retry.Permanent(errors.New("could not acquire the leader lease: " + err.Error()))
 			}
-			if instanceID == pkg.GetAutoscalingInstances(group)[0] {
-				initController(s3Svc, bucket)
-				return
+			if acquired {
+				log.Println("Acquired the leader lease with fencing token " + strconv.FormatInt(lock.Token(), 10))
+				if health := c.apiHealth(c.apiDNS, c.apiPort); health != pkg.APIUnreachable {
+					if err := lock.Release(); err != nil {
+						log.Println("Could not release the leader lease: " + err.Error())
+					}
+					return errors.New("k8s came up while acquiring the lease, its api server is " + health.String() + ", join instead")
+				}
+				c.lead(lock)
+				state.Action = pkg.ActionInit
+				return nil
 			}
 		}
 
-		caExists, err := pkg.ExistsOnS3(s3Svc, bucket, &caKeys)
+		caExists, err := c.pkiPublished()
 		if err != nil {
-			log.Fatalln("Could not fetch pki status from S3: " + err.Error())
+			return retry.Permanent(errors.New("could not fetch pki status from the secret store: " + err.Error()))
 		}
 		if kubeStatus && caExists {
-			joinController(s3Svc, apiDNS, apiPort, bucket)
-			return
+			state.Action = pkg.ActionJoin
+			return nil
+		}
+		if kubeStatus {
+			return errors.New("k8s is running, but the pki isn't published yet")
+		}
+		return errors.New("another controller holds the leader lease")
+	})
+}
+
+func (c *controller) kubeadm(ctx context.Context, state *pkg.BootstrapState) error {
+	if state.Resumed() {
+		if err := c.reset(); err != nil {
+			return err
+		}
+	}
+	if state.Action == pkg.ActionInit {
+		return c.initCluster()
+	}
+	return c.joinCluster(ctx)
+}
+
+func (c *controller) network(ctx context.Context, state *pkg.BootstrapState) error {
+	if state.Action == pkg.ActionJoin {
+		return nil
+	}
+	log.Println("---- Deploy " + c.cni.Name() + " ----")
+	if err := pkg.Download(c.store, "kubeadm-cfg-init.yaml", c.files["kubeadm-cfg-init.yaml"]); err != nil {
+		return errors.New("could not download from the secret store : " + err.Error())
+	}
+	return c.deployNetwork(ctx)
+}
+
+//resumeLeadership takes the leader lease again after an interrupted init.
+//If another controller took it meanwhile the init can't be resumed.
+func (c *controller) resumeLeadership() error {
+	lock := pkg.NewLeaderLock(c.lockStore, leaderLockKey, c.instanceID, leaseDuration)
+	acquired, err := lock.TryAcquire()
+	if err != nil {
+		return errors.New("could not acquire the leader lease: " + err.Error())
+	}
+	if !acquired {
+		return errors.New("another controller holds the leader lease, the interrupted init can't be resumed, run kubeadm reset and remove " + c.state.Path())
+	}
+	log.Println("Acquired the leader lease again with fencing token " + strconv.FormatInt(lock.Token(), 10))
+	c.lead(lock)
+	return nil
+}
+
+//deploy bootstraps the controller and completes the launch lifecycle hook
+//with the result
+func (c *controller) deploy(ctx context.Context) error {
+	return c.withLifecycleHook(func() error {
+		return c.bootstrap(ctx)
+	})
+}
+
+//bootstrap runs the phases of the controller, an interrupted bootstrap is
+//resumed at the phase it stopped at
+func (c *controller) bootstrap(ctx context.Context) error {
+	state, err := c.state.Load("controller")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.cancelInit = cancel
+	defer c.releaseLease()
+	if state.Action == pkg.ActionInit && state.Phase != pkg.PhaseDone {
+		if err := c.resumeLeadership(); err != nil {
+			return err
+		}
+	}
+	err = pkg.RunPhases(ctx, c.state, state, []pkg.Step{
+		{Phase: pkg.PhaseDiscover, Run: c.discover},
+		{Phase: pkg.PhaseElect, Run: c.elect},
+		{Phase: pkg.PhaseFetchPKI, Run: c.fetchPki},
+		{Phase: pkg.PhaseKubeadm, Run: c.kubeadm},
+		{Phase: pkg.PhaseCNI, Run: c.network},
+		{Phase: pkg.PhasePublish, Run: c.publish},
+	})
+	if lost := c.lostLease(); lost != nil {
+		return errors.New("lost the leader lease during init: " + lost.Error())
+	}
+	return err
+}
+
+func deployController(apiDNS string, apiPort int) {
+	sess, region, identity := cloudSession()
+	log.Println("Got the region: " + region)
+	kp, err := newKeyProvider(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the key provider: " + err.Error())
+	}
+	store, err := newSecretStore(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
+	}
+	cni, err := pkg.GetNetworkPlugin(cniName)
+	if err != nil {
+		log.Fatalln("Could not select the network plugin: " + err.Error())
+	}
+	if err := validatePkiMode(kp); err != nil {
+		log.Fatalln(err.Error())
+	}
+	switch restorePolicy {
+	case restorePolicyNever, restorePolicyLatest, restorePolicyRequired:
+	default:
+		log.Fatalln("Unknown --restore-policy " + restorePolicy + ", use " + restorePolicyNever + ", " + restorePolicyLatest + " or " + restorePolicyRequired)
+	}
+	if restorePolicy != restorePolicyNever && pkiMode != pkiModeStore {
+		log.Fatalln("--restore-policy=" + restorePolicy + " needs --pki-mode=" + pkiModeStore + ", the restored cluster has to keep its pki")
+	}
+	name, err := localNodeName()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	lockStore, ok := store.(pkg.LockStore)
+	if !ok {
+		log.Fatalln("The secret store does not support leader election, use a s3:// or file:// store")
+	}
+
+	provider, err := newCloudProvider(sess, identity)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	lifecycle, err := newLifecycleAction(sess, identity)
+	if err != nil {
+		log.Fatalln("Could not set up the lifecycle hook: " + err.Error())
+	}
+	ctx, cancel := bootstrapContext()
+	defer cancel()
+	self, err := selfAddress(ctx, provider)
+	if err != nil {
+		log.Fatalln("Could not find this controller among the peers: " + err.Error())
+	}
+	log.Println("Got the " + provider.Name() + " identity " + self.ID)
+
+	c := &controller{
+		node:             newNode(apiDNS, apiPort, store),
+		instanceID:       self.ID,
+		pki:              caKeys,
+		pkiMode:          pkiMode,
+		kp:               kp,
+		cni:              cni,
+		tokenTTL:         tokenTTL,
+		restorePolicy:    restorePolicy,
+		nodeName:         name,
+		lockStore:        lockStore,
+		provider:         provider,
+		etcd:             remoteEtcd(caKeys, self.ID),
+		allowEvenEtcd:    allowEvenEtcd,
+		etcdJoinTimeout:  etcdJoinTimeout,
+		capacityInterval: capacityInterval,
+		leaseRenew:       leaseRenewInterval,
+	}
+	c.lifecycle = lifecycle
+	if err := c.deploy(ctx); err != nil {
+		log.Fatalln("Could not deploy the controller: " + err.Error())
+	}
+}
+
+func refreshJoinConfig(apiDNS string, apiPort int) {
+	sess, region, _ := cloudSession()
+	kp, err := newKeyProvider(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the key provider: " + err.Error())
+	}
+	store, err := newSecretStore(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
+	}
+	if err := validatePkiMode(kp); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	lockStore, ok := store.(pkg.LockStore)
+	if !ok {
+		log.Fatalln("The secret store does not support fenced writes, use a s3:// or file:// store")
+	}
+
+	c := &controller{
+		node:      newNode(apiDNS, apiPort, store),
+		pki:       caKeys,
+		pkiMode:   pkiMode,
+		kp:        kp,
+		tokenTTL:  tokenTTL,
+		lockStore: lockStore,
+	}
+	if health := c.apiHealth("127.0.0.1", c.apiPort); health != pkg.APIHealthy {
+		log.Fatalln("Kubernetes isn't healthy on this controller, its api server is " + health.String())
+	}
+	if err := c.refreshJoinConfig(false); err != nil {
+		log.Fatalln("Could not refresh the join config: " + err.Error())
+	}
+	if err := c.refreshCertificateKey(false); err != nil {
+		log.Fatalln("Could not refresh the certificate key: " + err.Error())
+	}
+}
+
+//validatePkiMode checks the pki mode and that the certificate key is only
+//kept encrypted
+func validatePkiMode(kp pkg.KeyProvider) error {
+	switch pkiMode {
+	case pkiModeStore:
+		return nil
+	case pkiModeUploadCerts:
+		if kp == nil {
+			return errors.New("--pki-mode=" + pkiModeUploadCerts + " needs --key-file or --kms-key-id to encrypt the certificate key")
 		}
-		time.Sleep(time.Second * 1)
+		return nil
 	}
+	return errors.New("unknown pki mode " + pkiMode + ", use " + pkiModeStore + " or " + pkiModeUploadCerts)
 }
 
 var controllerCmd = &cobra.Command{
 	Use:   "controller",
 	Short: "Deploy controller",
-	Long:  `Deploys a HA controller on AWS.`,
+	Long: `Deploys a HA controller. On AWS the peers are the instances of the
+autoscaling group, off EC2 they are listed with --provider=static or
+discovered from a SRV record with --provider=dns-srv.
+
+A joining controller is added to etcd as a learner first and promoted once
+kubeadm joined and it caught up. That needs etcd 3.4 and kubeadm 1.19, with an
+older etcd kubeadm adds a voting member right away.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Println("Start provisioning of the controller")
-		deployController(kubeAddress, kubePort, bucket)
+		deployController(kubeAddress, kubePort)
+	},
+}
+
+var refreshJoinConfigCmd = &cobra.Command{
+	Use:   "refresh-join-config",
+	Short: "Refresh the join config",
+	Long: `Publishes a join config with a new bootstrap token if the current one
+expires within half of the token ttl. With --pki-mode=upload-certs the
+certificates are uploaded again with a new certificate key the same way.
+Run it periodically on the controllers.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		refreshJoinConfig(kubeAddress, kubePort)
 	},
 }
 
 func init() {
+	controllerCmd.Flags().StringVar(&cniName, "cni", "weave", "Network plugin: "+strings.Join(pkg.NetworkPluginNames(), ", "))
+	controllerCmd.Flags().BoolVar(&allowEvenEtcd, "allow-even-etcd", false, "Join even if the cluster ends with an even number of etcd members")
+	controllerCmd.Flags().StringVar(&restorePolicy, "restore-policy", restorePolicyNever, "Restore etcd from the latest backup when a new cluster is initialized: "+restorePolicyNever+", "+restorePolicyLatest+" if there is one or "+restorePolicyRequired+". A restore needs --pki-mode="+pkiModeStore+" and etcdutl or etcdctl on the host")
+	controllerCmd.PersistentFlags().StringVar(&pkiMode, "pki-mode", pkiModeStore, "How joining controllers get the pki: "+pkiModeStore+" copies it through the secret store, "+pkiModeUploadCerts+" uses kubeadm --upload-certs")
+	controllerCmd.PersistentFlags().DurationVar(&tokenTTL, "token-ttl", time.Hour*2, "Lifetime of the bootstrap tokens of the published join config")
+	controllerCmd.AddCommand(refreshJoinConfigCmd)
 	RootCmd.AddCommand(controllerCmd)
 }
@@ -0,0 +1,992 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+)
+
+type mockAutoScalingClient struct {
+	autoscalingiface.AutoScalingAPI
+	instances []string
+	//terminating are the instances held by a termination hook
+	terminating []string
+	//desired is the desired capacity, the number of instances if 0
+	desired int
+	//pending are Pending without a launch lifecycle hook for the first
+	//pendingFor describes of the group
+	pending    []string
+	pendingFor int
+	describes  int
+
+	mu          sync.Mutex
+	heartbeats  int
+	completions []string
+}
+
+func (m *mockAutoScalingClient) RecordLifecycleActionHeartbeat(input *autoscaling.RecordLifecycleActionHeartbeatInput) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heartbeats++
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+func (m *mockAutoScalingClient) CompleteLifecycleAction(input *autoscaling.CompleteLifecycleActionInput) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.completions = append(m.completions, aws.StringValue(input.LifecycleActionResult))
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (m *mockAutoScalingClient) DescribeAutoScalingInstances(input *autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	return &autoscaling.DescribeAutoScalingInstancesOutput{
+		AutoScalingInstances: []*autoscaling.InstanceDetails{
+			{
+				AutoScalingGroupName: aws.String("controller"),
+				InstanceId:           input.InstanceIds[0],
+			},
+		},
+	}, nil
+}
+
+//launch adds an instance to the group
+func (m *mockAutoScalingClient) launch(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.instances = append(m.instances, id)
+}
+
+//terminate removes an instance from the group
+func (m *mockAutoScalingClient) terminate(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, instance := range m.instances {
+		if instance == id {
+			m.instances = append(m.instances[:i:i], m.instances[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *mockAutoScalingClient) group() *autoscaling.Group {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.describes++
+	desired := m.desired
+	if desired == 0 {
+		desired = len(m.instances)
+	}
+	group := &autoscaling.Group{
+		AutoScalingGroupName: aws.String("controller"),
+		DesiredCapacity:      aws.Int64(int64(desired)),
+	}
+	for _, id := range m.instances {
+		state := autoscaling.LifecycleStateInService
+		for _, terminating := range m.terminating {
+			if id == terminating {
+				state = autoscaling.LifecycleStateTerminatingWait
+			}
+		}
+		for _, pending := range m.pending {
+			if id == pending && m.describes <= m.pendingFor {
+				state = autoscaling.LifecycleStatePending
+			}
+		}
+		group.Instances = append(group.Instances, &autoscaling.Instance{
+			InstanceId:     aws.String(id),
+			LifecycleState: aws.String(state),
+		})
+	}
+	return group
+}
+
+func (m *mockAutoScalingClient) DescribeAutoScalingGroups(input *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []*autoscaling.Group{m.group()}}, nil
+}
+
+func (m *mockAutoScalingClient) DescribeAutoScalingGroupsPagesWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool, opts ...request.Option) error {
+	fn(&autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []*autoscaling.Group{m.group()}}, true)
+	return nil
+}
+
+//mockEC2Client knows the private IP of the instances, their DNS names are
+//derived from it like in a VPC
+type mockEC2Client struct {
+	ec2iface.EC2API
+	addresses map[string]string
+}
+
+func (m *mockEC2Client) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	reservation := &ec2.Reservation{}
+	for _, id := range input.InstanceIds {
+		ip, ok := m.addresses[*id]
+		if !ok {
+			continue
+		}
+		reservation.Instances = append(reservation.Instances, &ec2.Instance{
+			InstanceId:       id,
+			PrivateIpAddress: aws.String(ip),
+			PrivateDnsName:   aws.String("ip-" + strings.Replace(ip, ".", "-", -1) + ".ec2.internal"),
+		})
+	}
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, true)
+	return nil
+}
+
+//kubeProbe answers the health probe for the local api server and with a
+//sequence of answers for the load balanced one, the last answer repeats.
+//apiUp answers healthy or unreachable, health overrides it with any result.
+type kubeProbe struct {
+	mu      sync.Mutex
+	localUp bool
+	apiUp   []bool
+	health  []pkg.APIHealth
+}
+
+func upHealth(up bool) pkg.APIHealth {
+	if up {
+		return pkg.APIHealthy
+	}
+	return pkg.APIUnreachable
+}
+
+func (p *kubeProbe) apiHealth(apiDNS string, apiPort int) pkg.APIHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if apiDNS == "127.0.0.1" {
+		return upHealth(p.localUp)
+	}
+	if len(p.health) > 0 {
+		health := p.health[0]
+		if len(p.health) > 1 {
+			p.health = p.health[1:]
+		}
+		return health
+	}
+	up := p.apiUp[0]
+	if len(p.apiUp) > 1 {
+		p.apiUp = p.apiUp[1:]
+	}
+	return upHealth(up)
+}
+
+func newTestNode(dir string, runner pkg.Runner, probe *kubeProbe) node {
+	return node{
+		apiDNS:     "api.k8s.local",
+		apiPort:    6443,
+		store:      pkg.NewFileStore(filepath.Join(dir, "store")),
+		runner:     runner,
+		kubeconfig: filepath.Join(dir, "admin.conf"),
+		files: map[string]string{
+			"cluster-info.yaml":     filepath.Join(dir, "cluster-info.yaml"),
+			"kubeadm-cfg-init.yaml": filepath.Join(dir, "cluster-cfg.yaml"),
+			"kubeadm-cfg-join.yaml": filepath.Join(dir, "cluster-join.yaml"),
+		},
+		apiHealth:   probe.apiHealth,
+		dnsResolves: func(context.Context, string) error { return nil },
+		backoff:     retry.Backoff{Initial: time.Millisecond, Max: time.Millisecond, Factor: 1},
+		state:       pkg.NewStateFile(filepath.Join(dir, "state.json")),
+	}
+}
+
+//awsMocks returns the mocks behind the aws provider of the controller
+func awsMocks(c *controller) (*mockAutoScalingClient, *mockEC2Client) {
+	p := c.provider.(*pkg.AWSProvider)
+	return p.AutoScaling().(*mockAutoScalingClient), p.EC2().(*mockEC2Client)
+}
+
+//withFourControllers adds a fourth instance to the group of the controller
+func withFourControllers(c *controller) {
+	autoSvc, ec2Svc := awsMocks(c)
+	autoSvc.instances = append(autoSvc.instances, "i-623adsf")
+	ec2Svc.addresses["i-623adsf"] = "10.0.6.10"
+}
+
+func newTestController(dir string, runner pkg.Runner, probe *kubeProbe) *controller {
+	pki := map[string]string{}
+	for name := range caKeys {
+		pki[name] = filepath.Join(dir, "pki", name)
+	}
+	n := newTestNode(dir, runner, probe)
+	cni, _ := pkg.GetNetworkPlugin("weave")
+	return &controller{
+		node:          n,
+		instanceID:    "i-143adsf",
+		pki:           pki,
+		pkiMode:       pkiModeStore,
+		cni:           cni,
+		tokenTTL:      time.Hour,
+		restorePolicy: restorePolicyNever,
+		nodeName:      "ip-10-0-1-10",
+		lockStore:     n.store.(pkg.LockStore),
+		provider: pkg.NewAWSProvider(
+			&mockAutoScalingClient{instances: []string{"i-143adsf", "i-423adsf", "i-523adsf"}},
+			&mockEC2Client{addresses: map[string]string{
+				"i-143adsf": "10.0.1.10",
+				"i-423adsf": "10.0.2.10",
+				"i-523adsf": "10.0.5.10",
+			}},
+			pkg.InstanceAddress{ID: "i-143adsf", PrivateIP: "10.0.1.10"},
+		),
+		etcd: func(context.Context, []pkg.InstanceAddress) (*pkg.EtcdClient, error) {
+			return nil, errors.New("etcd isn't reachable")
+		},
+		etcdJoinTimeout:  time.Millisecond * 100,
+		capacityInterval: time.Millisecond,
+		leaseRenew:       leaseRenewInterval,
+	}
+}
+
+//withTestLifecycleHook sets up the launch lifecycle hook of the controller
+func withTestLifecycleHook(c *controller) *mockAutoScalingClient {
+	svc, _ := awsMocks(c)
+	c.lifecycle = pkg.NewLifecycleAction(svc, "controller", "launch", c.instanceID)
+	c.heartbeatInterval = time.Millisecond
+	return svc
+}
+
+//checkLifecycleHook checks that the hook got heartbeats and was completed once with result
+func checkLifecycleHook(t *testing.T, svc *mockAutoScalingClient, result string) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.heartbeats == 0 {
+		t.Errorf("expect heartbeats during the bootstrap")
+	}
+	if e, a := []string{result}, svc.completions; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect the lifecycle hook to be completed with %v, got %v", e, a)
+	}
+}
+
+const testCACert = `-----BEGIN CERTIFICATE-----
+MIIBgjCCASegAwIBAgIUDciP4x4A7vZHz+ujpkKVuvrYFMMwCgYIKoZIzj0EAwIw
+FTETMBEGA1UEAwwKa3ViZXJuZXRlczAgFw0yNjEwMTcwNTQwMDBaGA8yMTI2MDky
+MzA1NDAwMFowFTETMBEGA1UEAwwKa3ViZXJuZXRlczBZMBMGByqGSM49AgEGCCqG
+SM49AwEHA0IABJxYKXO+V7tsc++sSAENtQW+5C7TjFjKkI+gMULx04efgTqNveli
+EcOA0HAcmumpeCIVGwtRxDDI47AyQtzzntmjUzBRMB0GA1UdDgQWBBRF0bPb1R42
+2ZT++x7v9Vx4xGOFKTAfBgNVHSMEGDAWgBRF0bPb1R422ZT++x7v9Vx4xGOFKTAP
+BgNVHRMBAf8EBTADAQH/MAoGCCqGSM49BAMCA0kAMEYCIQD7fKMJbrAF76/9Ms9V
+pl5obmFZMcJEHEC70ALsgH6JNQIhAJTbOtemmPBhrobQKg5XLpTETPmYEC8SJ9PA
+fu53PiRD
+-----END CERTIFICATE-----
+`
+
+//pkiContent returns the content of a fake pki file, ca.crt has to be a
+//certificate to compute the hash of the join config
+func pkiContent(name string) []byte {
+	if name == "ca.crt" {
+		return []byte(testCACert)
+	}
+	return []byte(name)
+}
+
+//writePki is used as the kubeadm init fake, it creates the pki like kubeadm would
+func writePki(c *controller) func([]string) {
+	return func([]string) {
+		c.createPkiDirs()
+		for name, p := range c.pki {
+			ioutil.WriteFile(p, pkiContent(name), 0600)
+		}
+	}
+}
+
+func putPki(t *testing.T, store pkg.SecretStore) {
+	for name := range caKeys {
+		if err := store.Put(name, pkiContent(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Put("cluster-info.yaml", []byte("cluster-info"))
+	publishJoinConfig(t, store, time.Now().Add(time.Hour))
+}
+
+func publishJoinConfig(t *testing.T, store pkg.SecretStore, expires time.Time) {
+	err := pkg.PublishJoinConfig(store, &pkg.JoinConfig{
+		APIEndpoint: "api.k8s.local:6443",
+		Token:       "abcdef.0123456789abcdef",
+		CACertHash:  "sha256:60a4bab0e1ad36c1424d6a662ea850f7ca1be29ed28ba790388c9708fed9a510",
+		Expires:     expires,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func holdLease(t *testing.T, store pkg.SecretStore, holder string) {
+	dat, _ := json.Marshal(pkg.Lease{Holder: holder, Token: 1, Expires: time.Now().Add(time.Hour)})
+	if err := store.Put(leaderLockKey, dat); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const kubeadmInitConfig = `apiVersion: kubeadm.k8s.io/v1beta2
+kind: ClusterConfiguration
+controlPlaneEndpoint: api.k8s.local:6443
+networking:
+  podSubnet: 10.32.0.0/16
+`
+
+//restoreConfig is a kubeadm config that sets the advertise address of the
+//etcd member
+const restoreConfig = `apiVersion: kubeadm.k8s.io/v1beta2
+kind: InitConfiguration
+localAPIEndpoint:
+  advertiseAddress: 10.0.1.10
+---
+` + kubeadmInitConfig
+
+//checkRestoreRecord checks the recorded restore decision
+func checkRestoreRecord(t *testing.T, store pkg.SecretStore, decision string) {
+	record := pkg.RestoreRecord{}
+	dat, err := store.Get(pkg.RestoreRecordKey)
+	if err != nil {
+		t.Fatalf("expect a restore record, got %v", err)
+	}
+	json.Unmarshal(dat, &record)
+	if e, a := decision, record.Decision; e != a {
+		t.Errorf("expect restore decision %v, got %v", e, a)
+	}
+}
+
+func TestControllerDeploy(t *testing.T) {
+	cases := []struct {
+		name    string
+		probe   *kubeProbe
+		prepare func(t *testing.T, c *controller)
+		script  func(c *controller) []pkgtest.FakeCall
+		check   func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner)
+		//etcd prepares the etcd cluster of ip-10-0-2-10 and ip-10-0-5-10
+		//the controller joins and checks it after the deploy
+		etcd  func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T)
+		init  bool
+		join  bool
+		fails bool
+	}{
+		{
+			name:  "kubernetes already runs locally",
+			probe: &kubeProbe{localUp: true, apiUp: []bool{true}},
+		},
+		{
+			name:  "init with a free lease",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			init:  true,
+		},
+		{
+			name:  "a pending instance doesn't count toward the capacity",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				autoSvc, _ := awsMocks(c)
+				autoSvc.pending = []string{"i-523adsf"}
+				autoSvc.pendingFor = 6
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				autoSvc, _ := awsMocks(c)
+				if autoSvc.describes <= autoSvc.pendingFor {
+					t.Errorf("expect the init to wait till the pending instance is in service, the group was described %v times", autoSvc.describes)
+				}
+			},
+			init: true,
+		},
+		{
+			name:    "init reuses an existing pki",
+			probe:   &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			init:    true,
+		},
+		{
+			name:    "join a running cluster",
+			probe:   &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			join:    true,
+		},
+		{
+			name:  "wait for the lease holder and join",
+			probe: &kubeProbe{apiUp: []bool{false, false, true}},
+			prepare: func(t *testing.T, c *controller) {
+				putPki(t, c.store)
+				holdLease(t, c.store, "i-423adsf")
+			},
+			join: true,
+		},
+		{
+			name:    "join as an etcd learner and promote it once it caught up",
+			probe:   &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			etcd: func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T) {
+				f.lagging = 2
+				return func(t *testing.T) {
+					m := f.member("https://10.0.1.10:2380")
+					if m == nil || m.IsLearner {
+						t.Errorf("expect a promoted etcd member, got %v", m)
+					} else if e, a := []uint64{m.ID}, f.promoted; !reflect.DeepEqual(e, a) {
+						t.Errorf("expect the promotion of %v, got %v", e, a)
+					}
+				}
+			},
+			join: true,
+		},
+		{
+			name:    "let kubeadm add a voting member to an etcd without learners",
+			probe:   &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			etcd: func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T) {
+				f.version = "3.3.15"
+				return func(t *testing.T) {
+					if m := f.member("https://10.0.1.10:2380"); m != nil {
+						t.Errorf("expect no learner to be added before the join, got %v", m)
+					}
+					if len(f.promoted) != 0 {
+						t.Errorf("expect no promotion, got %v", f.promoted)
+					}
+				}
+			},
+			join: true,
+		},
+		{
+			name:  "join with static peers off EC2",
+			probe: &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) {
+				putPki(t, c.store)
+				c.instanceID = "ip-10-0-1-10"
+				c.provider = pkg.NewStaticProvider("ip-10-0-1-10=10.0.1.10,ip-10-0-2-10=10.0.2.10,ip-10-0-5-10=10.0.5.10", "", c.nodeName)
+			},
+			etcd: func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T) {
+				return func(t *testing.T) {
+					if m := f.member("https://10.0.1.10:2380"); m == nil || m.IsLearner {
+						t.Errorf("expect a promoted etcd member, got %v", m)
+					}
+				}
+			},
+			join: true,
+		},
+		{
+			name:    "reuse the etcd learner of an interrupted join",
+			probe:   &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			etcd: func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T) {
+				learner := f.add("", []string{"https://10.0.1.10:2380"}, true)
+				return func(t *testing.T) {
+					if e, a := []uint64{learner.ID}, f.promoted; !reflect.DeepEqual(e, a) {
+						t.Errorf("expect the promotion of %v, got %v", e, a)
+					}
+					if e, a := 3, len(f.members); e != a {
+						t.Errorf("expect %v etcd members, got %v", e, a)
+					}
+				}
+			},
+			join: true,
+		},
+		{
+			name:    "don't join while an etcd member is unhealthy",
+			probe:   &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			etcd: func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T) {
+				f.unhealthy["ip-10-0-5-10"] = true
+				return func(t *testing.T) {
+					if m := f.member("https://10.0.1.10:2380"); m != nil {
+						t.Errorf("expect no etcd member to be added, got %v", m)
+					}
+				}
+			},
+			fails: true,
+		},
+		{
+			name:    "don't join an etcd without a leader",
+			probe:   &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			etcd: func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T) {
+				f.leader = 0
+				return nil
+			},
+			fails: true,
+		},
+		{
+			name:    "refuse an even number of etcd members",
+			probe:   &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			etcd: func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T) {
+				f.add("ip-10-0-6-10", []string{"https://10.0.6.10:2380"}, false)
+				withFourControllers(c)
+				return nil
+			},
+			fails: true,
+		},
+		{
+			name:    "join an even number of etcd members with an override",
+			probe:   &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			etcd: func(t *testing.T, c *controller, f *fakeEtcd) func(t *testing.T) {
+				f.add("ip-10-0-6-10", []string{"https://10.0.6.10:2380"}, false)
+				withFourControllers(c)
+				c.allowEvenEtcd = true
+				return nil
+			},
+			join: true,
+		},
+		{
+			name:    "wait while the api server is unhealthy and join",
+			probe:   &kubeProbe{health: []pkg.APIHealth{pkg.APIUnhealthy, pkg.APIUnhealthy, pkg.APIHealthy}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			join:    true,
+		},
+		{
+			name:    "an untrusted api server isn't taken for a missing cluster",
+			probe:   &kubeProbe{health: []pkg.APIHealth{pkg.APITLSFailure, pkg.APIHealthy}},
+			prepare: func(t *testing.T, c *controller) { putPki(t, c.store) },
+			join:    true,
+		},
+		{
+			name:  "join if kubernetes came up while acquiring the lease",
+			probe: &kubeProbe{apiUp: []bool{false, true}},
+			prepare: func(t *testing.T, c *controller) {
+				putPki(t, c.store)
+			},
+			join: true,
+		},
+		{
+			name:  "init with uploaded certs",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.pkiMode = pkiModeUploadCerts
+			},
+			init: true,
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				key, err := pkg.GetCertificateKey(c.store, nil, 0, time.Now())
+				if err != nil {
+					t.Fatalf("expect a published certificate key, got %v", err)
+				}
+				if e, a := 1, runner.Called("kubeadm", "init", "--config", c.files["kubeadm-cfg-init.yaml"], "--upload-certs", "--certificate-key", key.Key); e != a {
+					t.Errorf("expect kubeadm init to upload the certs, got %v", runner.Calls())
+				}
+				if ok, _ := c.store.Exists("ca.key"); ok {
+					t.Errorf("expect the pki not to be copied to the secret store")
+				}
+			},
+		},
+		{
+			name:  "join with uploaded certs",
+			probe: &kubeProbe{apiUp: []bool{true}},
+			prepare: func(t *testing.T, c *controller) {
+				c.pkiMode = pkiModeUploadCerts
+				c.store.Put("cluster-info.yaml", []byte("cluster-info"))
+				publishJoinConfig(t, c.store, time.Now().Add(time.Hour))
+				pkg.PublishCertificateKey(c.store, nil, &pkg.CertificateKey{Key: "stale", Expires: time.Now()})
+				go func() {
+					time.Sleep(time.Millisecond * 20)
+					pkg.PublishCertificateKey(c.store, nil, &pkg.CertificateKey{Key: "0123", Expires: time.Now().Add(pkg.CertificateKeyTTL)})
+				}()
+			},
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{{Command: []string{"kubeadm", "join"}, Do: writePki(c)}}
+			},
+			join: true,
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if e, a := 1, runner.Called("kubeadm", "join", "api.k8s.local:6443", "--config", c.files["kubeadm-cfg-join.yaml"], "--certificate-key", "0123"); e != a {
+					t.Errorf("expect kubeadm join with the refreshed certificate key, got %v", runner.Calls())
+				}
+			},
+		},
+		{
+			name:  "resume an interrupted init",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.state.Save(&pkg.BootstrapState{Role: "controller", Action: pkg.ActionInit, Phase: pkg.PhaseKubeadm, Started: true})
+			},
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{{Command: []string{"kubeadm", "reset", "-f"}}}
+			},
+			init: true,
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if e, a := []string{"kubeadm", "reset", "-f"}, runner.Calls()[0]; !reflect.DeepEqual(e, a) {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+				if state, _ := c.state.Load("controller"); state.Phase != pkg.PhaseDone {
+					t.Errorf("expect the bootstrap to be done, got %v", state.Phase)
+				}
+			},
+		},
+		{
+			name:  "resume the publish phase of an init",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				writePki(c)(nil)
+				c.state.Save(&pkg.BootstrapState{Role: "controller", Action: pkg.ActionInit, Phase: pkg.PhasePublish, Started: true})
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if runner.Called("kubeadm", "init") > 0 || runner.Called("kubectl", "apply") > 0 {
+					t.Errorf("expect completed phases to be skipped, got %v", runner.Calls())
+				}
+				if ok, err := pkg.ExistsInStore(c.store, &c.pki); err != nil || !ok {
+					t.Errorf("expect pki to be uploaded, got %v %v", ok, err)
+				}
+			},
+		},
+		{
+			name:  "losing the lease stops the init",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.leaseRenew = time.Millisecond
+			},
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{{Command: []string{"kubeadm", "init"}, Do: func(args []string) {
+					writePki(c)(args)
+					holdLease(t, c.store, "i-423adsf")
+					time.Sleep(time.Millisecond * 50)
+				}}}
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if runner.Called("kubectl", "apply") > 0 {
+					t.Errorf("expect no phase to start after the lease was lost, got %v", runner.Calls())
+				}
+				if ok, _ := c.store.Exists("cluster-info.yaml"); ok {
+					t.Errorf("expect no cluster info to be published")
+				}
+			},
+			init:  true,
+			fails: true,
+		},
+		{
+			name:  "a stale leader can't overwrite what a newer leader published",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				newer, err := pkg.NewFencedStore(c.store, 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				newer.Put("cluster-info.yaml", []byte("newer"))
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if dat, _ := c.store.Get("cluster-info.yaml"); string(dat) != "newer" {
+					t.Errorf("expect the cluster info of the newer leader to be kept, got %s", dat)
+				}
+				if _, err := c.store.Get(pkg.JoinConfigKey); err != pkg.ErrNotFound {
+					t.Errorf("expect no join config to be published, got %v", err)
+				}
+			},
+			init:  true,
+			fails: true,
+		},
+		{
+			name:  "resume an init while another controller leads",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				holdLease(t, c.store, "i-423adsf")
+				c.state.Save(&pkg.BootstrapState{Role: "controller", Action: pkg.ActionInit, Phase: pkg.PhaseCNI})
+			},
+			fails: true,
+		},
+		{
+			name:  "bootstrap is done",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.state.Save(&pkg.BootstrapState{Role: "controller", Action: pkg.ActionJoin, Phase: pkg.PhaseDone})
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if e, a := 0, len(runner.Calls()); e != a {
+					t.Errorf("expect no calls, got %v", runner.Calls())
+				}
+			},
+		},
+		{
+			name:  "network plugin without pod subnet",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.cni, _ = pkg.GetNetworkPlugin("flannel")
+				c.store.Put("kubeadm-cfg-init.yaml", []byte("kind: ClusterConfiguration\n"))
+			},
+			fails: true,
+		},
+		{
+			name:  "air-gapped without image archives",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.airGapped = true
+				c.imageDir = filepath.Join(filepath.Dir(c.kubeconfig), "images")
+			},
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{{Command: []string{"kubeadm", "config", "images", "list"}, Output: []byte("k8s.gcr.io/pause:3.1")}}
+			},
+			fails: true,
+		},
+		{
+			name:  "failing kubeadm init",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{{Command: []string{"kubeadm", "init"}, ExitCode: 1}}
+			},
+			init:  true,
+			fails: true,
+		},
+		{
+			name:  "restore the latest backup",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.restorePolicy = restorePolicyLatest
+				c.store.Put("kubeadm-cfg-init.yaml", []byte(restoreConfig))
+				pkg.UploadBackup(c.store, nil, []byte("snapshot"), time.Now())
+			},
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{
+					{Command: []string{"etcdutl", "version"}},
+					{Command: []string{"etcdutl", "snapshot", "restore"}, Do: func(args []string) {
+						if dat, _ := ioutil.ReadFile(args[2]); string(dat) != "snapshot" {
+							t.Errorf("expect the snapshot to be restored, got %s", dat)
+						}
+					}},
+				}
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				var restore, init []string
+				for _, call := range runner.Calls() {
+					if call[0] == "etcdutl" {
+						restore = call
+					} else if len(call) > 1 && call[1] == "init" {
+						init = call
+					}
+				}
+				expected := []string{"--data-dir", "/var/lib/etcd", "--name", "ip-10-0-1-10", "--initial-cluster", "ip-10-0-1-10=https://10.0.1.10:2380", "--initial-advertise-peer-urls", "https://10.0.1.10:2380"}
+				if len(restore) < 4 || !reflect.DeepEqual(expected, restore[4:]) {
+					t.Errorf("expect etcdutl %v, got %v", expected, restore)
+				}
+				if e, a := "--ignore-preflight-errors=DirAvailable--var-lib-etcd", init[len(init)-1]; e != a {
+					t.Errorf("expect %v, got %v", e, a)
+				}
+				checkRestoreRecord(t, c.store, pkg.RestoreDecisionRestored)
+			},
+			init: true,
+		},
+		{
+			name:  "restore with the etcdctl of etcd 3.4",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.restorePolicy = restorePolicyLatest
+				c.store.Put("kubeadm-cfg-init.yaml", []byte(restoreConfig))
+				pkg.UploadBackup(c.store, nil, []byte("snapshot"), time.Now())
+			},
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{
+					{Command: []string{"etcdutl"}, ExitCode: 127},
+					{Command: []string{"env", "ETCDCTL_API=3", "etcdctl"}},
+				}
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if runner.Called("env", "ETCDCTL_API=3", "etcdctl", "snapshot", "restore") != 1 {
+					t.Errorf("expect etcdctl to restore the snapshot, got %v", runner.Calls())
+				}
+				checkRestoreRecord(t, c.store, pkg.RestoreDecisionRestored)
+			},
+			init: true,
+		},
+		{
+			name:  "refuse to restore without an etcd client on the host",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.restorePolicy = restorePolicyLatest
+				c.store.Put("kubeadm-cfg-init.yaml", []byte(restoreConfig))
+				pkg.UploadBackup(c.store, nil, []byte("snapshot"), time.Now())
+			},
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{
+					{Command: []string{"etcdutl"}, ExitCode: 127},
+					{Command: []string{"env", "ETCDCTL_API=3", "etcdctl"}, ExitCode: 127},
+				}
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if _, err := c.store.Get(pkg.RestoreRecordKey); err != pkg.ErrNotFound {
+					t.Errorf("expect no restore decision to be recorded, got %v", err)
+				}
+			},
+			fails: true,
+		},
+		{
+			name:  "refuse to restore with uploaded certs",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.pkiMode = pkiModeUploadCerts
+				c.restorePolicy = restorePolicyLatest
+				c.store.Put("kubeadm-cfg-init.yaml", []byte(restoreConfig))
+				pkg.UploadBackup(c.store, nil, []byte("snapshot"), time.Now())
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if runner.Called("etcdutl") > 0 || runner.Called("env") > 0 {
+					t.Errorf("expect no restore, got %v", runner.Calls())
+				}
+			},
+			fails: true,
+		},
+		{
+			name:  "backup is ignored without a restore policy",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				pkg.UploadBackup(c.store, nil, []byte("snapshot"), time.Now())
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				if runner.Called("etcdutl") > 0 {
+					t.Errorf("expect no restore, got %v", runner.Calls())
+				}
+				checkRestoreRecord(t, c.store, pkg.RestoreDecisionSkipped)
+			},
+			init: true,
+		},
+		{
+			name:  "required restore without a backup",
+			probe: &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) {
+				c.restorePolicy = restorePolicyRequired
+			},
+			fails: true,
+		},
+		{
+			name:    "lifecycle hook continues after init",
+			probe:   &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) { withTestLifecycleHook(c) },
+			script: func(c *controller) []pkgtest.FakeCall {
+				init := writePki(c)
+				return []pkgtest.FakeCall{{Command: []string{"kubeadm", "init"}, Do: func(args []string) {
+					time.Sleep(time.Millisecond * 10)
+					init(args)
+				}}}
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				autoSvc, _ := awsMocks(c)
+				checkLifecycleHook(t, autoSvc, pkg.LifecycleActionContinue)
+			},
+			init: true,
+		},
+		{
+			name:    "lifecycle hook is abandoned after a failing kubeadm init",
+			probe:   &kubeProbe{apiUp: []bool{false}},
+			prepare: func(t *testing.T, c *controller) { withTestLifecycleHook(c) },
+			script: func(c *controller) []pkgtest.FakeCall {
+				return []pkgtest.FakeCall{{Command: []string{"kubeadm", "init"}, ExitCode: 1, Do: func([]string) {
+					time.Sleep(time.Millisecond * 10)
+				}}}
+			},
+			check: func(t *testing.T, c *controller, runner *pkgtest.ScriptedRunner) {
+				autoSvc, _ := awsMocks(c)
+				checkLifecycleHook(t, autoSvc, pkg.LifecycleActionAbandon)
+			},
+			init:  true,
+			fails: true,
+		},
+	}
+
+	for _, tc := range cases {
+		dir, err := ioutil.TempDir("", "k8sinit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		runner := pkgtest.NewScriptedRunner()
+		c := newTestController(dir, runner, tc.probe)
+		etcd := newFakeEtcd("ip-10-0-2-10", "ip-10-0-5-10")
+		c.etcd = func(context.Context, []pkg.InstanceAddress) (*pkg.EtcdClient, error) {
+			return pkg.NewEtcdClient(etcd.URL, nil), nil
+		}
+		var checkEtcd func(t *testing.T)
+		if tc.etcd != nil {
+			checkEtcd = tc.etcd(t, c, etcd)
+		}
+		if tc.script != nil {
+			runner.Add(tc.script(c)...)
+		}
+		runner.Add(
+			pkgtest.FakeCall{Command: []string{"kubeadm", "init"}, Do: writePki(c)},
+			pkgtest.FakeCall{Command: []string{"kubeadm", "join"}},
+			pkgtest.FakeCall{Command: []string{"kubectl", "--kubeconfig", c.kubeconfig, "version"}, Output: []byte("v1.14.0")},
+			pkgtest.FakeCall{Command: []string{"kubectl", "apply"}},
+			pkgtest.FakeCall{Command: []string{"kubeadm", "token", "create"}, Output: []byte("ghijkl.0123456789abcdef\n")},
+			pkgtest.FakeCall{Command: []string{"kubectl", "--kubeconfig", c.kubeconfig, "get", "cm"}, Output: []byte("cluster-info")},
+		)
+		c.store.Put("kubeadm-cfg-init.yaml", []byte(kubeadmInitConfig))
+		c.store.Put("cni/weave.yaml", []byte("kind: DaemonSet"))
+		if tc.prepare != nil {
+			tc.prepare(t, c)
+		}
+
+		err = c.deploy(context.Background())
+		if tc.fails && err == nil {
+			t.Errorf("%s: expect error", tc.name)
+		} else if !tc.fails && err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		if e, a := tc.init, runner.Called("kubeadm", "init") > 0; e != a {
+			t.Errorf("%s: expect kubeadm init %v, got %v", tc.name, e, a)
+		}
+		if e, a := tc.join, runner.Called("kubeadm", "join", "api.k8s.local:6443") > 0; e != a {
+			t.Errorf("%s: expect kubeadm join %v, got %v", tc.name, e, a)
+		}
+		if tc.join {
+			last := runner.Calls()[len(runner.Calls())-1]
+			if e, a := "--control-plane", last[len(last)-1]; e != a {
+				t.Errorf("%s: expect %v, got %v", tc.name, e, a)
+			}
+		}
+		if tc.check != nil {
+			tc.check(t, c, runner)
+		}
+		if checkEtcd != nil {
+			checkEtcd(t)
+		}
+		etcd.Close()
+		if tc.init && !tc.fails && c.pkiMode == pkiModeStore {
+			if ok, err := pkg.ExistsInStore(c.store, &c.pki); err != nil || !ok {
+				t.Errorf("%s: expect pki to be uploaded, got %v %v", tc.name, ok, err)
+			}
+			if dat, _ := c.store.Get("cluster-info.yaml"); !strings.Contains(string(dat), "cluster-info") {
+				t.Errorf("%s: expect cluster info to be uploaded, got %s", tc.name, dat)
+			}
+			lease := pkg.Lease{}
+			dat, _ := c.store.Get(leaderLockKey)
+			json.Unmarshal(dat, &lease)
+			if lease.Expires.After(time.Now()) {
+				t.Errorf("%s: expect the lease to be released", tc.name)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLeaderStoreOfAJoinedController(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newTestController(dir, pkgtest.NewScriptedRunner(), &kubeProbe{})
+	dat, _ := json.Marshal(pkg.Lease{Holder: "i-423adsf", Token: 3, Expires: time.Now()})
+	if err := c.store.Put(leaderLockKey, dat); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := c.leaderStore()
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if err := store.Put(pkg.JoinConfigKey, []byte("refreshed")); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	stale, _ := pkg.NewFencedStore(c.store, 2)
+	if err := stale.Put(pkg.JoinConfigKey, []byte("stale")); err != pkg.ErrStaleToken {
+		t.Errorf("expect a stale leader not to overwrite the refresh, got %v", err)
+	}
+	if dat, _ := c.store.Get(pkg.JoinConfigKey); string(dat) != "refreshed" {
+		t.Errorf("expect the refreshed join config to be kept, got %s", dat)
+	}
+}
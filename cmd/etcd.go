@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"io/ioutil"
+)
+
+var etcdEndpoint string
+
+//newEtcdClient connects to the etcd member at endpoint with a client
+//certificate issued by the etcd ca of the pki
+func newEtcdClient(pki map[string]string, endpoint string) (*pkg.EtcdClient, error) {
+	caCert, err := ioutil.ReadFile(pki["etcd-ca.crt"])
+	if err != nil {
+		return nil, errors.New("could not read the etcd ca: " + err.Error())
+	}
+	caKey, err := ioutil.ReadFile(pki["etcd-ca.key"])
+	if err != nil {
+		return nil, errors.New("could not read the etcd ca key: " + err.Error())
+	}
+	tlsConfig, err := pkg.EtcdClientTLS(caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewEtcdClient(endpoint, tlsConfig), nil
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+)
+
+//fakeEtcd is an etcd 3.5 cluster behind the grpc gateway. All members are
+//served by one server, the client url of a member ends with its name.
+type fakeEtcd struct {
+	*httptest.Server
+	mu        sync.Mutex
+	members   []pkg.EtcdMember
+	nextID    uint64
+	leader    uint64
+	unhealthy map[string]bool
+	removed   *[]string
+	//lagging is how often the promotion of a learner is refused
+	lagging  int
+	promoted []uint64
+	//version is the etcd version the members report
+	version string
+}
+
+//newFakeEtcd starts a cluster of the members names, the first one leads
+func newFakeEtcd(names ...string) *fakeEtcd {
+	f := &fakeEtcd{nextID: 1, leader: 1, version: "3.5.0", unhealthy: map[string]bool{}, removed: &[]string{}}
+	f.Server = httptest.NewServer(f)
+	for _, name := range names {
+		f.add(name, []string{namedPeerURL(name)}, false)
+	}
+	return f
+}
+
+//namedPeerURL returns the peer url of a member named after its node
+func namedPeerURL(name string) string {
+	return "https://" + strings.Replace(strings.TrimPrefix(name, "ip-"), "-", ".", -1) + ":2380"
+}
+
+func (f *fakeEtcd) add(name string, peerURLs []string, learner bool) pkg.EtcdMember {
+	m := pkg.EtcdMember{ID: f.nextID, Name: name, PeerURLs: peerURLs, IsLearner: learner}
+	if name != "" {
+		m.ClientURLs = []string{f.URL + "/" + name}
+	}
+	f.nextID++
+	f.members = append(f.members, m)
+	return m
+}
+
+//start names the member with peerURL and serves it like kubeadm started
+//etcd on it, a voting member is added if there is none
+func (f *fakeEtcd) start(name string, peerURL string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.members {
+		if f.members[i].HasPeerURL(peerURL) {
+			f.members[i].Name = name
+			f.members[i].ClientURLs = []string{f.URL + "/" + name}
+			return
+		}
+	}
+	f.add(name, []string{peerURL}, false)
+}
+
+//member returns the member with peerURL
+func (f *fakeEtcd) member(peerURL string) *pkg.EtcdMember {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.members {
+		if m.HasPeerURL(peerURL) {
+			return &m
+		}
+	}
+	return nil
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := ""
+	path := r.URL.Path
+	if !strings.HasPrefix(path, "/v3/") {
+		parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+		name, path = parts[0], "/"+parts[len(parts)-1]
+	}
+	in := struct {
+		ID        uint64   `json:"ID,string"`
+		PeerURLs  []string `json:"peerURLs"`
+		IsLearner bool     `json:"isLearner"`
+	}{}
+	json.NewDecoder(r.Body).Decode(&in)
+	switch path {
+	case "/v3/cluster/member/list":
+		json.NewEncoder(w).Encode(map[string]interface{}{"members": f.members})
+	case "/v3/cluster/member/remove":
+		for i, m := range f.members {
+			if m.ID == in.ID {
+				*f.removed = append(*f.removed, m.Name)
+				f.members = append(f.members[:i], f.members[i+1:]...)
+				break
+			}
+		}
+		w.Write([]byte("{}"))
+	case "/v3/cluster/member/add":
+		m := f.add("", in.PeerURLs, in.IsLearner)
+		json.NewEncoder(w).Encode(map[string]interface{}{"member": m, "members": f.members})
+	case "/v3/cluster/member/promote":
+		if f.lagging > 0 {
+			f.lagging--
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "etcdserver: can only promote a learner member which is in sync with leader", "code": 9}`))
+			return
+		}
+		for i := range f.members {
+			if f.members[i].ID == in.ID {
+				f.members[i].IsLearner = false
+			}
+		}
+		f.promoted = append(f.promoted, in.ID)
+		w.Write([]byte("{}"))
+	case "/v3/maintenance/status":
+		status := pkg.EtcdStatus{Version: f.version, Leader: f.leader}
+		if f.unhealthy[name] {
+			status.Errors = []string{"NOSPACE"}
+		}
+		json.NewEncoder(w).Encode(status)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//emptyDirDataMinor is the kubectl 1.x minor version that renamed
+//--delete-local-data to --delete-emptydir-data
+const emptyDirDataMinor = 20
+
+//leaveRequestTimeout is how long a worker waits for a controller to pick up
+//its leave request on top of the drain timeout
+const leaveRequestTimeout = time.Minute * 5
+
+var drainTimeout time.Duration
+
+//leaver takes a node out of the cluster
+type leaver struct {
+	node
+	nodeName     string
+	instanceID   string
+	pki          map[string]string
+	drainTimeout time.Duration
+	etcd         func() (*pkg.EtcdClient, error)
+}
+
+//isController tells if the node runs an etcd member, only controllers have
+//the etcd ca
+func (l *leaver) isController() bool {
+	_, err := os.Stat(l.pki["etcd-ca.key"])
+	return err == nil
+}
+
+//emptyDirFlag returns the drain flag that deletes emptyDir data, kubectl
+//1.20 deprecated --delete-local-data in favor of --delete-emptydir-data
+func emptyDirFlag(runner pkg.Runner, kubeconfig string) (string, error) {
+	out, err := runner.Run("kubectl", "--kubeconfig", kubeconfig, "version", "--client", "-o", "json")
+	if err != nil {
+		return "", errors.New("could not get the kubectl version: " + err.Error())
+	}
+	var version struct {
+		ClientVersion struct {
+			Major string `json:"major"`
+			Minor string `json:"minor"`
+		} `json:"clientVersion"`
+	}
+	if err := json.Unmarshal(out, &version); err != nil {
+		return "", errors.New("could not parse the kubectl version: " + err.Error())
+	}
+	major, err := strconv.Atoi(version.ClientVersion.Major)
+	if err != nil {
+		return "", errors.New("could not parse the kubectl version: " + err.Error())
+	}
+	//Vendor builds report minor versions like 20+
+	minor, err := strconv.Atoi(strings.TrimRight(version.ClientVersion.Minor, "+"))
+	if err != nil {
+		return "", errors.New("could not parse the kubectl version: " + err.Error())
+	}
+	if major > 1 || minor >= emptyDirDataMinor {
+		return "--delete-emptydir-data", nil
+	}
+	return "--delete-local-data", nil
+}
+
+//drainNode cordons and drains a node
+func drainNode(runner pkg.Runner, kubeconfig string, name string, timeout time.Duration) error {
+	emptyDir, err := emptyDirFlag(runner, kubeconfig)
+	if err != nil {
+		return err
+	}
+	log.Println("Cordon and drain " + name)
+	if _, err := runner.Run("kubectl", "--kubeconfig", kubeconfig, "cordon", name); err != nil {
+		return errors.New("could not cordon " + name + ": " + err.Error())
+	}
+	if _, err := runner.Run(
+		"kubectl",
+		"--kubeconfig",
+		kubeconfig,
+		"drain",
+		name,
+		"--ignore-daemonsets",
+		emptyDir,
+		"--force",
+		"--timeout",
+		timeout.String(),
+	); err != nil {
+		return errors.New("could not drain " + name + ": " + err.Error())
+	}
+	return nil
+}
+
+func deleteNode(runner pkg.Runner, kubeconfig string, name string) error {
+	log.Println("Delete the node " + name)
+	if _, err := runner.Run("kubectl", "--kubeconfig", kubeconfig, "delete", "node", name, "--ignore-not-found"); err != nil {
+		return errors.New("could not delete the node " + name + ": " + err.Error())
+	}
+	return nil
+}
+
+//waitEtcdLeave waits till the etcd member of the node can be removed
+//without losing the quorum
+func (l *leaver) waitEtcdLeave(ctx context.Context) error {
+	return retry.Do(ctx, "wait for the etcd quorum", l.backoff, func(ctx context.Context) error {
+		client, err := l.etcd()
+		if err != nil {
+			return err
+		}
+		return pkg.CheckEtcdLeave(ctx, client, l.nodeName)
+	})
+}
+
+//removeEtcdMember removes the member named after the node. The last member
+//is kept, removing it would lose the cluster. The quorum is checked again,
+//members may have failed while the node was drained.
+func (l *leaver) removeEtcdMember(ctx context.Context) error {
+	client, err := l.etcd()
+	if err != nil {
+		return err
+	}
+	if err := pkg.CheckEtcdLeave(ctx, client, l.nodeName); err != nil {
+		return err
+	}
+	members, err := client.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if m.Name != l.nodeName {
+			continue
+		}
+		if len(members) == 1 {
+			log.Println("The etcd member " + m.Name + " is the last one, keep it")
+			return nil
+		}
+		log.Println("Remove etcd member " + m.Name + " " + strconv.FormatUint(m.ID, 16))
+		return client.MemberRemove(ctx, m.ID)
+	}
+	log.Println("No etcd member named " + l.nodeName + ", it was removed before")
+	return nil
+}
+
+//leaveController drains the controller with the admin kubeconfig, removes
+//its etcd member and deletes its node. It waits till the member can go
+//without losing the quorum before it drains.
+func (l *leaver) leaveController(ctx context.Context) error {
+	if _, err := os.Stat(l.kubeconfig); err != nil {
+		return errors.New("no admin kubeconfig " + l.kubeconfig + " on the controller")
+	}
+	if err := l.waitEtcdLeave(ctx); err != nil {
+		return err
+	}
+	if err := drainNode(l.runner, l.kubeconfig, l.nodeName, l.drainTimeout); err != nil {
+		return err
+	}
+	if err := l.removeEtcdMember(ctx); err != nil {
+		return err
+	}
+	return deleteNode(l.runner, l.kubeconfig, l.nodeName)
+}
+
+//requestLeave asks the controllers to drain and delete the node of a worker
+//and waits till one did. Workers have no rights on other nodes, the reconcile
+//loop of a controller drains them with the admin credentials.
+func (l *leaver) requestLeave(ctx context.Context) error {
+	log.Println("Ask the controllers to drain and delete " + l.nodeName)
+	req := &pkg.LeaveRequest{Node: l.nodeName, InstanceID: l.instanceID, Requested: time.Now().UTC()}
+	if err := pkg.PutLeaveRequest(l.store, req); err != nil {
+		return err
+	}
+	return retry.Do(ctx, "wait till a controller drained "+l.nodeName, l.backoff.WithTimeout(l.drainTimeout+leaveRequestTimeout), func(ctx context.Context) error {
+		req, err := pkg.GetLeaveRequest(l.store, l.nodeName)
+		if err != nil {
+			return err
+		}
+		if req.Error != "" {
+			return errors.New("the controller could not drain the node: " + req.Error)
+		}
+		if !req.Done {
+			return errors.New("no controller drained the node yet")
+		}
+		return nil
+	})
+}
+
+//leave drains the node, removes its etcd member on controllers, deletes the
+//node object and resets kubeadm. Workers ask the controllers to drain and
+//delete their node. Every step can run again, so a failed leave can be
+//retried.
+func (l *leaver) leave(ctx context.Context) error {
+	controller := l.isController()
+	if controller {
+		if err := l.leaveController(ctx); err != nil {
+			return err
+		}
+	} else if err := l.requestLeave(ctx); err != nil {
+		return err
+	}
+	log.Println("Reset kubeadm")
+	if _, err := l.runner.Run("kubeadm", "reset", "-f"); err != nil {
+		return errors.New("kubeadm reset failed: " + err.Error())
+	}
+	if !controller {
+		if err := pkg.DeleteLeaveRequest(l.store, l.nodeName); err != nil {
+			log.Println("Could not delete the leave request: " + err.Error())
+		}
+	}
+	if err := os.Remove(l.state.Path()); err != nil && !os.IsNotExist(err) {
+		return errors.New("could not remove the bootstrap state: " + err.Error())
+	}
+	return nil
+}
+
+func leaveCluster(apiDNS string, apiPort int) {
+	sess, region, identity := cloudSession()
+	store, err := newSecretStore(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
+	}
+	name, err := localNodeName()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	l := &leaver{
+		node:         newNode(apiDNS, apiPort, store),
+		nodeName:     name,
+		pki:          caKeys,
+		drainTimeout: drainTimeout,
+	}
+	if identity != nil {
+		l.instanceID = identity.InstanceID
+	}
+	l.etcd = func() (*pkg.EtcdClient, error) { return newEtcdClient(l.pki, etcdEndpoint) }
+	if l.lifecycle, err = newLifecycleAction(sess, identity); err != nil {
+		log.Fatalln("Could not set up the lifecycle hook: " + err.Error())
+	}
+	ctx, cancel := bootstrapContext()
+	defer cancel()
+	if err := l.withLifecycleHook(func() error { return l.leave(ctx) }); err != nil {
+		log.Fatalln("Could not leave the cluster: " + err.Error())
+	}
+}
+
+var leaveCmd = &cobra.Command{
+	Use:   "leave",
+	Short: "Take this node out of the cluster",
+	Long: `Cordons and drains this node, removes its etcd member on controllers,
+deletes the node object and runs kubeadm reset. Run it from a termination
+lifecycle hook with --lifecycle-hook or from a systemd stop unit.
+
+Controllers use the admin kubeconfig and wait till their etcd member can be
+removed without losing the quorum. Workers have no rights to drain or
+delete nodes, they put a leave request into the secret store and wait till
+a controller running controller reconcile --interval drained and deleted
+their node.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		leaveCluster(kubeAddress, kubePort)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(leaveCmd)
+	leaveCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", time.Minute*5, "Time after which the drain gives up")
+}
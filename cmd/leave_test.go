@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+//kubectlVersion answers kubectl version --client -o json
+func kubectlVersion(kubeconfig string, minor string) pkgtest.FakeCall {
+	return pkgtest.FakeCall{
+		Command: []string{"kubectl", "--kubeconfig", kubeconfig, "version", "--client", "-o", "json"},
+		Output:  []byte(`{"clientVersion":{"major":"1","minor":"` + minor + `","gitVersion":"v1.` + minor + `.0"}}`),
+	}
+}
+
+//workerList has the worker ip-10-0-1-10 on the instance i-143adsf
+const workerList = `{"items": [
+	{"metadata": {"name": "ip-10-0-1-10"}, "spec": {"providerID": "aws:///eu-central-1a/i-143adsf"}},
+	{"metadata": {"name": "ip-10-0-2-10", "labels": {"node-role.kubernetes.io/control-plane": ""}}, "spec": {"providerID": "aws:///eu-central-1b/i-423adsf"}}
+]}`
+
+//drainingController handles the leave requests in the store like the
+//reconcile loop of a controller till the returned stop func is called
+func drainingController(store pkg.SecretStore, minor string) (*pkgtest.ScriptedRunner, func()) {
+	runner := pkgtest.NewScriptedRunner(
+		pkgtest.FakeCall{Command: []string{"kubectl", "--kubeconfig", "admin.conf", "get", "nodes"}, Output: []byte(workerList)},
+		kubectlVersion("admin.conf", minor),
+		pkgtest.FakeCall{Command: []string{"kubectl", "--kubeconfig", "admin.conf"}},
+	)
+	r := &reconciler{runner: runner, kubeconfig: "admin.conf", store: store, drainTimeout: time.Minute}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			r.reconcileLeaveRequests()
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	return runner, func() {
+		close(stop)
+		<-done
+	}
+}
+
+func TestLeave(t *testing.T) {
+	cases := []struct {
+		name       string
+		controller bool
+		members    []string
+		unhealthy  []string
+		minor      string
+		removed    []string
+		fails      bool
+	}{
+		{name: "controller", controller: true, members: []string{"ip-10-0-1-10", "ip-10-0-2-10"}, minor: "22", removed: []string{"ip-10-0-1-10"}},
+		{name: "last controller", controller: true, members: []string{"ip-10-0-1-10"}, minor: "22"},
+		{name: "removed controller", controller: true, members: []string{"ip-10-0-2-10"}, minor: "22"},
+		{
+			name:       "controller without quorum",
+			controller: true,
+			members:    []string{"ip-10-0-1-10", "ip-10-0-2-10", "ip-10-0-5-10"},
+			unhealthy:  []string{"ip-10-0-5-10"},
+			minor:      "22",
+			fails:      true,
+		},
+		{name: "worker", members: []string{"ip-10-0-2-10"}, minor: "22"},
+		{name: "old kubectl", members: []string{"ip-10-0-2-10"}, minor: "14"},
+		{name: "vendor kubectl", members: []string{"ip-10-0-2-10"}, minor: "21+"},
+	}
+	for _, tc := range cases {
+		dir, err := ioutil.TempDir("", "k8sinit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		etcd := newFakeEtcd(tc.members...)
+		for _, name := range tc.unhealthy {
+			etcd.unhealthy[name] = true
+		}
+		n := newTestNode(dir, nil, &kubeProbe{apiUp: []bool{true}})
+		l := &leaver{
+			node:         n,
+			nodeName:     "ip-10-0-1-10",
+			instanceID:   "i-143adsf",
+			pki:          map[string]string{"etcd-ca.key": filepath.Join(dir, "pki", "etcd", "ca.key")},
+			drainTimeout: time.Minute,
+			etcd:         func() (*pkg.EtcdClient, error) { return pkg.NewEtcdClient(etcd.URL, nil), nil },
+		}
+		l.state.Save(&pkg.BootstrapState{Role: "worker", Phase: pkg.PhaseDone})
+		kubeconfig := l.kubeconfig
+		runner := pkgtest.NewScriptedRunner(
+			kubectlVersion(kubeconfig, tc.minor),
+			pkgtest.FakeCall{Command: []string{"kubectl"}},
+			pkgtest.FakeCall{Command: []string{"kubeadm", "reset", "-f"}},
+		)
+		l.runner = runner
+		//The kubectl calls of workers run on the controller
+		kubectlRunner, stopController := runner, func() {}
+		if tc.controller {
+			os.MkdirAll(filepath.Dir(l.pki["etcd-ca.key"]), 0755)
+			ioutil.WriteFile(l.pki["etcd-ca.key"], []byte("key"), 0600)
+			ioutil.WriteFile(l.kubeconfig, []byte("admin"), 0600)
+		} else {
+			kubeconfig = "admin.conf"
+			kubectlRunner, stopController = drainingController(l.store, tc.minor)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		err = l.leave(ctx)
+		cancel()
+		stopController()
+		if tc.fails && err == nil {
+			t.Errorf("%s: expect error", tc.name)
+		} else if !tc.fails && err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		emptyDir := "--delete-emptydir-data"
+		if tc.minor == "14" {
+			emptyDir = "--delete-local-data"
+		}
+		drained := [][]string{
+			{"kubectl", "--kubeconfig", kubeconfig, "version", "--client", "-o", "json"},
+			{"kubectl", "--kubeconfig", kubeconfig, "cordon", "ip-10-0-1-10"},
+			{"kubectl", "--kubeconfig", kubeconfig, "drain", "ip-10-0-1-10", "--ignore-daemonsets", emptyDir, "--force", "--timeout", "1m0s"},
+			{"kubectl", "--kubeconfig", kubeconfig, "delete", "node", "ip-10-0-1-10", "--ignore-not-found"},
+		}
+		reset := [][]string{{"kubeadm", "reset", "-f"}}
+		expected := append(drained, reset...)
+		if !tc.controller {
+			expected = reset
+			listed := append([][]string{{"kubectl", "--kubeconfig", kubeconfig, "get", "nodes", "-o", "json"}}, drained...)
+			if e, a := listed, kubectlRunner.Calls(); !reflect.DeepEqual(e, a) {
+				t.Errorf("%s: expect the controller to run %v, got %v", tc.name, e, a)
+			}
+		}
+		if tc.fails {
+			expected = [][]string{}
+		}
+		if e, a := expected, runner.Calls(); !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expect %v, got %v", tc.name, e, a)
+		}
+		if _, err := l.store.Get(pkg.LeaveRequestKey(l.nodeName)); err != pkg.ErrNotFound {
+			t.Errorf("%s: expect the leave request to be deleted, got %v", tc.name, err)
+		}
+		if e, a := fmt.Sprint(tc.removed), fmt.Sprint(*etcd.removed); e != a {
+			t.Errorf("%s: expect the etcd members %v to be removed, got %v", tc.name, e, a)
+		}
+		if _, err := os.Stat(l.state.Path()); tc.fails == os.IsNotExist(err) {
+			t.Errorf("%s: expect the bootstrap state to be removed %v, got %v", tc.name, !tc.fails, err)
+		}
+		etcd.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLeaveWithoutKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner := pkgtest.NewScriptedRunner()
+	l := &leaver{
+		node:     newTestNode(dir, runner, &kubeProbe{apiUp: []bool{true}}),
+		nodeName: "ip-10-0-1-10",
+		pki:      map[string]string{"etcd-ca.key": filepath.Join(dir, "ca.key")},
+	}
+	ioutil.WriteFile(l.pki["etcd-ca.key"], []byte("key"), 0600)
+	//Controllers never fall back to the admin.conf of the secret store
+	l.store.Put("admin.conf", []byte("admin"))
+	if err := l.leave(context.Background()); err == nil {
+		t.Errorf("expect error without a kubeconfig")
+	}
+	if e, a := 0, len(runner.Calls()); e != a {
+		t.Errorf("expect no calls, got %v", runner.Calls())
+	}
+}
+
+func TestLeaveRequestRefused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner := pkgtest.NewScriptedRunner()
+	l := &leaver{
+		node:         newTestNode(dir, runner, &kubeProbe{apiUp: []bool{true}}),
+		nodeName:     "ip-10-0-2-10",
+		instanceID:   "i-423adsf",
+		drainTimeout: time.Minute,
+	}
+	//A worker can't ask the controllers to drain a control plane node
+	kubectlRunner, stopController := drainingController(l.store, "22")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	err = l.leave(ctx)
+	cancel()
+	stopController()
+	if err == nil {
+		t.Errorf("expect error")
+	}
+	if e, a := 0, len(runner.Calls()); e != a {
+		t.Errorf("expect no kubeadm reset, got %v", runner.Calls())
+	}
+	if e, a := 0, kubectlRunner.Called("kubectl", "--kubeconfig", "admin.conf", "drain"); e != a {
+		t.Errorf("expect the control plane node not to be drained, got %v", kubectlRunner.Calls())
+	}
+	req, err := pkg.GetLeaveRequest(l.store, l.nodeName)
+	if err != nil || req.Done || req.Error == "" {
+		t.Errorf("expect the leave request to keep the error, got %v %v", req, err)
+	}
+}
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+	"github.com/spf13/cobra"
+	"log"
+	"time"
+)
+
+const (
+	//leaveLockKey serializes the controllers that leave the cluster
+	leaveLockKey = "leave.lock"
+	//targetLifecycleTerminated is the target lifecycle state of an instance
+	//a scale in or an instance refresh picked
+	targetLifecycleTerminated = "Terminated"
+)
+
+var agentInterval time.Duration
+
+//lifecycleAgent waits till the autoscaling group terminates the instance and
+//takes it out of the cluster while the termination hook holds it. Controllers
+//leave one at a time and only if the etcd members that stay keep a quorum.
+type lifecycleAgent struct {
+	leaver
+	lockStore   pkg.LockStore
+	autoSvc     autoscalingiface.AutoScalingAPI
+	hook        string
+	targetState func() (string, error)
+	interval    time.Duration
+}
+
+//waitForTermination polls the target lifecycle state till it is Terminated
+func (a *lifecycleAgent) waitForTermination(ctx context.Context) error {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		state, err := a.targetState()
+		if err != nil {
+			log.Println("Could not get the target lifecycle state: " + err.Error())
+		} else if state == targetLifecycleTerminated {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+//terminationAction returns the action of the termination hook, nil if no
+//hook is set or the group doesn't hold the instance in Terminating:Wait
+func (a *lifecycleAgent) terminationAction() (*pkg.LifecycleAction, error) {
+	if a.hook == "" {
+		log.Println("No --lifecycle-hook is set, leave before the instance is gone")
+		return nil, nil
+	}
+	groupName, err := pkg.GetAutoscalingGroupName(a.autoSvc, a.instanceID)
+	if err != nil {
+		return nil, errors.New("could not get the autoscaling group name: " + err.Error())
+	}
+	group, err := pkg.GetAutoscalingGroup(a.autoSvc, groupName)
+	if err != nil {
+		return nil, errors.New("could not describe the autoscaling group: " + err.Error())
+	}
+	for _, i := range group.Instances {
+		if aws.StringValue(i.InstanceId) != a.instanceID {
+			continue
+		}
+		if state := aws.StringValue(i.LifecycleState); state != autoscaling.LifecycleStateTerminatingWait {
+			log.Println("The instance is " + state + ", no termination hook holds it")
+			return nil, nil
+		}
+		return pkg.NewLifecycleAction(a.autoSvc, groupName, a.hook, a.instanceID), nil
+	}
+	return nil, errors.New("the instance isn't in the autoscaling group " + groupName)
+}
+
+//acquireLeaveLock waits till no other controller leaves
+func (a *lifecycleAgent) acquireLeaveLock(ctx context.Context) (*pkg.LeaderLock, error) {
+	lock := pkg.NewLeaderLock(a.lockStore, leaveLockKey, a.instanceID, leaseDuration)
+	err := retry.Do(ctx, "acquire the leave lock", a.backoff, func(ctx context.Context) error {
+		acquired, err := lock.TryAcquire()
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			return errors.New("another controller is leaving")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Acquired the leave lock")
+	return lock, nil
+}
+
+//leaveGuarded leaves the cluster. Controllers hold the leave lock and wait
+//till their etcd member can be removed without losing the quorum.
+func (a *lifecycleAgent) leaveGuarded(ctx context.Context) error {
+	if !a.isController() {
+		return a.leave(ctx)
+	}
+	lock, err := a.acquireLeaveLock(ctx)
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	lost, done := lock.KeepAlive(leaseRenewInterval, stop)
+	go func() {
+		for err := range lost {
+			log.Println("Lost the leave lock: " + err.Error())
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+		if err := lock.Release(); err != nil {
+			log.Println("Could not release the leave lock: " + err.Error())
+		}
+	}()
+	return a.leave(ctx)
+}
+
+//run waits for the termination and leaves while heartbeats keep the
+//termination hook pending, the hook is completed afterwards
+func (a *lifecycleAgent) run(ctx context.Context) error {
+	log.Println("Wait till the autoscaling group terminates the instance")
+	if err := a.waitForTermination(ctx); err != nil {
+		return err
+	}
+	log.Println("The autoscaling group terminates the instance, leave the cluster")
+	action, err := a.terminationAction()
+	if err != nil {
+		log.Println("Could not find the termination hook: " + err.Error())
+	}
+	a.lifecycle = action
+	return a.withLifecycleHook(func() error { return a.leaveGuarded(ctx) })
+}
+
+func runLifecycleAgent(apiDNS string, apiPort int) {
+	if providerName != providerAWS {
+		log.Fatalln("The lifecycle agent needs --provider=" + providerAWS + ", only autoscaling groups terminate instances")
+	}
+	sess, metaSvc, identity := instanceSession()
+	instanceID, region := identity.InstanceID, identity.Region
+	store, err := newSecretStore(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
+	}
+	lockStore, ok := store.(pkg.LockStore)
+	if !ok {
+		log.Fatalln("The secret store does not support locks, use a s3:// or file:// store")
+	}
+	name, err := localNodeName()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	a := &lifecycleAgent{
+		leaver: leaver{
+			node:         newNode(apiDNS, apiPort, store),
+			nodeName:     name,
+			instanceID:   instanceID,
+			pki:          caKeys,
+			drainTimeout: drainTimeout,
+		},
+		lockStore:   lockStore,
+		autoSvc:     autoscaling.New(sess, aws.NewConfig().WithRegion(region)),
+		hook:        lifecycleHook,
+		targetState: metaSvc.GetTargetLifecycleState,
+		interval:    agentInterval,
+	}
+	a.etcd = func() (*pkg.EtcdClient, error) { return newEtcdClient(a.pki, etcdEndpoint) }
+	ctx, cancel := signalContext(0)
+	defer cancel()
+	if err := a.run(ctx); err != nil {
+		log.Fatalln("Could not leave the cluster: " + err.Error())
+	}
+}
+
+var lifecycleAgentCmd = &cobra.Command{
+	Use:   "lifecycle-agent",
+	Short: "Leave the cluster when the autoscaling group terminates the instance",
+	Long: `Watches the target lifecycle state of the instance in the metadata
+service. Once a scale in or an instance refresh terminates it, the node
+leaves the cluster like with leave and the termination hook set with
+--lifecycle-hook is completed. Controllers leave one at a time through a
+lock in the secret store and wait till the etcd members that stay keep a
+quorum without them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runLifecycleAgent(kubeAddress, kubePort)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lifecycleAgentCmd)
+	lifecycleAgentCmd.Flags().DurationVar(&agentInterval, "interval", time.Second*5, "Interval the target lifecycle state is polled with")
+	lifecycleAgentCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", time.Minute*5, "Time after which the drain gives up")
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+//lifecycleStates answers the target lifecycle state with a sequence, the
+//last state repeats
+func lifecycleStates(states ...string) func() (string, error) {
+	var mu sync.Mutex
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		state := states[0]
+		if len(states) > 1 {
+			states = states[1:]
+		}
+		return state, nil
+	}
+}
+
+func TestLifecycleAgent(t *testing.T) {
+	cases := []struct {
+		name        string
+		controller  bool
+		terminating bool
+		prepare     func(a *lifecycleAgent, f *fakeEtcd)
+		removed     []string
+		completions []string
+		fails       bool
+	}{
+		{
+			name:        "controller leaves when it is terminated",
+			controller:  true,
+			terminating: true,
+			removed:     []string{"ip-10-0-1-10"},
+			completions: []string{pkg.LifecycleActionContinue},
+		},
+		{
+			name:        "wait till another controller left",
+			controller:  true,
+			terminating: true,
+			prepare: func(a *lifecycleAgent, f *fakeEtcd) {
+				dat, _ := json.Marshal(pkg.Lease{Holder: "i-423adsf", Token: 1, Expires: time.Now().Add(time.Millisecond * 30)})
+				a.store.Put(leaveLockKey, dat)
+			},
+			removed:     []string{"ip-10-0-1-10"},
+			completions: []string{pkg.LifecycleActionContinue},
+		},
+		{
+			name:        "keep the etcd member while the quorum would be lost",
+			controller:  true,
+			terminating: true,
+			prepare:     func(a *lifecycleAgent, f *fakeEtcd) { f.unhealthy["ip-10-0-5-10"] = true },
+			completions: []string{pkg.LifecycleActionAbandon},
+			fails:       true,
+		},
+		{
+			name:        "no termination hook holds the instance",
+			controller:  true,
+			removed:     []string{"ip-10-0-1-10"},
+			completions: []string{},
+		},
+		{
+			name:        "worker",
+			terminating: true,
+			completions: []string{pkg.LifecycleActionContinue},
+		},
+	}
+	for _, tc := range cases {
+		dir, err := ioutil.TempDir("", "k8sinit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		etcd := newFakeEtcd("ip-10-0-1-10", "ip-10-0-2-10", "ip-10-0-5-10")
+		n := newTestNode(dir, nil, &kubeProbe{apiUp: []bool{true}})
+		runner := pkgtest.NewScriptedRunner(
+			kubectlVersion(n.kubeconfig, "22"),
+			pkgtest.FakeCall{Command: []string{"kubectl"}},
+			pkgtest.FakeCall{Command: []string{"kubeadm", "reset", "-f"}},
+		)
+		n.runner = runner
+		n.heartbeatInterval = time.Millisecond
+		autoSvc := &mockAutoScalingClient{instances: []string{"i-143adsf", "i-423adsf", "i-523adsf"}}
+		if tc.terminating {
+			autoSvc.terminating = []string{"i-143adsf"}
+		}
+		a := &lifecycleAgent{
+			leaver: leaver{
+				node:         n,
+				nodeName:     "ip-10-0-1-10",
+				instanceID:   "i-143adsf",
+				pki:          map[string]string{"etcd-ca.key": filepath.Join(dir, "pki", "etcd", "ca.key")},
+				drainTimeout: time.Minute,
+				etcd:         func() (*pkg.EtcdClient, error) { return pkg.NewEtcdClient(etcd.URL, nil), nil },
+			},
+			lockStore:   n.store.(pkg.LockStore),
+			autoSvc:     autoSvc,
+			hook:        "terminate",
+			targetState: lifecycleStates("InService", "InService", targetLifecycleTerminated),
+			interval:    time.Millisecond,
+		}
+		ioutil.WriteFile(a.kubeconfig, []byte("admin"), 0600)
+		if tc.controller {
+			os.MkdirAll(filepath.Dir(a.pki["etcd-ca.key"]), 0755)
+			ioutil.WriteFile(a.pki["etcd-ca.key"], []byte("key"), 0600)
+		}
+		stopController := func() {}
+		if !tc.controller {
+			_, stopController = drainingController(a.store, "22")
+		}
+		if tc.prepare != nil {
+			tc.prepare(a, etcd)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		err = a.run(ctx)
+		cancel()
+		stopController()
+		if tc.fails && err == nil {
+			t.Errorf("%s: expect error", tc.name)
+		} else if !tc.fails && err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		if e, a := fmt.Sprint(tc.removed), fmt.Sprint(*etcd.removed); e != a {
+			t.Errorf("%s: expect the etcd members %v to be removed, got %v", tc.name, e, a)
+		}
+		if e, a := tc.completions, append([]string{}, autoSvc.completions...); !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expect the lifecycle action to be completed with %v, got %v", tc.name, e, a)
+		}
+		if e, a := !tc.fails, runner.Called("kubeadm", "reset", "-f") > 0; e != a {
+			t.Errorf("%s: expect kubeadm reset %v, got %v", tc.name, e, a)
+		}
+		if tc.controller {
+			lease := pkg.Lease{}
+			dat, _ := a.store.Get(leaveLockKey)
+			json.Unmarshal(dat, &lease)
+			if lease.Holder != "i-143adsf" || lease.Expires.After(time.Now()) {
+				t.Errorf("%s: expect the leave lock to be released, got %v", tc.name, lease)
+			}
+		}
+		etcd.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	imageDir = "/var/lib/k8sinit/images"
+	//joinConfigMinValidity is how long the token of a join config has to be
+	//valid to be used, shorter lived configs are treated as stale
+	joinConfigMinValidity = time.Minute * 10
+)
+
+var airGapped bool
+var stateFile string
+var nodeName string
+var lifecycleHook string
+var lifecycleHeartbeat time.Duration
+
+//node holds what controllers and workers share to bootstrap. The probes and
+//the runner are fields so tests can replace them.
+type node struct {
+	apiDNS      string
+	apiPort     int
+	store       pkg.SecretStore
+	runner      pkg.Runner
+	files       map[string]string
+	kubeconfig  string
+	apiHealth   func(apiDNS string, apiPort int) pkg.APIHealth
+	dnsResolves func(ctx context.Context, apiDNS string) error
+	backoff     retry.Backoff
+	airGapped   bool
+	imageDir    string
+	state       *pkg.StateFile
+	//lifecycle is the action of the launch lifecycle hook, nil without a hook
+	lifecycle         *pkg.LifecycleAction
+	heartbeatInterval time.Duration
+}
+
+func newNode(apiDNS string, apiPort int, store pkg.SecretStore) node {
+	return node{
+		apiDNS:      apiDNS,
+		apiPort:     apiPort,
+		store:       store,
+		runner:      &pkg.ExecRunner{Stdout: os.Stdout, Stderr: os.Stderr},
+		files:       clusterConfig,
+		kubeconfig:  kubeconfig,
+		apiHealth:   pkg.NewAPIProbe(caKeys["ca.crt"]).Probe,
+		dnsResolves: pkg.DNSResolves,
+		backoff:     retry.Default,
+		airGapped:   airGapped,
+		imageDir:    imageDir,
+		state:       pkg.NewStateFile(stateFile),
+
+		heartbeatInterval: lifecycleHeartbeat,
+	}
+}
+
+//localNodeName returns --node-name or the lower case hostname kubeadm uses
+//by default
+func localNodeName() (string, error) {
+	if nodeName != "" {
+		return nodeName, nil
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "", errors.New("could not get the hostname: " + err.Error())
+	}
+	return strings.ToLower(name), nil
+}
+
+//newLifecycleAction looks up the group of the instance for the lifecycle
+//hook, nil is returned if --lifecycle-hook isn't set. Only autoscaling
+//groups have lifecycle hooks, identity is nil off EC2.
+func newLifecycleAction(sess *session.Session, identity *pkg.InstanceIdentity) (*pkg.LifecycleAction, error) {
+	if lifecycleHook == "" {
+		return nil, nil
+	}
+	if identity == nil {
+		return nil, errors.New("--lifecycle-hook needs --provider=" + providerAWS)
+	}
+	svc := autoscaling.New(sess, aws.NewConfig().WithRegion(identity.Region))
+	groupName, err := pkg.GetAutoscalingGroupName(svc, identity.InstanceID)
+	if err != nil {
+		return nil, errors.New("could not get the autoscaling group name: " + err.Error())
+	}
+	return pkg.NewLifecycleAction(svc, groupName, lifecycleHook, identity.InstanceID), nil
+}
+
+//withLifecycleHook runs fn while it sends heartbeats to the lifecycle hook.
+//The hook is completed with CONTINUE if fn succeeds and with ABANDON if it
+//fails, so the autoscaling group replaces a node whose bootstrap failed.
+func (n *node) withLifecycleHook(fn func() error) error {
+	if n.lifecycle == nil {
+		return fn()
+	}
+	stop := make(chan struct{})
+	done := n.lifecycle.KeepAlive(n.heartbeatInterval, stop)
+	err := fn()
+	close(stop)
+	<-done
+
+	result := pkg.LifecycleActionContinue
+	if err != nil {
+		result = pkg.LifecycleActionAbandon
+	}
+	log.Println("Complete the lifecycle hook with " + result)
+	if err := n.lifecycle.Complete(result); err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+//download gets a cluster file from the store and retries until it exists
+func (n *node) download(ctx context.Context, name string) error {
+	return retry.Do(ctx, "download "+name, n.backoff, func(ctx context.Context) error {
+		return pkg.Download(n.store, name, n.files[name])
+	})
+}
+
+//reset cleans up after kubeadm was interrupted so it can run again
+func (n *node) reset() error {
+	log.Println("Reset the interrupted kubeadm run")
+	if _, err := n.runner.Run("kubeadm", "reset", "-f"); err != nil {
+		return errors.New("kubeadm reset failed: " + err.Error())
+	}
+	return nil
+}
+
+//waitJoinConfig waits till a join config that isn't stale is published and
+//renders it to the kubeadm join config file
+func (n *node) waitJoinConfig(ctx context.Context, controlPlane bool) error {
+	var cfg *pkg.JoinConfig
+	err := retry.Do(ctx, "wait for a join config", n.backoff, func(ctx context.Context) error {
+		var err error
+		cfg, err = pkg.GetJoinConfig(n.store, joinConfigMinValidity, time.Now())
+		if err == pkg.ErrJoinConfigStale {
+			return errors.New("the join config expires at " + cfg.Expires.Format(time.RFC3339) + ", wait for a refreshed one")
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	dat, err := cfg.Render(controlPlane)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(n.files["kubeadm-cfg-join.yaml"], dat, 0600)
+}
+
+//prepareAirGap checks that the addon manifests and the images kubeadm needs
+//are in the secret store and imports the images into containerd. Nothing is
+//done if the node isn't air-gapped.
+func (n *node) prepareAirGap(addons ...string) error {
+	if !n.airGapped {
+		return nil
+	}
+	log.Println("---- Prepare air-gapped bootstrap ----")
+	if err := pkg.Download(n.store, "kubeadm-cfg-init.yaml", n.files["kubeadm-cfg-init.yaml"]); err != nil {
+		return errors.New("could not download kubeadm-cfg-init.yaml to list the images: " + err.Error())
+	}
+	images, err := pkg.KubeadmImages(n.runner, n.files["kubeadm-cfg-init.yaml"])
+	if err != nil {
+		return err
+	}
+	bundle, err := pkg.LoadImageBundle(n.store, n.imageDir)
+	if err != nil {
+		return errors.New("could not load the image archives: " + err.Error())
+	}
+	if err := pkg.CheckAirGap(n.store, bundle, addons, images); err != nil {
+		return err
+	}
+	return bundle.Import(n.runner)
+}
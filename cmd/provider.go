@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+	"log"
+	"net"
+)
+
+const (
+	//providerAWS finds the peers in the autoscaling group of the instance
+	providerAWS = "aws"
+	//providerStatic takes the peers from --peers and --peers-file
+	providerStatic = "static"
+	//providerDNSSRV discovers the peers from the SRV record --peers-srv
+	providerDNSSRV = "dns-srv"
+)
+
+var providerName string
+var peers string
+var peersFile string
+var peersSRV string
+
+//newCloudProvider creates the provider selected with --provider, identity
+//is nil off EC2
+func newCloudProvider(sess *session.Session, identity *pkg.InstanceIdentity) (pkg.CloudProvider, error) {
+	if providerName == providerAWS {
+		config := aws.NewConfig().WithRegion(identity.Region)
+		self := pkg.InstanceAddress{ID: identity.InstanceID, PrivateIP: identity.PrivateIP}
+		return pkg.NewAWSProvider(autoscaling.New(sess, config), ec2.New(sess, config), self), nil
+	}
+	name, err := localNodeName()
+	if err != nil {
+		return nil, err
+	}
+	switch providerName {
+	case providerStatic:
+		if peers == "" && peersFile == "" {
+			return nil, errors.New("--provider=" + providerStatic + " needs --peers or --peers-file")
+		}
+		return pkg.NewStaticProvider(peers, peersFile, name), nil
+	case providerDNSSRV:
+		if peersSRV == "" {
+			return nil, errors.New("--provider=" + providerDNSSRV + " needs --peers-srv")
+		}
+		return pkg.NewSRVProvider(peersSRV, name, net.DefaultResolver), nil
+	}
+	return nil, errors.New("unknown --provider " + providerName + ", use " + providerAWS + ", " + providerStatic + " or " + providerDNSSRV)
+}
+
+//cloudSession creates the aws session for the secret store and the key
+//provider. With --provider=aws the identity of the instance is read from
+//the metadata service, off EC2 it is nil and the region is taken from
+//AWS_REGION.
+func cloudSession() (*session.Session, string, *pkg.InstanceIdentity) {
+	if providerName == providerAWS {
+		sess, _, identity := instanceSession()
+		return sess, identity.Region, identity
+	}
+	if providerName != providerStatic && providerName != providerDNSSRV {
+		log.Fatalln("Unknown --provider " + providerName + ", use " + providerAWS + ", " + providerStatic + " or " + providerDNSSRV)
+	}
+	sess, err := newSession(nil)
+	if err != nil {
+		log.Fatalln("Could not initialize aws session: " + err.Error())
+	}
+	return sess, aws.StringValue(sess.Config.Region), nil
+}
+
+//selfAddress waits till the provider finds this node among the peers
+func selfAddress(ctx context.Context, provider pkg.CloudProvider) (pkg.InstanceAddress, error) {
+	var self pkg.InstanceAddress
+	err := retry.Do(ctx, "find this node among the peers", retry.Default, func(ctx context.Context) error {
+		var err error
+		self, err = provider.Self(ctx)
+		return err
+	})
+	return self, err
+}
+
+func init() {
+	RootCmd.PersistentFlags().StringVar(&providerName, "provider", providerAWS, "Where the peers are found: "+providerAWS+" in the autoscaling group, "+providerStatic+" from --peers or "+providerDNSSRV+" from --peers-srv")
+	RootCmd.PersistentFlags().StringVar(&peers, "peers", "", "Controllers of the "+providerStatic+" provider as name=ip, separated by commas")
+	RootCmd.PersistentFlags().StringVar(&peersFile, "peers-file", "", "File with the controllers of the "+providerStatic+" provider, one name=ip per line")
+	RootCmd.PersistentFlags().StringVar(&peersSRV, "peers-srv", "", "SRV record whose targets are the controllers of the "+providerDNSSRV+" provider")
+}
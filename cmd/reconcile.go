@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reconcileInterval time.Duration
+
+//reconciler removes the etcd members and control plane nodes of instances
+//that left the autoscaling group of the controllers. With a store it drains
+//and deletes the workers that asked to leave.
+type reconciler struct {
+	runner       pkg.Runner
+	kubeconfig   string
+	provider     pkg.CloudProvider
+	etcd         func(ctx context.Context, instances []pkg.InstanceAddress) (*pkg.EtcdClient, error)
+	store        pkg.SecretStore
+	drainTimeout time.Duration
+}
+
+//memberRemoveTimeout bounds a member remove, it blocks while the cluster
+//has no quorum to commit it
+const memberRemoveTimeout = time.Second * 30
+
+//reconcileMembers removes the stale members one by one. The removal commits
+//in the current cluster, so it needs the voters on active instances to be a
+//quorum of all voters, which keeps them a quorum of the smaller cluster too.
+//Learners don't vote, they neither count for nor against the quorum.
+func (r *reconciler) reconcileMembers(ctx context.Context, instances []pkg.InstanceAddress) error {
+	client, err := r.etcd(ctx, instances)
+	if err != nil {
+		return err
+	}
+	members, err := client.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	stale := pkg.StaleMembers(members, instances)
+	if len(stale) == 0 {
+		log.Println("All " + strconv.Itoa(len(members)) + " etcd members run on instances of the group")
+		return nil
+	}
+	if len(stale) == len(members) {
+		log.Println("No etcd member runs on an instance of the group, skip removing members")
+		return nil
+	}
+	voters, active := 0, 0
+	for _, m := range members {
+		if !m.IsLearner {
+			voters++
+			active++
+		}
+	}
+	for _, m := range stale {
+		if !m.IsLearner {
+			active--
+		}
+	}
+	for _, m := range stale {
+		id := strconv.FormatUint(m.ID, 16)
+		if active < pkg.Quorum(voters) {
+			log.Println("Skip removing etcd member " + m.Name + " " + id + ", " + strconv.Itoa(active) + " of " + strconv.Itoa(voters) + " voting members are no quorum")
+			continue
+		}
+		log.Println("Remove etcd member " + m.Name + " " + id + ", its instance left the group")
+		removeCtx, cancel := context.WithTimeout(ctx, memberRemoveTimeout)
+		err := client.MemberRemove(removeCtx, m.ID)
+		cancel()
+		if err != nil {
+			return errors.New("could not remove etcd member " + m.Name + " " + id + ": " + err.Error())
+		}
+		if !m.IsLearner {
+			voters--
+		}
+	}
+	return nil
+}
+
+//reconcileNodes deletes the control plane nodes whose instances left the group
+func (r *reconciler) reconcileNodes(instances []pkg.InstanceAddress) error {
+	nodes, err := pkg.GetNodes(r.runner, r.kubeconfig)
+	if err != nil {
+		return err
+	}
+	stale := pkg.StaleNodes(nodes, instances)
+	for _, n := range stale {
+		log.Println("Delete control plane node " + n.Name + ", its instance left the group")
+		if _, err := r.runner.Run("kubectl", "--kubeconfig", r.kubeconfig, "delete", "node", n.Name, "--ignore-not-found"); err != nil {
+			return errors.New("could not delete the node " + n.Name + ": " + err.Error())
+		}
+	}
+	if len(stale) == 0 {
+		log.Println("All control plane nodes run on instances of the group")
+	}
+	return nil
+}
+
+//drainWorker drains and deletes the node of a leave request. Control plane
+//nodes leave on their own and are refused, so are nodes that run on another
+//instance than the one that asked.
+func (r *reconciler) drainWorker(req *pkg.LeaveRequest, nodes []pkg.KubeNode) error {
+	var node *pkg.KubeNode
+	for i := range nodes {
+		if nodes[i].Name == req.Node {
+			node = &nodes[i]
+		}
+	}
+	if node == nil {
+		log.Println("The node " + req.Node + " asked to leave, it was deleted before")
+		return nil
+	}
+	if node.ControlPlane {
+		return errors.New("the control plane node " + req.Node + " can't be drained on request")
+	}
+	if req.InstanceID != "" && node.ProviderID != "" && !strings.HasSuffix(node.ProviderID, "/"+req.InstanceID) {
+		return errors.New("the node " + req.Node + " runs on " + node.ProviderID + ", not on the instance " + req.InstanceID + " that asked to leave")
+	}
+	if err := drainNode(r.runner, r.kubeconfig, req.Node, r.drainTimeout); err != nil {
+		return err
+	}
+	return deleteNode(r.runner, r.kubeconfig, req.Node)
+}
+
+//reconcileLeaveRequests drains and deletes the workers that asked to leave
+//and marks their requests as done. Failed requests keep the error and are
+//retried by the next run.
+func (r *reconciler) reconcileLeaveRequests() error {
+	if r.store == nil {
+		return nil
+	}
+	requests, err := pkg.PendingLeaveRequests(r.store)
+	if err != nil {
+		return errors.New("could not list the leave requests: " + err.Error())
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	nodes, err := pkg.GetNodes(r.runner, r.kubeconfig)
+	if err != nil {
+		return err
+	}
+	for _, req := range requests {
+		req.Done, req.Error = true, ""
+		if err := r.drainWorker(req, nodes); err != nil {
+			log.Println("Could not drain the worker " + req.Node + ": " + err.Error())
+			req.Done, req.Error = false, err.Error()
+		}
+		if err := pkg.PutLeaveRequest(r.store, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//reconcile drains the workers that asked to leave and compares etcd and the
+//control plane nodes with the group
+func (r *reconciler) reconcile(ctx context.Context) error {
+	if err := r.reconcileLeaveRequests(); err != nil {
+		log.Println("Could not handle the leave requests: " + err.Error())
+	}
+	instances, err := r.provider.Peers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		log.Println("The group has no active instances, skip the reconcile")
+		return nil
+	}
+	if err := r.reconcileMembers(ctx, instances); err != nil {
+		return err
+	}
+	return r.reconcileNodes(instances)
+}
+
+//run reconciles once or, with an interval, every interval till the context
+//is cancelled. Failed runs of the loop are logged.
+func (r *reconciler) run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return r.reconcile(ctx)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.reconcile(ctx); err != nil {
+			log.Println("Reconcile failed: " + err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+//remoteEtcd connects to the first etcd member on another instance that answers
+func remoteEtcd(pki map[string]string, self string) func(ctx context.Context, instances []pkg.InstanceAddress) (*pkg.EtcdClient, error) {
+	return func(ctx context.Context, instances []pkg.InstanceAddress) (*pkg.EtcdClient, error) {
+		var lastErr error = errors.New("no other instance runs etcd")
+		for _, i := range instances {
+			if i.ID == self || i.PrivateIP == "" {
+				continue
+			}
+			client, err := newEtcdClient(pki, "https://"+i.PrivateIP+":2379")
+			if err != nil {
+				return nil, err
+			}
+			if _, lastErr = client.MemberList(ctx); lastErr == nil {
+				return client, nil
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+func reconcileCluster() {
+	sess, region, identity := cloudSession()
+	provider, err := newCloudProvider(sess, identity)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	store, err := newSecretStore(sess, region)
+	if err != nil {
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
+	}
+	r := &reconciler{
+		runner:     &pkg.ExecRunner{Stderr: os.Stderr},
+		kubeconfig: kubeconfig,
+		provider:   provider,
+		etcd: func(ctx context.Context, instances []pkg.InstanceAddress) (*pkg.EtcdClient, error) {
+			return newEtcdClient(caKeys, etcdEndpoint)
+		},
+		store:        store,
+		drainTimeout: drainTimeout,
+	}
+	ctx, cancel := signalContext(0)
+	defer cancel()
+	if err := r.run(ctx, reconcileInterval); err != nil {
+		log.Fatalln("Could not reconcile the cluster: " + err.Error())
+	}
+}
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Remove etcd members and nodes of terminated controllers",
+	Long: `Compares the etcd members and the control plane nodes with the active
+instances of the autoscaling group of this controller. Members whose
+instances are gone are removed as long as the remaining members keep a
+quorum, their nodes are deleted. Workers that run leave put a leave request
+into the secret store, the reconcile drains and deletes their nodes with the
+admin kubeconfig. With --interval it runs as a loop.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		reconcileCluster()
+	},
+}
+
+func init() {
+	reconcileCmd.Flags().DurationVar(&reconcileInterval, "interval", 0, "Interval of the reconcile loop, 0 reconciles once")
+	reconcileCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", time.Minute*5, "Time after which the drain of a leaving worker gives up")
+	controllerCmd.AddCommand(reconcileCmd)
+}
@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+const nodeList = `{"items": [
+	{"metadata": {"name": "ip-10-0-1-10", "labels": {"node-role.kubernetes.io/master": ""}}, "status": {"addresses": [{"type": "InternalIP", "address": "10.0.1.10"}]}},
+	{"metadata": {"name": "controller-b", "labels": {"node-role.kubernetes.io/master": ""}}, "spec": {"providerID": "aws:///eu-central-1b/i-423adsf"}},
+	{"metadata": {"name": "ip-10-0-3-10", "labels": {"node-role.kubernetes.io/master": ""}}, "status": {"addresses": [{"type": "InternalIP", "address": "10.0.3.10"}]}},
+	{"metadata": {"name": "ip-10-0-9-10"}, "status": {"addresses": [{"type": "InternalIP", "address": "10.0.9.10"}]}}
+]}`
+
+//workerNodeList has a controller and the workers ip-10-0-9-10 and worker-b on i-943adsf
+const workerNodeList = `{"items": [
+	{"metadata": {"name": "ip-10-0-3-10", "labels": {"node-role.kubernetes.io/master": ""}}, "status": {"addresses": [{"type": "InternalIP", "address": "10.0.3.10"}]}},
+	{"metadata": {"name": "ip-10-0-9-10"}, "status": {"addresses": [{"type": "InternalIP", "address": "10.0.9.10"}]}},
+	{"metadata": {"name": "worker-b"}, "spec": {"providerID": "aws:///eu-central-1b/i-943adsf"}}
+]}`
+
+func TestReconcile(t *testing.T) {
+	cases := []struct {
+		name      string
+		instances []string
+		members   []string
+		learners  []string
+		removed   []string
+		deleted   []string
+	}{
+		{
+			name:      "terminated controller",
+			instances: []string{"i-143adsf", "i-423adsf", "i-523adsf"},
+			members:   []string{"ip-10-0-1-10", "ip-10-0-2-10", "ip-10-0-3-10"},
+			removed:   []string{"ip-10-0-3-10"},
+			deleted:   []string{"ip-10-0-3-10"},
+		},
+		{
+			name:      "two of five controllers terminated",
+			instances: []string{"i-143adsf", "i-423adsf", "i-523adsf"},
+			members:   []string{"ip-10-0-1-10", "ip-10-0-2-10", "ip-10-0-3-10", "ip-10-0-4-10", "ip-10-0-5-10"},
+			removed:   []string{"ip-10-0-3-10", "ip-10-0-4-10"},
+			deleted:   []string{"ip-10-0-3-10"},
+		},
+		{
+			name:      "removing would lose the quorum",
+			instances: []string{"i-143adsf"},
+			members:   []string{"ip-10-0-1-10", "ip-10-0-3-10", "ip-10-0-4-10"},
+			deleted:   []string{"controller-b", "ip-10-0-3-10"},
+		},
+		{
+			name:      "two of four controllers terminated",
+			instances: []string{"i-143adsf", "i-423adsf"},
+			members:   []string{"ip-10-0-1-10", "ip-10-0-2-10", "ip-10-0-3-10", "ip-10-0-4-10"},
+			deleted:   []string{"ip-10-0-3-10"},
+		},
+		{
+			name:      "learners of terminated controllers",
+			instances: []string{"i-143adsf"},
+			members:   []string{"ip-10-0-1-10"},
+			learners:  []string{"ip-10-0-3-10", "ip-10-0-4-10"},
+			removed:   []string{"ip-10-0-3-10", "ip-10-0-4-10"},
+			deleted:   []string{"controller-b", "ip-10-0-3-10"},
+		},
+		{
+			name:      "no member on an instance",
+			instances: []string{"i-143adsf", "i-423adsf"},
+			members:   []string{"ip-10-0-6-10", "ip-10-0-7-10"},
+			deleted:   []string{"ip-10-0-3-10"},
+		},
+	}
+	for _, tc := range cases {
+		removed := []string{}
+		srv := newFakeEtcd(tc.members...)
+		srv.removed = &removed
+		for _, name := range tc.learners {
+			srv.add(name, []string{namedPeerURL(name)}, true)
+		}
+		runner := pkgtest.NewScriptedRunner(
+			pkgtest.FakeCall{Command: []string{"kubectl", "--kubeconfig", "admin.conf", "get", "nodes"}, Output: []byte(nodeList)},
+			pkgtest.FakeCall{Command: []string{"kubectl", "--kubeconfig", "admin.conf", "delete", "node"}},
+		)
+		r := &reconciler{
+			runner:     runner,
+			kubeconfig: "admin.conf",
+			provider: pkg.NewAWSProvider(
+				&mockAutoScalingClient{instances: tc.instances},
+				&mockEC2Client{addresses: map[string]string{
+					"i-143adsf": "10.0.1.10",
+					"i-423adsf": "10.0.2.10",
+					"i-523adsf": "10.0.5.10",
+				}},
+				pkg.InstanceAddress{ID: "i-143adsf", PrivateIP: "10.0.1.10"},
+			),
+			etcd: func(context.Context, []pkg.InstanceAddress) (*pkg.EtcdClient, error) {
+				return pkg.NewEtcdClient(srv.URL, nil), nil
+			},
+		}
+
+		if err := r.reconcile(context.Background()); err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		if e, a := fmt.Sprint(tc.removed), fmt.Sprint(removed); e != a {
+			t.Errorf("%s: expect the etcd members %v to be removed, got %v", tc.name, e, a)
+		}
+		deleted := []string{}
+		for _, call := range runner.Calls() {
+			if call[3] == "delete" {
+				deleted = append(deleted, call[5])
+			}
+		}
+		if e, a := tc.deleted, deleted; !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expect the nodes %v to be deleted, got %v", tc.name, e, a)
+		}
+		srv.Close()
+	}
+}
+
+func TestReconcileLeaveRequests(t *testing.T) {
+	cases := []struct {
+		name    string
+		req     pkg.LeaveRequest
+		drained bool
+		done    bool
+	}{
+		{name: "worker", req: pkg.LeaveRequest{Node: "ip-10-0-9-10"}, drained: true, done: true},
+		{name: "worker on its instance", req: pkg.LeaveRequest{Node: "worker-b", InstanceID: "i-943adsf"}, drained: true, done: true},
+		{name: "worker on another instance", req: pkg.LeaveRequest{Node: "worker-b", InstanceID: "i-843adsf"}},
+		{name: "control plane node", req: pkg.LeaveRequest{Node: "ip-10-0-3-10"}},
+		{name: "deleted node", req: pkg.LeaveRequest{Node: "ip-10-0-7-10"}, done: true},
+	}
+	for _, tc := range cases {
+		dir, err := ioutil.TempDir("", "k8sinit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := pkg.NewFileStore(filepath.Join(dir, "store"))
+		pkg.PutLeaveRequest(store, &tc.req)
+		runner := pkgtest.NewScriptedRunner(
+			pkgtest.FakeCall{Command: []string{"kubectl", "--kubeconfig", "admin.conf", "get", "nodes"}, Output: []byte(workerNodeList)},
+			kubectlVersion("admin.conf", "22"),
+			pkgtest.FakeCall{Command: []string{"kubectl", "--kubeconfig", "admin.conf"}},
+		)
+		r := &reconciler{runner: runner, kubeconfig: "admin.conf", store: store, drainTimeout: time.Minute}
+
+		if err := r.reconcileLeaveRequests(); err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		if e, a := tc.drained, runner.Called("kubectl", "--kubeconfig", "admin.conf", "drain", tc.req.Node) == 1; e != a {
+			t.Errorf("%s: expect the node to be drained %v, got %v", tc.name, e, runner.Calls())
+		}
+		if e, a := tc.drained, runner.Called("kubectl", "--kubeconfig", "admin.conf", "delete", "node", tc.req.Node) == 1; e != a {
+			t.Errorf("%s: expect the node to be deleted %v, got %v", tc.name, e, runner.Calls())
+		}
+		req, err := pkg.GetLeaveRequest(store, tc.req.Node)
+		if err != nil {
+			t.Fatalf("%s: expect no error, got %v", tc.name, err)
+		}
+		if e, a := tc.done, req.Done; e != a {
+			t.Errorf("%s: expect the request to be done %v, got %v", tc.name, e, a)
+		}
+		if e, a := !tc.done, req.Error != ""; e != a {
+			t.Errorf("%s: expect an error in the request %v, got %q", tc.name, e, req.Error)
+		}
+		os.RemoveAll(dir)
+	}
+}
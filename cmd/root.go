@@ -1,33 +1,44 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var kubeAddress string
 var kubePort int
 var bucket string
+var storeURL string
+var storePrefix string
+var clusterName string
+var keyFile string
+var allowPlaintext bool
+var kmsKeyID string
+var s3Options pkg.S3Options
 
-var caKeys = map[string]string{
-	"admin.conf":         "/etc/kubernetes/admin.conf",
-	"ca.crt":             "/etc/kubernetes/pki/ca.crt",
-	"ca.key":             "/etc/kubernetes/pki/ca.key",
-	"etcd-ca.crt":        "/etc/kubernetes/pki/etcd/ca.crt",
-	"etcd-ca.key":        "/etc/kubernetes/pki/etcd/ca.key",
-	"front-proxy-ca.crt": "/etc/kubernetes/pki/front-proxy-ca.crt",
-	"front-proxy-ca.key": "/etc/kubernetes/pki/front-proxy-ca.key",
-	"sa.key":             "/etc/kubernetes/pki/sa.key",
-	"sa.pub":             "/etc/kubernetes/pki/sa.pub",
-}
+var configFile string
 
-var clusterConfig = map[string]string{
-	"cluster-info.yaml":     "/tmp/cluster-info.yaml",
-	"kubeadm-cfg-init.yaml": "/tmp/cluster-cfg.yaml",
-	"kubeadm-cfg-join.yaml": "/tmp/cluster-join.yaml",
-}
+var bootstrapTimeout time.Duration
+
+var caKeys = pkg.DefaultConfig().SyncedFiles()
+
+var clusterConfig = pkg.DefaultConfig().ClusterFiles
+
+var kubeconfig = pkg.DefaultConfig().Kubeconfig
 
 //RootCmd is the entry point to the application
 var RootCmd = &cobra.Command{
@@ -35,6 +46,188 @@ var RootCmd = &cobra.Command{
 	Short:         "Deploy a HA kubernetes",
 	Long:          `Initialize a kubernetes HA cluster using kubeadm on AWS`,
 	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return loadConfig(cmd)
+	},
+}
+
+//loadConfig applies the config file and the K8SINIT_* environment to all
+//flags that were not set on the command line
+func loadConfig(cmd *cobra.Command) error {
+	if configFile == "" {
+		configFile = os.Getenv(pkg.FlagEnvName("config"))
+	}
+	cfg := pkg.DefaultConfig()
+	if configFile != "" {
+		var err error
+		if cfg, err = pkg.LoadConfig(configFile); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Validate(func(name string) bool { return isKnownFlag(cmd.Root(), name) }); err != nil {
+		return errors.New("config file " + configFile + ": " + err.Error())
+	}
+
+	var setErr error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed || f.Name == "config" || setErr != nil {
+			return
+		}
+		if v, ok := cfg.FlagValue(f.Name, os.Getenv); ok {
+			if err := cmd.Flags().Set(f.Name, v); err != nil {
+				setErr = errors.New("flag " + f.Name + ": " + err.Error())
+			}
+		}
+	})
+	if setErr != nil {
+		return setErr
+	}
+
+	caKeys = cfg.SyncedFiles()
+	clusterConfig = cfg.ClusterFiles
+	kubeconfig = cfg.Kubeconfig
+	return nil
+}
+
+func isKnownFlag(root *cobra.Command, name string) bool {
+	var known func(c *cobra.Command) bool
+	known = func(c *cobra.Command) bool {
+		if c.Flags().Lookup(name) != nil || c.PersistentFlags().Lookup(name) != nil {
+			return true
+		}
+		for _, sub := range c.Commands() {
+			if known(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return name != "config" && known(root)
+}
+
+//newKeyProvider creates the key provider of --key-file or --kms-key-id.
+//Plaintext secrets are only read with --allow-plaintext-secrets.
+func newKeyProvider(sess *session.Session, region string) (pkg.KeyProvider, error) {
+	var kp pkg.KeyProvider
+	switch {
+	case keyFile != "" && kmsKeyID != "":
+		return nil, errors.New("only one of --key-file and --kms-key-id can be set")
+	case keyFile != "":
+		var err error
+		if kp, err = pkg.NewKeyFileProvider(keyFile); err != nil {
+			return nil, err
+		}
+	case kmsKeyID != "":
+		kp = pkg.NewKMSProvider(kms.New(sess, aws.NewConfig().WithRegion(region)), kmsKeyID, clusterName)
+	default:
+		return nil, nil
+	}
+	if allowPlaintext {
+		log.Println("Plaintext secrets are read to migrate them, remove --allow-plaintext-secrets once the store is encrypted")
+		return pkg.AllowPlaintext(kp), nil
+	}
+	return kp, nil
+}
+
+func newSecretStore(sess *session.Session, region string) (pkg.SecretStore, error) {
+	return newStore(sess, region, clusterName)
+}
+
+//secretStoreURL returns the location of the secret store of cluster
+func secretStoreURL(cluster string) (*pkg.StoreURL, error) {
+	raw := storeURL
+	if raw == "" {
+		if bucket == "" {
+			return nil, errors.New("either --store or --bucket has to be set")
+		}
+		raw = "s3://" + bucket
+	}
+	u, err := pkg.ParseStoreURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	return u.Join(storePrefix, cluster), nil
+}
+
+func newStore(sess *session.Session, region string, cluster string) (pkg.SecretStore, error) {
+	u, err := secretStoreURL(cluster)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		config, err := s3Options.Config(sess, region)
+		if err != nil {
+			return nil, err
+		}
+		return pkg.NewS3Store(s3.New(sess, config), u.Bucket, u.Path), nil
+	case "file":
+		return pkg.NewFileStore(u.Path), nil
+	case "ssm":
+		return nil, errors.New("ssm stores are not supported, SSM has no conditional writes for the leader lease and the fenced writes of the controllers, use s3:// or file://")
+	}
+	return nil, errors.New("unsupported secret store scheme " + u.Scheme)
+}
+
+//newSession creates an aws session. The credentials of the instance role are
+//read with IMDSv2, the provider of the sdk only knows IMDSv1. Off EC2
+//metaSvc is nil and only the environment and the shared credentials are used.
+func newSession(metaSvc *pkg.IMDS) (*session.Session, error) {
+	providers := []credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{},
+	}
+	if metaSvc != nil {
+		providers = append(providers, pkg.NewIMDSRoleProvider(metaSvc))
+	}
+	creds := credentials.NewChainCredentials(providers)
+	return session.NewSession(aws.NewConfig().WithCredentials(creds))
+}
+
+//instanceSession reads the identity of the instance from the metadata
+//service and creates an aws session
+func instanceSession() (*session.Session, *pkg.IMDS, *pkg.InstanceIdentity) {
+	metaSvc := pkg.NewIMDS("")
+	identity, err := metaSvc.GetInstanceIdentity()
+	if err != nil {
+		log.Fatalln("Could not get the instance identity: " + err.Error())
+	}
+	sess, err := newSession(metaSvc)
+	if err != nil {
+		log.Fatalln("Could not initialize aws session: " + err.Error())
+	}
+	return sess, metaSvc, identity
+}
+
+//bootstrapContext returns the context of a bootstrap, it is cancelled after
+//--bootstrap-timeout or on SIGINT and SIGTERM
+func bootstrapContext() (context.Context, context.CancelFunc) {
+	return signalContext(bootstrapTimeout)
+}
+
+//signalContext returns a context that is cancelled after timeout, unless it
+//is 0, or on SIGINT and SIGTERM
+func signalContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.Background(), func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	ctx, stop := context.WithCancel(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Println("Received " + sig.String() + ", stop")
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		stop()
+		cancel()
+	}
 }
 
 //Execute starts the root cmd
@@ -47,7 +240,30 @@ func Execute() {
 
 func init() {
 	log.SetOutput(os.Stdout)
+	RootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "Config file, all flags can also be set there or as "+pkg.EnvPrefix+"* environment variables")
 	RootCmd.PersistentFlags().StringVarP(&kubeAddress, "name", "n", "", "Address of the Kubernetes API Server")
 	RootCmd.PersistentFlags().IntVarP(&kubePort, "port", "p", 6443, "Port of the Kubernetes API Server")
-	RootCmd.PersistentFlags().StringVarP(&bucket, "bucket", "b", "", "S3Bucket for the Kubernetes Config")
+	RootCmd.PersistentFlags().StringVarP(&bucket, "bucket", "b", "", "S3Bucket for the Kubernetes Config, short for --store s3://<bucket>")
+	RootCmd.PersistentFlags().StringVar(&storeURL, "store", "", "Secret store for the Kubernetes Config: s3://bucket/prefix or file:///path")
+	RootCmd.PersistentFlags().StringVar(&storePrefix, "prefix", "", "Prefix below the secret store location that holds the clusters")
+	RootCmd.PersistentFlags().StringVar(&clusterName, "cluster-name", "", "Name of the cluster, namespaces all keys in the secret store")
+	RootCmd.PersistentFlags().StringVar(&s3Options.Endpoint, "s3-endpoint", "", "Endpoint of a S3 compatible service like MinIO, defaults to AWS")
+	RootCmd.PersistentFlags().BoolVar(&s3Options.PathStyle, "s3-path-style", false, "Address buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>")
+	RootCmd.PersistentFlags().StringVar(&s3Options.CABundle, "s3-ca-bundle", "", "PEM file with the CAs the S3 endpoint is trusted with")
+	RootCmd.PersistentFlags().StringVar(&s3Options.Region, "s3-region", "", "Region of the S3 bucket, defaults to the region of the instance or AWS_REGION")
+	RootCmd.PersistentFlags().StringVar(&s3Options.Credentials, "s3-credentials", pkg.S3CredentialsDefault, "Credentials of the S3 client: "+pkg.S3CredentialsDefault+" of the session, "+pkg.S3CredentialsStatic+" from --s3-access-key-id, "+pkg.S3CredentialsProfile+" from --s3-profile or "+pkg.S3CredentialsAssumeRole+" of --s3-role-arn")
+	RootCmd.PersistentFlags().StringVar(&s3Options.AccessKeyID, "s3-access-key-id", "", "Access key id of the "+pkg.S3CredentialsStatic+" S3 credentials")
+	RootCmd.PersistentFlags().StringVar(&s3Options.SecretAccessKey, "s3-secret-access-key", "", "Secret access key of the "+pkg.S3CredentialsStatic+" S3 credentials, better set as "+pkg.FlagEnvName("s3-secret-access-key"))
+	RootCmd.PersistentFlags().StringVar(&s3Options.Profile, "s3-profile", "", "Profile of the shared credentials file for the "+pkg.S3CredentialsProfile+" S3 credentials")
+	RootCmd.PersistentFlags().StringVar(&s3Options.RoleARN, "s3-role-arn", "", "Role the "+pkg.S3CredentialsAssumeRole+" S3 credentials assume")
+	RootCmd.PersistentFlags().StringVar(&keyFile, "key-file", "", "Key file used to encrypt the pki in the secret store")
+	RootCmd.PersistentFlags().StringVar(&kmsKeyID, "kms-key-id", "", "KMS key used to encrypt the pki in the secret store")
+	RootCmd.PersistentFlags().BoolVar(&allowPlaintext, "allow-plaintext-secrets", false, "Read secrets stored unencrypted while the store is migrated to --key-file or --kms-key-id")
+	RootCmd.PersistentFlags().DurationVar(&bootstrapTimeout, "bootstrap-timeout", time.Hour, "Time after which the bootstrap gives up, 0 waits forever")
+	RootCmd.PersistentFlags().StringVar(&stateFile, "state-file", "/var/lib/k8sinit/state.json", "File that keeps the bootstrap progress to resume after a crash or reboot")
+	RootCmd.PersistentFlags().StringVar(&lifecycleHook, "lifecycle-hook", "", "Lifecycle hook of the autoscaling group that is completed with the result of the bootstrap or leave")
+	RootCmd.PersistentFlags().DurationVar(&lifecycleHeartbeat, "lifecycle-heartbeat", time.Minute, "Interval of the heartbeats sent to the lifecycle hook")
+	RootCmd.PersistentFlags().StringVar(&nodeName, "node-name", "", "Name of the node and its etcd member, defaults to the hostname")
+	RootCmd.PersistentFlags().StringVar(&etcdEndpoint, "etcd-endpoint", "https://127.0.0.1:2379", "Endpoint of the local etcd member on controllers")
+	RootCmd.PersistentFlags().BoolVar(&airGapped, "air-gapped", false, "Bootstrap without internet access from the "+pkg.AddonPrefix+" manifests and "+pkg.ImagePrefix+" archives of the secret store")
 }
@@ -0,0 +1,593 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+)
+
+//simTimeout bounds a simulation, a node that hasn't finished by then is
+//taken as deadlocked
+const simTimeout = time.Second * 30
+
+//simIMDS serves the identity of one instance with IMDSv2 session tokens
+func simIMDS(identity pkg.InstanceIdentity) *httptest.Server {
+	doc, _ := json.Marshal(identity)
+	token := "token-" + identity.InstanceID
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte(token))
+		case r.Header.Get("X-aws-ec2-metadata-token") != token:
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/dynamic/instance-identity/document":
+			w.Write(doc)
+		case r.URL.Path == "/latest/meta-data/mac":
+			w.Write([]byte("0e:49:61:0f:c3:11"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+//flakyS3 fails every nth request with an internal error before the fake S3
+//sees it, the S3 client retries them
+type flakyS3 struct {
+	*pkgtest.FakeS3
+	every int
+
+	mu     sync.Mutex
+	count  int
+	failed int
+}
+
+func (f *flakyS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.count++
+	fail := f.every > 0 && f.count%f.every == 0
+	if fail {
+		f.failed++
+	}
+	f.mu.Unlock()
+	if fail {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`<Error><Code>InternalError</Code><Message>We encountered an internal error. Please try again.</Message></Error>`))
+		return
+	}
+	f.FakeS3.ServeHTTP(w, r)
+}
+
+//simNode is a simulated instance. It fakes kubeadm and kubectl against the
+//cluster of the simulation and answers the probes of the api server.
+type simNode struct {
+	sim          *sim
+	id           string
+	ip           string
+	name         string
+	controlPlane bool
+	dir          string
+	imds         *httptest.Server
+
+	mu      sync.Mutex
+	running bool
+	killed  bool
+}
+
+//role is controller or worker, the name of the group of the node
+func (n *simNode) role() string {
+	if n.controlPlane {
+		return "controller"
+	}
+	return "worker"
+}
+
+func (n *simNode) peerURL() string {
+	return "https://" + n.ip + ":2380"
+}
+
+func (n *simNode) setRunning(running bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.running = running
+}
+
+func (n *simNode) isRunning() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.running
+}
+
+func (n *simNode) apiHealth(apiDNS string, apiPort int) pkg.APIHealth {
+	if apiDNS == "127.0.0.1" {
+		return upHealth(n.isRunning())
+	}
+	n.sim.mu.Lock()
+	defer n.sim.mu.Unlock()
+	return upHealth(n.sim.apiUp)
+}
+
+func (n *simNode) Run(name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	switch {
+	case strings.HasPrefix(command, "kubeadm init "):
+		return nil, n.sim.init(n)
+	case strings.HasPrefix(command, "kubeadm join "):
+		return nil, n.sim.join(n, args)
+	case command == "kubeadm reset -f":
+		n.setRunning(false)
+	case strings.HasPrefix(command, "kubeadm token create "):
+		return []byte("abcdef.0123456789abcdef\n"), nil
+	case strings.HasPrefix(command, "kubectl apply "):
+	case strings.HasSuffix(command, " version"):
+		return []byte("v1.14.0"), nil
+	case strings.Contains(command, " get cm "):
+		return []byte("cluster-info"), nil
+	case strings.HasSuffix(command, " get nodes -o json"):
+		return n.sim.nodeList(), nil
+	default:
+		n.sim.mu.Lock()
+		n.sim.unexpected = append(n.sim.unexpected, command)
+		n.sim.mu.Unlock()
+		return nil, errors.New("unexpected command " + command)
+	}
+	return nil, nil
+}
+
+//sim bootstraps controllers and workers concurrently against fakes of the
+//metadata service, the autoscaling group, S3 and etcd
+type sim struct {
+	t        *testing.T
+	dir      string
+	sess     *session.Session
+	s3Config *aws.Config
+	s3       *flakyS3
+	s3Srv    *httptest.Server
+	autoSvc  *mockAutoScalingClient
+	ec2Svc   *mockEC2Client
+	etcd     *fakeEtcd
+
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	nextID int
+	nodes  []*simNode
+	errs   map[string]error
+	apiUp  bool
+	inits  []string
+	joins  map[string]string
+	//kill is how many nodes of a role are killed during kubeadm join
+	kill       map[string]int
+	launched   map[string]time.Time
+	initAt     time.Time
+	unexpected []string
+}
+
+func newSim(t *testing.T, controllers int) *sim {
+	s := &sim{
+		t:        t,
+		sess:     session.Must(session.NewSession()),
+		s3:       &flakyS3{FakeS3: pkgtest.NewFakeS3()},
+		autoSvc:  &mockAutoScalingClient{desired: controllers},
+		ec2Svc:   &mockEC2Client{addresses: map[string]string{}},
+		etcd:     newFakeEtcd(),
+		errs:     map[string]error{},
+		joins:    map[string]string{},
+		kill:     map[string]int{},
+		launched: map[string]time.Time{},
+	}
+	s.s3.AccessKeyID = "AKID"
+	s.s3Srv = httptest.NewServer(s.s3)
+	options := pkg.S3Options{
+		Endpoint:        s.s3Srv.URL,
+		PathStyle:       true,
+		Credentials:     pkg.S3CredentialsStatic,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+	}
+	config, err := options.Config(s.sess, "eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.s3Config = config.WithMaxRetries(10)
+	if s.dir, err = ioutil.TempDir("", "k8ssim"); err != nil {
+		t.Fatal(err)
+	}
+	//the addresses of replacements are known up front, the EC2 mock isn't locked
+	for i := 1; i < 100; i++ {
+		s.ec2Svc.addresses[simInstanceID(i)] = simIP(i)
+	}
+	store := s.store()
+	store.Put("kubeadm-cfg-init.yaml", []byte(kubeadmInitConfig))
+	store.Put("cni/weave.yaml", []byte("kind: DaemonSet"))
+	return s
+}
+
+func simInstanceID(i int) string {
+	return fmt.Sprintf("i-%04dsim", i)
+}
+
+func simIP(i int) string {
+	return fmt.Sprintf("10.0.%d.10", i)
+}
+
+func (s *sim) close() {
+	s.s3Srv.Close()
+	s.etcd.Close()
+	for _, n := range s.nodes {
+		n.imds.Close()
+	}
+	os.RemoveAll(s.dir)
+}
+
+//store returns a S3 store that reaches the fake S3 like a compatible
+//endpoint. The nodes share the session, creating them concurrently races.
+func (s *sim) store() *pkg.S3Store {
+	return pkg.NewS3Store(s3.New(s.sess, s.s3Config), "k8s", "sim")
+}
+
+//newNode creates the next instance, controllers get the addresses the EC2
+//mock knows
+func (s *sim) newNode(controlPlane bool) *simNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	i := s.nextID
+	if !controlPlane {
+		i += 100
+	}
+	n := &simNode{
+		sim:          s,
+		id:           simInstanceID(i),
+		ip:           simIP(i),
+		name:         "ip-" + strings.Replace(simIP(i), ".", "-", -1),
+		controlPlane: controlPlane,
+		dir:          filepath.Join(s.dir, simInstanceID(i)),
+	}
+	//a missing dir fails the node once it saves its state
+	os.MkdirAll(n.dir, 0755)
+	n.imds = simIMDS(pkg.InstanceIdentity{
+		InstanceID:       n.id,
+		Region:           "eu-west-1",
+		AvailabilityZone: "eu-west-1a",
+		PrivateIP:        n.ip,
+		InstanceType:     "t3.small",
+		AccountID:        "123456789012",
+	})
+	s.nodes = append(s.nodes, n)
+	return n
+}
+
+//start launches the instance after delay and bootstraps it. A killed node
+//abandons its launch and the group replaces it with a new instance.
+func (s *sim) start(ctx context.Context, n *simNode, delay time.Duration) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		time.Sleep(delay)
+		if n.controlPlane {
+			s.autoSvc.launch(n.id)
+		}
+		s.mu.Lock()
+		s.launched[n.id] = time.Now()
+		s.mu.Unlock()
+
+		err := s.boot(ctx, n)
+		s.mu.Lock()
+		s.errs[n.id] = err
+		s.mu.Unlock()
+		if n.killed {
+			if n.controlPlane {
+				s.autoSvc.terminate(n.id)
+			}
+			s.start(ctx, s.newNode(n.controlPlane), 0)
+		}
+	}()
+}
+
+//boot reads the identity from the metadata service and deploys the node
+//like the controller and worker commands do
+func (s *sim) boot(ctx context.Context, n *simNode) error {
+	identity, err := pkg.NewIMDS(n.imds.URL).GetInstanceIdentity()
+	if err != nil {
+		return err
+	}
+	store := s.store()
+	nd := node{
+		apiDNS:     "api.k8s.local",
+		apiPort:    6443,
+		store:      store,
+		runner:     n,
+		kubeconfig: filepath.Join(n.dir, "admin.conf"),
+		files: map[string]string{
+			"cluster-info.yaml":     filepath.Join(n.dir, "cluster-info.yaml"),
+			"kubeadm-cfg-init.yaml": filepath.Join(n.dir, "cluster-cfg.yaml"),
+			"kubeadm-cfg-join.yaml": filepath.Join(n.dir, "cluster-join.yaml"),
+		},
+		apiHealth:         n.apiHealth,
+		dnsResolves:       func(context.Context, string) error { return nil },
+		backoff:           retry.Backoff{Initial: time.Millisecond * 5, Max: time.Millisecond * 20, Factor: 2, Jitter: 0.2},
+		state:             pkg.NewStateFile(filepath.Join(n.dir, "state.json")),
+		lifecycle:         pkg.NewLifecycleAction(s.autoSvc, n.role(), "launch", identity.InstanceID),
+		heartbeatInterval: time.Millisecond * 10,
+	}
+	if !n.controlPlane {
+		return (&worker{node: nd}).deploy(ctx)
+	}
+
+	cni, _ := pkg.GetNetworkPlugin("weave")
+	c := &controller{
+		node:          nd,
+		instanceID:    identity.InstanceID,
+		pki:           map[string]string{},
+		pkiMode:       pkiModeStore,
+		cni:           cni,
+		tokenTTL:      time.Hour,
+		restorePolicy: restorePolicyNever,
+		nodeName:      n.name,
+		lockStore:     store,
+		provider: pkg.NewAWSProvider(s.autoSvc, s.ec2Svc, pkg.InstanceAddress{
+			ID:        identity.InstanceID,
+			PrivateIP: identity.PrivateIP,
+		}),
+		etcd: func(context.Context, []pkg.InstanceAddress) (*pkg.EtcdClient, error) {
+			return pkg.NewEtcdClient(s.etcd.URL, nil), nil
+		},
+		etcdJoinTimeout:  time.Second * 10,
+		capacityInterval: time.Millisecond * 5,
+		leaseRenew:       leaseRenewInterval,
+	}
+	for name := range caKeys {
+		c.pki[name] = filepath.Join(n.dir, "pki", name)
+	}
+	return c.deploy(ctx)
+}
+
+//init fakes kubeadm init, it creates the pki and starts the first etcd
+//member and the api server
+func (s *sim) init(n *simNode) error {
+	for name := range caKeys {
+		p := filepath.Join(n.dir, "pki", name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, pkiContent(name), 0600); err != nil {
+			return err
+		}
+	}
+	s.etcd.start(n.name, n.peerURL())
+	n.setRunning(true)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inits = append(s.inits, n.id)
+	s.initAt = time.Now()
+	s.apiUp = true
+	return nil
+}
+
+//join fakes kubeadm join, a control plane node starts the etcd member of
+//its peer url. A node whose role is to be killed dies instead.
+func (s *sim) join(n *simNode, args []string) error {
+	if _, err := os.Stat(args[3]); err != nil {
+		return errors.New("no join config: " + err.Error())
+	}
+	controlPlane := args[len(args)-1] == "--control-plane"
+	s.mu.Lock()
+	if s.kill[n.role()] > 0 {
+		s.kill[n.role()]--
+		n.killed = true
+		s.mu.Unlock()
+		return errors.New("signal: killed")
+	}
+	s.joins[n.id] = strings.Join(args, " ")
+	s.mu.Unlock()
+	if controlPlane != n.controlPlane {
+		return errors.New("joined with the wrong role")
+	}
+	if controlPlane {
+		s.etcd.start(n.name, n.peerURL())
+	}
+	n.setRunning(true)
+	return nil
+}
+
+//nodeList is the kubectl get nodes output of the running nodes
+func (s *sim) nodeList() []byte {
+	s.mu.Lock()
+	nodes := append([]*simNode{}, s.nodes...)
+	s.mu.Unlock()
+	items := []interface{}{}
+	for _, n := range nodes {
+		if !n.isRunning() {
+			continue
+		}
+		labels := map[string]string{}
+		if n.controlPlane {
+			labels["node-role.kubernetes.io/control-plane"] = ""
+		}
+		items = append(items, map[string]interface{}{
+			"metadata": map[string]interface{}{"name": n.name, "labels": labels},
+			"spec":     map[string]interface{}{"providerID": "aws:///eu-west-1a/" + n.id},
+			"status": map[string]interface{}{
+				"addresses": []map[string]string{{"type": "InternalIP", "address": n.ip}},
+			},
+		})
+	}
+	dat, _ := json.Marshal(map[string]interface{}{"items": items})
+	return dat
+}
+
+//run bootstraps all nodes and waits till they are done. The controller at
+//delayed is launched late.
+func (s *sim) run(controllers int, workers int, delayed int, delay time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), simTimeout)
+	defer cancel()
+	for i := 1; i <= controllers; i++ {
+		d := time.Duration(0)
+		if i == delayed {
+			d = delay
+		}
+		s.start(ctx, s.newNode(true), d)
+	}
+	for i := 0; i < workers; i++ {
+		s.start(ctx, s.newNode(false), 0)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(simTimeout + time.Second*5):
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.t.Fatalf("the nodes deadlocked, only %v finished", s.errs)
+	}
+}
+
+//check asserts that exactly one controller inits the cluster, every other
+//node joins with its role and etcd ends up with a voting member per
+//controller of the group
+func (s *sim) check(t *testing.T, name string, controllers int, workers int, kills int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	leader := ""
+	if len(s.inits) == 1 {
+		leader = s.inits[0]
+	} else {
+		t.Errorf("%s: expect exactly one kubeadm init, got %v", name, s.inits)
+	}
+	killed, running := 0, []string{}
+	for _, n := range s.nodes {
+		if n.killed {
+			killed++
+			continue
+		}
+		if err := s.errs[n.id]; err != nil {
+			t.Errorf("%s: expect %s to bootstrap, got %v", name, n.id, err)
+		}
+		if !n.isRunning() {
+			t.Errorf("%s: expect %s to run kubernetes", name, n.id)
+		}
+		if n.controlPlane {
+			running = append(running, n.name)
+		}
+		if n.id == leader {
+			continue
+		}
+		args, joined := s.joins[n.id]
+		if !joined {
+			t.Errorf("%s: expect %s to join", name, n.id)
+		} else if e, a := n.controlPlane, strings.HasSuffix(args, "--control-plane"); e != a {
+			t.Errorf("%s: expect %s to join the control plane %v, got %v", name, n.id, e, a)
+		}
+	}
+	if e, a := kills, killed; e != a {
+		t.Errorf("%s: expect %v killed nodes, got %v", name, e, a)
+	}
+	if e, a := controllers+workers, len(s.nodes)-killed; e != a {
+		t.Errorf("%s: expect %v nodes, got %v", name, e, a)
+	}
+
+	members := []string{}
+	s.etcd.mu.Lock()
+	defer s.etcd.mu.Unlock()
+	for _, m := range s.etcd.members {
+		if m.IsLearner {
+			t.Errorf("%s: expect no etcd learner, got %v", name, m)
+		}
+		members = append(members, m.Name)
+	}
+	sort.Strings(members)
+	sort.Strings(running)
+	if !reflect.DeepEqual(running, members) {
+		t.Errorf("%s: expect the etcd members %v, got %v", name, running, members)
+	}
+
+	lease := pkg.Lease{}
+	dat, err := s.store().Get(leaderLockKey)
+	if err != nil {
+		t.Errorf("%s: expect a lease, got %v", name, err)
+	}
+	json.Unmarshal(dat, &lease)
+	if lease.Expires.After(time.Now()) {
+		t.Errorf("%s: expect the lease to be released, %s holds it", name, lease.Holder)
+	}
+
+	results := map[string]int{}
+	s.autoSvc.mu.Lock()
+	for _, result := range s.autoSvc.completions {
+		results[result]++
+	}
+	s.autoSvc.mu.Unlock()
+	expected := map[string]int{pkg.LifecycleActionContinue: controllers + workers}
+	if kills > 0 {
+		expected[pkg.LifecycleActionAbandon] = kills
+	}
+	if !reflect.DeepEqual(expected, results) {
+		t.Errorf("%s: expect the lifecycle actions %v, got %v", name, expected, results)
+	}
+	if len(s.unexpected) > 0 {
+		t.Errorf("%s: expect only known commands, got %v", name, s.unexpected)
+	}
+}
+
+func TestSimulatedBootstrap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the simulation bootstraps whole clusters")
+	}
+	cases := []struct {
+		name        string
+		controllers int
+		workers     int
+		//s3Errors fails every nth S3 request
+		s3Errors int
+		//delayed is the controller that is launched late
+		delayed int
+		//kill is how many nodes of a role are killed during kubeadm join
+		kill map[string]int
+	}{
+		{name: "three controllers and two workers", controllers: 3, workers: 2},
+		{name: "five controllers", controllers: 5, workers: 1},
+		{name: "single controller", controllers: 1, workers: 2},
+		{name: "S3 errors", controllers: 3, workers: 2, s3Errors: 5},
+		{name: "delayed instance", controllers: 3, workers: 1, delayed: 3},
+		{name: "killed nodes", controllers: 3, workers: 2, kill: map[string]int{"controller": 1, "worker": 1}},
+		{name: "all faults", controllers: 5, workers: 3, s3Errors: 7, delayed: 2, kill: map[string]int{"controller": 2, "worker": 1}},
+	}
+	for _, tc := range cases {
+		s := newSim(t, tc.controllers)
+		s.s3.every = tc.s3Errors
+		kills := 0
+		for role, n := range tc.kill {
+			s.kill[role] = n
+			kills += n
+		}
+		s.run(tc.controllers, tc.workers, tc.delayed, time.Millisecond*200)
+		s.check(t, tc.name, tc.controllers, tc.workers, kills)
+		if tc.s3Errors > 0 && s.s3.failed == 0 {
+			t.Errorf("%s: expect failed S3 requests", tc.name)
+		}
+		if tc.delayed > 0 && len(s.inits) > 0 && s.initAt.Before(s.launched[simInstanceID(tc.delayed)]) {
+			t.Errorf("%s: expect the init to wait for the delayed instance", tc.name)
+		}
+		s.close()
+	}
+}
@@ -1,66 +1,106 @@
 package cmd
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"context"
+	"errors"
 	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
 	"github.com/spf13/cobra"
 	"log"
-	"os/exec"
 	"strconv"
 )
 
-func joinWorker(apiDNS string, apiPort int) {
-	joinCmd := exec.Command(
+type worker struct {
+	node
+}
+
+func (w *worker) join() error {
+	if _, err := w.runner.Run(
 		"kubeadm",
 		"join",
-		apiDNS+":"+strconv.Itoa(apiPort),
+		w.apiDNS+":"+strconv.Itoa(w.apiPort),
 		"--config",
-		clusterConfig["kubeadm-cfg-join.yaml"],
-	)
+		w.files["kubeadm-cfg-join.yaml"],
+	); err != nil {
+		return errors.New("failed to join worker: " + err.Error())
+	}
+	return nil
+}
 
-	if err := joinCmd.Run(); err != nil {
-		log.Fatalln("Failed to join worker: " + err.Error())
+func (w *worker) discover(ctx context.Context, state *pkg.BootstrapState) error {
+	if err := w.prepareAirGap(); err != nil {
+		return err
 	}
+	log.Println("Wait till DNS resolves")
+	return w.dnsResolves(ctx, w.apiDNS)
 }
 
-func deployWorker(apiDNS string, apiPort int) {
-	sess, err := session.NewSession()
+func (w *worker) fetchJoinConfig(ctx context.Context, state *pkg.BootstrapState) error {
+	if err := retry.Until(ctx, "wait till kubernetes runs", w.backoff, func(ctx context.Context) bool {
+		health := w.apiHealth(w.apiDNS, w.apiPort)
+		if health != pkg.APIHealthy {
+			log.Println("k8s api server is " + health.String())
+		}
+		return health == pkg.APIHealthy
+	}); err != nil {
+		return err
+	}
+	if err := w.download(ctx, "cluster-info.yaml"); err != nil {
+		return err
+	}
+	if err := w.waitJoinConfig(ctx, false); err != nil {
+		return errors.New("could not write the join config: " + err.Error())
+	}
+	return nil
+}
+
+func (w *worker) kubeadm(ctx context.Context, state *pkg.BootstrapState) error {
+	if state.Resumed() {
+		if err := w.reset(); err != nil {
+			return err
+		}
+	}
+	return w.join()
+}
+
+//deploy bootstraps the worker and completes the launch lifecycle hook
+//with the result
+func (w *worker) deploy(ctx context.Context) error {
+	return w.withLifecycleHook(func() error {
+		return w.bootstrap(ctx)
+	})
+}
+
+//bootstrap runs the phases of the worker, an interrupted bootstrap is
+//resumed at the phase it stopped at
+func (w *worker) bootstrap(ctx context.Context) error {
+	state, err := w.state.Load("worker")
 	if err != nil {
-		log.Fatalln("Could not initialize aws session: " + err.Error())
-	} else {
-		log.Println("AWS Session started")
+		return err
 	}
-	metaSvc := ec2metadata.New(sess)
+	return pkg.RunPhases(ctx, w.state, state, []pkg.Step{
+		{Phase: pkg.PhaseDiscover, Run: w.discover},
+		{Phase: pkg.PhaseFetchPKI, Run: w.fetchJoinConfig},
+		{Phase: pkg.PhaseKubeadm, Run: w.kubeadm},
+	})
+}
 
-	region, err := pkg.GetRegion(metaSvc)
+func deployWorker(apiDNS string, apiPort int) {
+	sess, region, identity := cloudSession()
+	log.Println("Got the region: " + region)
+	store, err := newSecretStore(sess, region)
 	if err != nil {
-		log.Fatalln("Could not get the region: " + err.Error())
-	} else {
-		log.Println("Got the region: " + region)
+		log.Fatalln("Could not initialize the secret store: " + err.Error())
 	}
-	s3Svc := s3.New(sess, aws.NewConfig().WithRegion(region))
 
-	log.Println("Wait till DNS resolves")
-	pkg.DNSResolves(apiDNS)
-	log.Println("Start deployment loop")
-	for {
-		if pkg.KubeUp(apiDNS, apiPort) {
-			for {
-				if err := pkg.DownloadFromS3(s3Svc, bucket, "cluster-info.yaml", clusterConfig["cluster-info.yaml"]); err == nil {
-					break
-				}
-			}
-			for {
-				if err := pkg.DownloadFromS3(s3Svc, bucket, "kubeadm-cfg-join.yaml", clusterConfig["kubeadm-cfg-join.yaml"]); err == nil {
-					break
-				}
-			}
-			joinWorker(apiDNS, apiPort)
-			return
-		}
+	w := &worker{node: newNode(apiDNS, apiPort, store)}
+	if w.lifecycle, err = newLifecycleAction(sess, identity); err != nil {
+		log.Fatalln("Could not set up the lifecycle hook: " + err.Error())
+	}
+	ctx, cancel := bootstrapContext()
+	defer cancel()
+	if err := w.deploy(ctx); err != nil {
+		log.Fatalln("Could not deploy the worker: " + err.Error())
 	}
 }
 
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+func TestWorkerDeploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner := pkgtest.NewScriptedRunner(pkgtest.FakeCall{Command: []string{"kubeadm", "join"}})
+	w := &worker{node: newTestNode(dir, runner, &kubeProbe{health: []pkg.APIHealth{pkg.APIUnreachable, pkg.APIUnhealthy, pkg.APIHealthy}})}
+	w.store.Put("cluster-info.yaml", []byte("cluster-info"))
+	publishJoinConfig(t, w.store, time.Now())
+	refreshed := make(chan struct{})
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		err := pkg.PublishJoinConfig(w.store, &pkg.JoinConfig{
+			APIEndpoint: "api.k8s.local:6443",
+			Token:       "ghijkl.0123456789abcdef",
+			Expires:     time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		close(refreshed)
+	}()
+
+	if err := w.deploy(context.Background()); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	<-refreshed
+	expected := [][]string{{"kubeadm", "join", "api.k8s.local:6443", "--config", w.files["kubeadm-cfg-join.yaml"]}}
+	if e, a := expected, runner.Calls(); !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	dat, _ := ioutil.ReadFile(w.files["kubeadm-cfg-join.yaml"])
+	if !strings.Contains(string(dat), "token: ghijkl.0123456789abcdef") {
+		t.Errorf("expect the refreshed join config, got %s", dat)
+	}
+}
+
+func TestWorkerResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner := pkgtest.NewScriptedRunner(
+		pkgtest.FakeCall{Command: []string{"kubeadm", "reset", "-f"}},
+		pkgtest.FakeCall{Command: []string{"kubeadm", "join"}},
+	)
+	w := &worker{node: newTestNode(dir, runner, &kubeProbe{apiUp: []bool{true}})}
+	w.state.Save(&pkg.BootstrapState{Role: "worker", Phase: pkg.PhaseKubeadm, Started: true})
+
+	if err := w.deploy(context.Background()); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	expected := [][]string{
+		{"kubeadm", "reset", "-f"},
+		{"kubeadm", "join", "api.k8s.local:6443", "--config", w.files["kubeadm-cfg-join.yaml"]},
+	}
+	if e, a := expected, runner.Calls(); !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestWorkerBootstrapTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := &worker{node: newTestNode(dir, pkgtest.NewScriptedRunner(), &kubeProbe{apiUp: []bool{false}})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err = w.deploy(ctx)
+	if err == nil || !strings.Contains(err.Error(), "wait till kubernetes runs") {
+		t.Errorf("expect the wait for kubernetes to time out, got %v", err)
+	}
+	if state, _ := w.state.Load("worker"); state.Phase != pkg.PhaseFetchPKI {
+		t.Errorf("expect the phase to be resumed later, got %v", state.Phase)
+	}
+}
+
+func TestWorkerLifecycleHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner := pkgtest.NewScriptedRunner(pkgtest.FakeCall{Command: []string{"kubeadm", "join"}, ExitCode: 1, Do: func([]string) {
+		time.Sleep(time.Millisecond * 10)
+	}})
+	w := &worker{node: newTestNode(dir, runner, &kubeProbe{apiUp: []bool{true}})}
+	svc := &mockAutoScalingClient{}
+	w.lifecycle = pkg.NewLifecycleAction(svc, "worker", "launch", "i-743adsf")
+	w.heartbeatInterval = time.Millisecond
+	w.state.Save(&pkg.BootstrapState{Role: "worker", Phase: pkg.PhaseKubeadm})
+
+	if err := w.deploy(context.Background()); err == nil {
+		t.Fatalf("expect error")
+	}
+	checkLifecycleHook(t, svc, pkg.LifecycleActionAbandon)
+}
@@ -4,7 +4,8 @@ require (
 	github.com/aws/aws-sdk-go v1.16.13
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/spf13/cobra v0.0.3
-	github.com/spf13/pflag v1.0.3 // indirect
+	github.com/spf13/pflag v1.0.3
 	github.com/stretchr/testify v1.3.0 // indirect
 	golang.org/x/net v0.0.0-20190607181551-461777fb6f67 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//AddonPrefix is the prefix in the secret store that holds the addon manifests
+//of air-gapped clusters
+const AddonPrefix = "addons/"
+
+//ImagePrefix is the prefix in the secret store that holds the image archives
+//of air-gapped clusters, created with docker save or ctr images export
+const ImagePrefix = "images/"
+
+//AddonKey returns the store key of the manifest of an addon
+func AddonKey(name string) string {
+	return AddonPrefix + name + ".yaml"
+}
+
+//MissingArtifactsError reports the addons and images an air-gapped node
+//can't find in the secret store
+type MissingArtifactsError struct {
+	Addons []string
+	Images []string
+}
+
+func (e *MissingArtifactsError) Error() string {
+	report := []string{}
+	if len(e.Addons) > 0 {
+		report = append(report, "addon manifests missing below "+AddonPrefix+": "+strings.Join(e.Addons, ", "))
+	}
+	if len(e.Images) > 0 {
+		report = append(report, "images missing in the archives below "+ImagePrefix+": "+strings.Join(e.Images, ", "))
+	}
+	return "air-gapped bootstrap is incomplete, " + strings.Join(report, "; ")
+}
+
+//ImageBundle are the image archives of the secret store, downloaded to a
+//local directory
+type ImageBundle struct {
+	//Archives maps the local path of each archive to the images it contains
+	Archives map[string][]string
+}
+
+//LoadImageBundle downloads all archives below ImagePrefix to dir and reads
+//the image names from their manifest.json
+func LoadImageBundle(store SecretStore, dir string) (*ImageBundle, error) {
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	bundle := &ImageBundle{Archives: map[string][]string{}}
+	for _, name := range names {
+		if !strings.HasPrefix(name, ImagePrefix) || !strings.HasSuffix(name, ".tar") {
+			continue
+		}
+		p := filepath.Join(dir, path.Base(name))
+		if err := Download(store, name, p); err != nil {
+			return nil, errors.New("could not download " + name + ": " + err.Error())
+		}
+		images, err := archiveImages(p)
+		if err != nil {
+			return nil, errors.New("could not read " + name + ": " + err.Error())
+		}
+		bundle.Archives[p] = images
+	}
+	return bundle, nil
+}
+
+//Missing returns the images that are not part of any archive
+func (b *ImageBundle) Missing(images []string) []string {
+	found := map[string]bool{}
+	for _, archived := range b.Archives {
+		for _, image := range archived {
+			found[normalizeImage(image)] = true
+		}
+	}
+	missing := []string{}
+	for _, image := range images {
+		if !found[normalizeImage(image)] {
+			missing = append(missing, image)
+		}
+	}
+	return missing
+}
+
+//Import loads all archives into the k8s.io namespace of containerd
+func (b *ImageBundle) Import(runner Runner) error {
+	archives := []string{}
+	for p := range b.Archives {
+		archives = append(archives, p)
+	}
+	sort.Strings(archives)
+	for _, p := range archives {
+		if _, err := runner.Run("ctr", "-n", "k8s.io", "images", "import", p); err != nil {
+			return errors.New("could not import " + p + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+//KubeadmImages lists the images kubeadm needs for the given config
+func KubeadmImages(runner Runner, kubeadmConfig string) ([]string, error) {
+	out, err := runner.Run("kubeadm", "config", "images", "list", "--config", kubeadmConfig)
+	if err != nil {
+		return nil, errors.New("could not list the kubeadm images: " + err.Error())
+	}
+	images := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			images = append(images, line)
+		}
+	}
+	return images, nil
+}
+
+//CheckAirGap verifies that the addon manifests and all images exist in the
+//store and bundle, it returns a MissingArtifactsError listing everything
+//that is missing
+func CheckAirGap(store SecretStore, bundle *ImageBundle, addons []string, images []string) error {
+	missing := &MissingArtifactsError{Images: bundle.Missing(images)}
+	for _, addon := range addons {
+		if _, err := store.Get(AddonKey(addon)); err == ErrNotFound {
+			missing.Addons = append(missing.Addons, addon)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(missing.Addons) > 0 || len(missing.Images) > 0 {
+		return missing
+	}
+	return nil
+}
+
+//archiveImages reads the RepoTags of the manifest.json of a docker save archive
+func archiveImages(archive string) ([]string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("manifest.json not found")
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Clean(hdr.Name) != "manifest.json" {
+			continue
+		}
+		dat, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		manifest := []struct {
+			RepoTags []string
+		}{}
+		if err := json.Unmarshal(dat, &manifest); err != nil {
+			return nil, err
+		}
+		images := []string{}
+		for _, entry := range manifest {
+			images = append(images, entry.RepoTags...)
+		}
+		return images, nil
+	}
+}
+
+//normalizeImage strips the default registry so that nginx:1.17 and
+//docker.io/library/nginx:1.17 compare equal
+func normalizeImage(image string) string {
+	image = strings.TrimPrefix(image, "docker.io/")
+	return strings.TrimPrefix(image, "library/")
+}
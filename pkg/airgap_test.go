@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+//imageArchive builds a docker save archive that only contains the manifest
+func imageArchive(t *testing.T, images ...string) []byte {
+	manifest, _ := json.Marshal([]map[string]interface{}{{"Config": "config.json", "RepoTags": images}})
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "config.json", Mode: 0644, Size: 2})
+	tw.Write([]byte("{}"))
+	tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))})
+	tw.Write(manifest)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAirGap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(filepath.Join(dir, "store"))
+	store.Put("images/control-plane.tar", imageArchive(t, "k8s.gcr.io/kube-apiserver:v1.14.0", "k8s.gcr.io/pause:3.1"))
+	store.Put("images/weave.tar", imageArchive(t, "docker.io/weaveworks/weave-kube:2.5.2"))
+	store.Put("images/README", []byte("not an archive"))
+	store.Put(AddonKey("weave"), []byte("kind: DaemonSet"))
+
+	runner := pkgtest.NewScriptedRunner(
+		pkgtest.FakeCall{Command: []string{"kubeadm", "config", "images", "list"}, Output: []byte("k8s.gcr.io/kube-apiserver:v1.14.0\nk8s.gcr.io/pause:3.1\n")},
+		pkgtest.FakeCall{Command: []string{"ctr"}},
+	)
+	images, err := KubeadmImages(runner, "/tmp/cluster-cfg.yaml")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	bundle, err := LoadImageBundle(store, filepath.Join(dir, "images"))
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := 2, len(bundle.Archives); e != a {
+		t.Errorf("expect %v archives, got %v", e, a)
+	}
+	if err := CheckAirGap(store, bundle, []string{"weave"}, append(images, "weaveworks/weave-kube:2.5.2")); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+
+	err = CheckAirGap(store, bundle, []string{"weave", "calico"}, append(images, "k8s.gcr.io/etcd:3.3.10"))
+	missing, ok := err.(*MissingArtifactsError)
+	if !ok {
+		t.Fatalf("expect a MissingArtifactsError, got %v", err)
+	}
+	if e, a := (&MissingArtifactsError{Addons: []string{"calico"}, Images: []string{"k8s.gcr.io/etcd:3.3.10"}}), missing; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if !strings.Contains(err.Error(), "calico") || !strings.Contains(err.Error(), "k8s.gcr.io/etcd:3.3.10") {
+		t.Errorf("expect the report to list all missing artifacts, got %v", err)
+	}
+
+	if err := bundle.Import(runner); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	expected := [][]string{
+		{"kubeadm", "config", "images", "list", "--config", "/tmp/cluster-cfg.yaml"},
+		{"ctr", "-n", "k8s.io", "images", "import", filepath.Join(dir, "images", "control-plane.tar")},
+		{"ctr", "-n", "k8s.io", "images", "import", filepath.Join(dir, "images", "weave.tar")},
+	}
+	if e, a := expected, runner.Calls(); !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	store.Put("images/broken.tar", []byte("broken"))
+	if _, err := LoadImageBundle(store, filepath.Join(dir, "images")); err == nil {
+		t.Errorf("expect error for an archive without manifest.json")
+	}
+}
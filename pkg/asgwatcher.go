@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+)
+
+//ASGWatcher follows the live state of an autoscaling group by describing it
+//again on every check
+type ASGWatcher struct {
+	svc  autoscalingiface.AutoScalingAPI
+	name string
+}
+
+//NewASGWatcher creates a watcher of the named group
+func NewASGWatcher(svc autoscalingiface.AutoScalingAPI, name string) *ASGWatcher {
+	return &ASGWatcher{svc: svc, name: name}
+}
+
+//Describe gets the current state of the group, following all pages
+func (w *ASGWatcher) Describe(ctx context.Context) (*autoscaling.Group, error) {
+	var group *autoscaling.Group
+	err := w.svc.DescribeAutoScalingGroupsPagesWithContext(
+		ctx,
+		&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: []*string{aws.String(w.name)},
+		},
+		func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+			for _, g := range page.AutoScalingGroups {
+				if aws.StringValue(g.AutoScalingGroupName) == w.name {
+					group = g
+					return false
+				}
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, errors.New("autoscaling group " + w.name + " not found")
+	}
+	return group, nil
+}
+
+//ActiveInstances returns the instances of a group that are in service or
+//about to be after their launch lifecycle hook
+func ActiveInstances(group *autoscaling.Group) []*autoscaling.Instance {
+	active := []*autoscaling.Instance{}
+	for _, instance := range group.Instances {
+		switch aws.StringValue(instance.LifecycleState) {
+		case autoscaling.LifecycleStateInService, autoscaling.LifecycleStatePendingWait:
+			active = append(active, instance)
+		}
+	}
+	return active
+}
+
+//isLeaving tells if an instance is terminating or moved to standby
+func isLeaving(instance *autoscaling.Instance) bool {
+	switch aws.StringValue(instance.LifecycleState) {
+	case autoscaling.LifecycleStateTerminating,
+		autoscaling.LifecycleStateTerminatingWait,
+		autoscaling.LifecycleStateTerminatingProceed,
+		autoscaling.LifecycleStateTerminated,
+		autoscaling.LifecycleStateEnteringStandby,
+		autoscaling.LifecycleStateStandby:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+//AWSProvider finds the peers in the autoscaling group of the instance
+type AWSProvider struct {
+	autoSvc autoscalingiface.AutoScalingAPI
+	ec2Svc  ec2iface.EC2API
+	self    InstanceAddress
+
+	mu      sync.Mutex
+	watcher *ASGWatcher
+}
+
+//NewAWSProvider creates a provider for the instance self
+func NewAWSProvider(autoSvc autoscalingiface.AutoScalingAPI, ec2Svc ec2iface.EC2API, self InstanceAddress) *AWSProvider {
+	return &AWSProvider{autoSvc: autoSvc, ec2Svc: ec2Svc, self: self}
+}
+
+//Name returns aws
+func (p *AWSProvider) Name() string {
+	return "aws"
+}
+
+//AutoScaling returns the autoscaling client of the provider
+func (p *AWSProvider) AutoScaling() autoscalingiface.AutoScalingAPI {
+	return p.autoSvc
+}
+
+//EC2 returns the ec2 client of the provider
+func (p *AWSProvider) EC2() ec2iface.EC2API {
+	return p.ec2Svc
+}
+
+//Self returns the instance from the instance metadata
+func (p *AWSProvider) Self(ctx context.Context) (InstanceAddress, error) {
+	return p.self, nil
+}
+
+//Watcher returns the watcher of the autoscaling group of the instance, the
+//name of the group is looked up once
+func (p *AWSProvider) Watcher() (*ASGWatcher, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.watcher == nil {
+		groupName, err := GetAutoscalingGroupName(p.autoSvc, p.self.ID)
+		if err != nil {
+			return nil, errors.New("could not get the autoscaling group name: " + err.Error())
+		}
+		p.watcher = NewASGWatcher(p.autoSvc, groupName)
+	}
+	return p.watcher, nil
+}
+
+//Group describes the autoscaling group of the instance
+func (p *AWSProvider) Group(ctx context.Context) (*autoscaling.Group, error) {
+	watcher, err := p.Watcher()
+	if err != nil {
+		return nil, err
+	}
+	group, err := watcher.Describe(ctx)
+	if err != nil {
+		return nil, errors.New("could not describe the autoscaling group: " + err.Error())
+	}
+	return group, nil
+}
+
+//Peers returns the addresses of the active instances of the group. Pending
+//instances that aren't held by a launch lifecycle hook don't count yet,
+//terminating instances and those in standby don't count anymore.
+func (p *AWSProvider) Peers(ctx context.Context) ([]InstanceAddress, error) {
+	group, err := p.Group(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, i := range ActiveInstances(group) {
+		ids = append(ids, aws.StringValue(i.InstanceId))
+	}
+	sort.Strings(ids)
+	instances, err := DescribeInstanceAddresses(p.ec2Svc, ids)
+	if err != nil {
+		return nil, errors.New("could not describe the instances: " + err.Error())
+	}
+	return instances, nil
+}
+
+//DesiredCapacity returns the desired capacity of the group
+func (p *AWSProvider) DesiredCapacity(ctx context.Context) (int, error) {
+	group, err := p.Group(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return int(aws.Int64Value(group.DesiredCapacity)), nil
+}
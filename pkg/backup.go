@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+//BackupPrefix is the prefix of the etcd snapshots in the secret store
+const BackupPrefix = "backups/"
+
+//LatestBackupKey points to the newest snapshot
+const LatestBackupKey = BackupPrefix + "latest.json"
+
+const (
+	backupKeyPrefix  = BackupPrefix + "etcd-snapshot-"
+	backupKeySuffix  = ".db.gz"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+//BackupPointer describes a snapshot, it is kept as LatestBackupKey for the
+//restore tooling
+type BackupPointer struct {
+	Key       string    `json:"key"`
+	Created   time.Time `json:"created"`
+	Size      int       `json:"size"`
+	Encrypted bool      `json:"encrypted"`
+}
+
+//RetentionPolicy decides which snapshots are pruned. The newest Keep
+//snapshots are kept unless they are older than MaxAge, the latest snapshot
+//is never pruned. Zero values disable the limit.
+type RetentionPolicy struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+//BackupKey returns the key of a snapshot taken at t, keys sort by time
+func BackupKey(t time.Time) string {
+	return backupKeyPrefix + t.UTC().Format(backupTimeFormat) + backupKeySuffix
+}
+
+//backupTime parses the time of a snapshot key
+func backupTime(key string) (time.Time, bool) {
+	if !strings.HasPrefix(key, backupKeyPrefix) || !strings.HasSuffix(key, backupKeySuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(key, backupKeyPrefix), backupKeySuffix))
+	return t, err == nil
+}
+
+//UploadBackup compresses a snapshot, puts it to the store, envelope
+//encrypted if kp is set, and points LatestBackupKey to it
+func UploadBackup(store SecretStore, kp KeyProvider, snapshot []byte, now time.Time) (*BackupPointer, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(snapshot); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	pointer := &BackupPointer{Key: BackupKey(now), Created: now.UTC(), Size: buf.Len(), Encrypted: kp != nil}
+	if err := PutSecret(store, pointer.Key, buf.Bytes(), kp); err != nil {
+		return nil, errors.New("could not upload " + pointer.Key + ": " + err.Error())
+	}
+	dat, err := json.Marshal(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(LatestBackupKey, dat); err != nil {
+		return nil, errors.New("could not update " + LatestBackupKey + ": " + err.Error())
+	}
+	return pointer, nil
+}
+
+//GetLatestBackup reads the pointer to the newest snapshot, ErrNotFound is
+//returned if there is no backup
+func GetLatestBackup(store SecretStore) (*BackupPointer, error) {
+	dat, err := store.Get(LatestBackupKey)
+	if err != nil {
+		return nil, err
+	}
+	pointer := &BackupPointer{}
+	if err := json.Unmarshal(dat, pointer); err != nil {
+		return nil, errors.New("invalid " + LatestBackupKey + ": " + err.Error())
+	}
+	return pointer, nil
+}
+
+//DownloadBackup gets the snapshot a pointer refers to and decompresses it
+func DownloadBackup(store SecretStore, kp KeyProvider, pointer *BackupPointer) ([]byte, error) {
+	dat, err := GetSecret(store, pointer.Key, kp)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		return nil, errors.New(pointer.Key + ": " + err.Error())
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+//ListBackups returns the keys of all snapshots, the oldest first
+func ListBackups(store SecretStore) ([]string, error) {
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, name := range names {
+		if _, ok := backupTime(name); ok {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+//PruneBackups deletes the snapshots the policy doesn't keep and returns their keys
+func PruneBackups(store SecretStore, policy RetentionPolicy, now time.Time) ([]string, error) {
+	dstore, ok := store.(DeleteStore)
+	if !ok {
+		return nil, errors.New("secret store does not support deleting backups")
+	}
+	keys, err := ListBackups(store)
+	if err != nil {
+		return nil, err
+	}
+	latest := ""
+	if pointer, err := GetLatestBackup(store); err == nil {
+		latest = pointer.Key
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	pruned := []string{}
+	for i, key := range keys {
+		created, _ := backupTime(key)
+		newer := len(keys) - 1 - i
+		expired := policy.Keep > 0 && newer >= policy.Keep ||
+			policy.MaxAge > 0 && now.Sub(created) > policy.MaxAge
+		if !expired || key == latest || i == len(keys)-1 {
+			continue
+		}
+		log.Println("Prune backup " + key)
+		if err := dstore.Delete(key); err != nil {
+			return pruned, errors.New("could not delete " + key + ": " + err.Error())
+		}
+		pruned = append(pruned, key)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp, err := NewKeyFileProvider(writeKeyFile(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileStore(filepath.Join(dir, "store"))
+	if _, err := GetLatestBackup(store); err != ErrNotFound {
+		t.Errorf("expect %v, got %v", ErrNotFound, err)
+	}
+
+	start := time.Date(2026, 10, 1, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if _, err := UploadBackup(store, kp, []byte("snapshot"), start.Add(time.Hour*24*time.Duration(i))); err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+	}
+	store.Put(BackupPrefix+"README", []byte("not a snapshot"))
+	pointer, err := GetLatestBackup(store)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "backups/etcd-snapshot-20261004T030000Z.db.gz", pointer.Key; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if !pointer.Encrypted {
+		t.Errorf("expect the backup to be encrypted")
+	}
+	if dat, _ := store.Get(pointer.Key); string(dat) == "snapshot" {
+		t.Errorf("expect the backup to be compressed and encrypted")
+	}
+	snapshot, err := DownloadBackup(store, kp, pointer)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "snapshot", string(snapshot); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	pruned, err := PruneBackups(store, RetentionPolicy{Keep: 3}, start.Add(time.Hour*24*4))
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := []string{"backups/etcd-snapshot-20261001T030000Z.db.gz"}, pruned; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	pruned, _ = PruneBackups(store, RetentionPolicy{Keep: 3, MaxAge: time.Hour * 30}, start.Add(time.Hour*24*4))
+	expected := []string{"backups/etcd-snapshot-20261002T030000Z.db.gz", "backups/etcd-snapshot-20261003T030000Z.db.gz"}
+	if e, a := expected, pruned; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	PruneBackups(store, RetentionPolicy{MaxAge: time.Hour}, start.Add(time.Hour*24*30))
+	keys, _ := ListBackups(store)
+	if e, a := []string{pointer.Key}, keys; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect the latest backup to be kept, expect %v, got %v", e, a)
+	}
+}
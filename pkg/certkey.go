@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+//CertificateKeyKey is the key of the certificate key in the secret store
+const CertificateKeyKey = "certificate-key.json"
+
+//CertificateKeyTTL is how long kubeadm keeps the uploaded certificates
+const CertificateKeyTTL = time.Hour * 2
+
+//ErrCertificateKeyStale is returned for a certificate key whose uploaded
+//certificates are deleted soon
+var ErrCertificateKeyStale = errors.New("the certificate key is stale")
+
+//CertificateKey decrypts the control plane certificates that kubeadm
+//uploaded to the kubeadm-certs secret
+type CertificateKey struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+//GenerateCertificateKey creates a random AES-256 key in the hex encoding
+//kubeadm expects for --certificate-key
+func GenerateCertificateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+//UploadCerts uploads the control plane certificates of this node, encrypted
+//with key, to the kubeadm-certs secret
+func UploadCerts(runner Runner, kubeconfig string, key string) error {
+	if _, err := runner.Run(
+		"kubeadm",
+		"init",
+		"phase",
+		"upload-certs",
+		"--upload-certs",
+		"--kubeconfig",
+		kubeconfig,
+		"--certificate-key",
+		key,
+	); err != nil {
+		return errors.New("could not upload the certificates: " + err.Error())
+	}
+	return nil
+}
+
+//PublishCertificateKey puts the certificate key to the store, envelope
+//encrypted if kp is set
+func PublishCertificateKey(store SecretStore, kp KeyProvider, key *CertificateKey) error {
+	dat, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return PutSecret(store, CertificateKeyKey, dat, kp)
+}
+
+//GetCertificateKey reads the certificate key from the store.
+//ErrCertificateKeyStale is returned together with the key if it expires
+//within minValidity.
+func GetCertificateKey(store SecretStore, kp KeyProvider, minValidity time.Duration, now time.Time) (*CertificateKey, error) {
+	dat, err := GetSecret(store, CertificateKeyKey, kp)
+	if err != nil {
+		return nil, err
+	}
+	key := &CertificateKey{}
+	if err := json.Unmarshal(dat, key); err != nil {
+		return nil, errors.New("invalid certificate key: " + err.Error())
+	}
+	if key.Expires.Before(now.Add(minValidity)) {
+		return key, ErrCertificateKeyStale
+	}
+	return key, nil
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+func TestCertificateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp, err := NewKeyFileProvider(writeKeyFile(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileStore(filepath.Join(dir, "store"))
+
+	key, err := GenerateCertificateKey()
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if raw, err := hex.DecodeString(key); err != nil || len(raw) != 32 {
+		t.Errorf("expect a hex encoded 32 byte key, got %v %v", key, err)
+	}
+
+	now := time.Now()
+	if err := PublishCertificateKey(store, kp, &CertificateKey{Key: key, Expires: now.Add(CertificateKeyTTL)}); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if dat, _ := store.Get(CertificateKeyKey); strings.Contains(string(dat), key) {
+		t.Errorf("expect the certificate key to be encrypted in the store")
+	}
+	published, err := GetCertificateKey(store, kp, time.Minute, now)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := key, published.Key; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if _, err := GetCertificateKey(store, kp, time.Minute, now.Add(CertificateKeyTTL)); err != ErrCertificateKeyStale {
+		t.Errorf("expect %v, got %v", ErrCertificateKeyStale, err)
+	}
+
+	runner := pkgtest.NewScriptedRunner(pkgtest.FakeCall{Command: []string{"kubeadm", "init", "phase", "upload-certs"}})
+	if err := UploadCerts(runner, "/etc/kubernetes/admin.conf", key); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "kubeadm init phase upload-certs --upload-certs --kubeconfig /etc/kubernetes/admin.conf --certificate-key "+key, strings.Join(runner.Calls()[0], " "); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//ManifestParams are the cluster settings a network plugin manifest is rendered for
+type ManifestParams struct {
+	PodCIDR     string
+	ServiceCIDR string
+	KubeVersion string
+}
+
+//NetworkPlugin is a CNI plugin that is deployed after kubeadm init
+type NetworkPlugin interface {
+	Name() string
+	//CheckCIDR validates the pod CIDR of the kubeadm ClusterConfiguration for the plugin
+	CheckCIDR(params ManifestParams) error
+	//Manifest renders the manifest, preferring cni/<name>.yaml from the store
+	//over the pinned upstream manifest
+	Manifest(store SecretStore, params ManifestParams) ([]byte, error)
+	//Render sets the pod CIDR in a manifest of the plugin
+	Render(manifest []byte, params ManifestParams) []byte
+}
+
+type pinnedPlugin struct {
+	name        string
+	url         func(params ManifestParams) string
+	defaultCIDR string
+	needsCIDR   bool
+	client      *http.Client
+}
+
+var networkPlugins = map[string]*pinnedPlugin{
+	"calico": {
+		name: "calico",
+		url: func(ManifestParams) string {
+			return "https://docs.projectcalico.org/v3.8/manifests/calico.yaml"
+		},
+		defaultCIDR: "192.168.0.0/16",
+		needsCIDR:   true,
+	},
+	"cilium": {
+		name: "cilium",
+		url: func(ManifestParams) string {
+			return "https://raw.githubusercontent.com/cilium/cilium/v1.5.5/examples/kubernetes/1.14/cilium.yaml"
+		},
+		needsCIDR: true,
+	},
+	"flannel": {
+		name: "flannel",
+		url: func(ManifestParams) string {
+			return "https://raw.githubusercontent.com/coreos/flannel/v0.11.0/Documentation/kube-flannel.yml"
+		},
+		defaultCIDR: "10.244.0.0/16",
+		needsCIDR:   true,
+	},
+	"weave": {
+		name: "weave",
+		url: func(params ManifestParams) string {
+			query := url.Values{}
+			query.Set("k8s-version", base64.StdEncoding.EncodeToString([]byte(params.KubeVersion)))
+			query.Set("version", "2.5.2")
+			if params.PodCIDR != "" {
+				query.Set("env.IPALLOC_RANGE", params.PodCIDR)
+			}
+			return "https://cloud.weave.works/k8s/net?" + query.Encode()
+		},
+	},
+}
+
+//GetNetworkPlugin returns the built in network plugin with the given name
+func GetNetworkPlugin(name string) (NetworkPlugin, error) {
+	plugin, ok := networkPlugins[name]
+	if !ok {
+		return nil, errors.New("unknown network plugin " + name + ", use one of " + strings.Join(NetworkPluginNames(), ", "))
+	}
+	return plugin, nil
+}
+
+//NetworkPluginNames returns the names of the built in network plugins
+func NetworkPluginNames() []string {
+	names := []string{}
+	for name := range networkPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *pinnedPlugin) Name() string {
+	return p.name
+}
+
+func (p *pinnedPlugin) CheckCIDR(params ManifestParams) error {
+	if params.PodCIDR == "" {
+		if p.needsCIDR {
+			return errors.New(p.name + " needs networking.podSubnet in the kubeadm ClusterConfiguration")
+		}
+		return nil
+	}
+	_, pods, err := net.ParseCIDR(params.PodCIDR)
+	if err != nil {
+		return errors.New("invalid networking.podSubnet: " + err.Error())
+	}
+	if params.ServiceCIDR != "" {
+		_, services, err := net.ParseCIDR(params.ServiceCIDR)
+		if err != nil {
+			return errors.New("invalid networking.serviceSubnet: " + err.Error())
+		}
+		if pods.Contains(services.IP) || services.Contains(pods.IP) {
+			return fmt.Errorf("pod subnet %s overlaps the service subnet %s", params.PodCIDR, params.ServiceCIDR)
+		}
+	}
+	return nil
+}
+
+func (p *pinnedPlugin) Manifest(store SecretStore, params ManifestParams) ([]byte, error) {
+	manifest, err := store.Get("cni/" + p.name + ".yaml")
+	if err == ErrNotFound {
+		manifest, err = p.fetch(p.url(params))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.Render(manifest, params), nil
+}
+
+func (p *pinnedPlugin) Render(manifest []byte, params ManifestParams) []byte {
+	if p.defaultCIDR != "" && params.PodCIDR != "" {
+		return bytes.Replace(manifest, []byte(p.defaultCIDR), []byte(params.PodCIDR), -1)
+	}
+	return manifest
+}
+
+func (p *pinnedPlugin) fetch(manifestURL string) ([]byte, error) {
+	client := p.client
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	resp, err := client.Get(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("could not fetch " + manifestURL + ": " + resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+//ClusterNetworking reads the pod and service subnet from the
+//ClusterConfiguration of a kubeadm config file
+func ClusterNetworking(kubeadmConfig []byte) (ManifestParams, error) {
+	params := ManifestParams{}
+	decoder := yaml.NewDecoder(bytes.NewReader(kubeadmConfig))
+	for {
+		doc := struct {
+			Kind       string `yaml:"kind"`
+			Networking struct {
+				PodSubnet     string `yaml:"podSubnet"`
+				ServiceSubnet string `yaml:"serviceSubnet"`
+			} `yaml:"networking"`
+		}{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return params, nil
+		} else if err != nil {
+			return params, err
+		}
+		if doc.Kind == "ClusterConfiguration" {
+			params.PodCIDR = doc.Networking.PodSubnet
+			params.ServiceCIDR = doc.Networking.ServiceSubnet
+			if params.ServiceCIDR == "" {
+				params.ServiceCIDR = "10.96.0.0/12"
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+const kubeadmInitConfig = `apiVersion: kubeadm.k8s.io/v1beta2
+kind: InitConfiguration
+nodeRegistration:
+  name: controller-0
+---
+apiVersion: kubeadm.k8s.io/v1beta2
+kind: ClusterConfiguration
+controlPlaneEndpoint: api.k8s.local:6443
+networking:
+  podSubnet: 10.32.0.0/16
+`
+
+func TestClusterNetworking(t *testing.T) {
+	params, err := ClusterNetworking([]byte(kubeadmInitConfig))
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "10.32.0.0/16", params.PodCIDR; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "10.96.0.0/12", params.ServiceCIDR; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestCheckCIDR(t *testing.T) {
+	cases := []struct {
+		plugin string
+		params ManifestParams
+		valid  bool
+	}{
+		{"flannel", ManifestParams{PodCIDR: "10.244.0.0/16", ServiceCIDR: "10.96.0.0/12"}, true},
+		{"flannel", ManifestParams{ServiceCIDR: "10.96.0.0/12"}, false},
+		{"weave", ManifestParams{ServiceCIDR: "10.96.0.0/12"}, true},
+		{"calico", ManifestParams{PodCIDR: "10.96.0.0/16", ServiceCIDR: "10.96.0.0/12"}, false},
+		{"cilium", ManifestParams{PodCIDR: "10.300.0.0/16"}, false},
+	}
+	for _, c := range cases {
+		plugin, err := GetNetworkPlugin(c.plugin)
+		if err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+		err = plugin.CheckCIDR(c.params)
+		if c.valid && err != nil {
+			t.Errorf("%s %v: expect no error, got %v", c.plugin, c.params, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s %v: expect error", c.plugin, c.params)
+		}
+	}
+	if _, err := GetNetworkPlugin("kube-router"); err == nil {
+		t.Errorf("expect error for an unknown plugin")
+	}
+}
+
+func TestNetworkPluginManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(dir)
+	params := ManifestParams{PodCIDR: "10.32.0.0/16", KubeVersion: "v1.14.0"}
+
+	server := initTestServer("/flannel.yml", `net-conf.json: |
+    {
+      "Network": "10.244.0.0/16",
+      "Backend": {"Type": "vxlan"}
+    }`)
+	defer server.Close()
+	flannel := *networkPlugins["flannel"]
+	flannel.url = func(ManifestParams) string { return server.URL + "/flannel.yml" }
+	manifest, err := flannel.Manifest(store, params)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if !strings.Contains(string(manifest), `"Network": "10.32.0.0/16"`) {
+		t.Errorf("expect the pod CIDR to be rendered, got %s", manifest)
+	}
+
+	store.Put("cni/flannel.yaml", []byte(`"Network": "10.244.0.0/16"`))
+	manifest, err = flannel.Manifest(store, params)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := `"Network": "10.32.0.0/16"`, string(manifest); e != a {
+		t.Errorf("expect the manifest from the store, expect %v, got %v", e, a)
+	}
+
+	weaveURL, _ := url.Parse(networkPlugins["weave"].url(params))
+	if e, a := "10.32.0.0/16", weaveURL.Query().Get("env.IPALLOC_RANGE"); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//ConfigVersion is the version of the config file format
+const ConfigVersion = "k8sinit/v1"
+
+//EnvPrefix is the prefix of the environment variables that set flags
+const EnvPrefix = "K8SINIT_"
+
+//Config is the declarative k8sinit configuration file
+type Config struct {
+	Version      string                 `yaml:"version"`
+	Flags        map[string]interface{} `yaml:"flags"`
+	Kubeconfig   string                 `yaml:"kubeconfig"`
+	PKI          map[string]string      `yaml:"pki"`
+	ClusterFiles map[string]string      `yaml:"clusterFiles"`
+	ExtraFiles   map[string]string      `yaml:"extraFiles"`
+}
+
+//DefaultConfig returns the configuration used without a config file
+func DefaultConfig() *Config {
+	return &Config{
+		Version:    ConfigVersion,
+		Flags:      map[string]interface{}{},
+		Kubeconfig: "/etc/kubernetes/admin.conf",
+		PKI: map[string]string{
+			"admin.conf":         "/etc/kubernetes/admin.conf",
+			"ca.crt":             "/etc/kubernetes/pki/ca.crt",
+			"ca.key":             "/etc/kubernetes/pki/ca.key",
+			"etcd-ca.crt":        "/etc/kubernetes/pki/etcd/ca.crt",
+			"etcd-ca.key":        "/etc/kubernetes/pki/etcd/ca.key",
+			"front-proxy-ca.crt": "/etc/kubernetes/pki/front-proxy-ca.crt",
+			"front-proxy-ca.key": "/etc/kubernetes/pki/front-proxy-ca.key",
+			"sa.key":             "/etc/kubernetes/pki/sa.key",
+			"sa.pub":             "/etc/kubernetes/pki/sa.pub",
+		},
+		ClusterFiles: map[string]string{
+			"cluster-info.yaml":     "/tmp/cluster-info.yaml",
+			"kubeadm-cfg-init.yaml": "/tmp/cluster-cfg.yaml",
+			"kubeadm-cfg-join.yaml": "/tmp/cluster-join.yaml",
+		},
+		ExtraFiles: map[string]string{},
+	}
+}
+
+//LoadConfig reads a config file on top of the defaults. Unknown fields are
+//reported as errors.
+func LoadConfig(path string) (*Config, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := Config{}
+	if err := yaml.UnmarshalStrict(dat, &file); err != nil {
+		return nil, fmt.Errorf("config file %s: %s", path, err.Error())
+	}
+	if file.Version != ConfigVersion {
+		return nil, fmt.Errorf("config file %s: version must be %q, got %q", path, ConfigVersion, file.Version)
+	}
+
+	cfg := DefaultConfig()
+	for k, v := range file.Flags {
+		cfg.Flags[k] = v
+	}
+	if file.Kubeconfig != "" {
+		cfg.Kubeconfig = file.Kubeconfig
+	}
+	for k, v := range file.PKI {
+		cfg.PKI[k] = v
+	}
+	for k, v := range file.ClusterFiles {
+		cfg.ClusterFiles[k] = v
+	}
+	for k, v := range file.ExtraFiles {
+		cfg.ExtraFiles[k] = v
+	}
+	return cfg, nil
+}
+
+//Validate checks the paths of the config and that all flags are known
+func (c *Config) Validate(knownFlag func(name string) bool) error {
+	problems := []string{}
+	for name, v := range c.Flags {
+		if !knownFlag(name) {
+			problems = append(problems, "unknown flag "+name)
+		}
+		switch v.(type) {
+		case string, int, bool, float64:
+		default:
+			problems = append(problems, "flag "+name+" must be a scalar value")
+		}
+	}
+	if !filepath.IsAbs(c.Kubeconfig) {
+		problems = append(problems, "kubeconfig must be an absolute path")
+	}
+	for _, section := range []struct {
+		name  string
+		files map[string]string
+	}{
+		{"pki", c.PKI},
+		{"clusterFiles", c.ClusterFiles},
+		{"extraFiles", c.ExtraFiles},
+	} {
+		for k, v := range section.files {
+			if !filepath.IsAbs(v) {
+				problems = append(problems, section.name+"."+k+" must be an absolute path")
+			}
+		}
+	}
+	for _, k := range []string{"cluster-info.yaml", "kubeadm-cfg-init.yaml", "kubeadm-cfg-join.yaml"} {
+		if _, ok := c.ClusterFiles[k]; !ok {
+			problems = append(problems, "clusterFiles."+k+" is missing")
+		}
+	}
+	for k := range c.ExtraFiles {
+		if _, ok := c.PKI[k]; ok {
+			problems = append(problems, "extraFiles."+k+" is already part of pki")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("invalid config: " + strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+//FlagValue returns the value for a flag from the environment or the config
+//file, the environment takes precedence
+func (c *Config) FlagValue(name string, getenv func(string) string) (string, bool) {
+	if v := getenv(FlagEnvName(name)); v != "" {
+		return v, true
+	}
+	if v, ok := c.Flags[name]; ok {
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+//SyncedFiles returns the pki and the extra files that are kept in the secret store
+func (c *Config) SyncedFiles() map[string]string {
+	files := map[string]string{}
+	for k, v := range c.PKI {
+		files[k] = v
+	}
+	for k, v := range c.ExtraFiles {
+		files[k] = v
+	}
+	return files
+}
+
+//FlagEnvName returns the environment variable for a flag, K8SINIT_CLUSTER_NAME for cluster-name
+func FlagEnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `version: k8sinit/v1
+flags:
+  name: api.example.com
+  port: 8443
+  cluster-name: prod
+kubeconfig: /etc/k8sinit/admin.conf
+pki:
+  ca.crt: /srv/pki/ca.crt
+clusterFiles:
+  kubeadm-cfg-init.yaml: /var/lib/k8sinit/kubeadm-init.yaml
+extraFiles:
+  audit-policy.yaml: /etc/kubernetes/audit-policy.yaml
+`
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "k8sinit.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func knownTestFlag(name string) bool {
+	return name == "name" || name == "port" || name == "cluster-name"
+}
+
+func TestLoadConfig(t *testing.T) {
+	path, cleanup := writeConfig(t, testConfig)
+	defer cleanup()
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if err := cfg.Validate(knownTestFlag); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if e, a := "/srv/pki/ca.crt", cfg.PKI["ca.crt"]; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "/etc/kubernetes/pki/ca.key", cfg.PKI["ca.key"]; e != a {
+		t.Errorf("expect defaults to be kept, expect %v, got %v", e, a)
+	}
+	if e, a := "/var/lib/k8sinit/kubeadm-init.yaml", cfg.ClusterFiles["kubeadm-cfg-init.yaml"]; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if _, ok := cfg.SyncedFiles()["audit-policy.yaml"]; !ok {
+		t.Errorf("expect extra files to be synced")
+	}
+
+	env := map[string]string{"K8SINIT_CLUSTER_NAME": "staging"}
+	getenv := func(k string) string { return env[k] }
+	if v, ok := cfg.FlagValue("port", getenv); !ok || v != "8443" {
+		t.Errorf("expect 8443 from the config file, got %v %v", v, ok)
+	}
+	if v, ok := cfg.FlagValue("cluster-name", getenv); !ok || v != "staging" {
+		t.Errorf("expect staging from the environment, got %v %v", v, ok)
+	}
+	if _, ok := cfg.FlagValue("bucket", getenv); ok {
+		t.Errorf("expect bucket not to be set")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		content string
+		message string
+	}{
+		{"version: k8sinit/v1\nflag:\n  name: api\n", "field flag not found"},
+		{"version: k8sinit/v2\n", "version must be"},
+		{"flags:\n  name: api\n", "version must be"},
+	}
+	for _, c := range cases {
+		path, cleanup := writeConfig(t, c.content)
+		_, err := LoadConfig(path)
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("expect error containing %q, got %v", c.message, err)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Flags["bucket"] = "my-bucket"
+	cfg.PKI["ca.crt"] = "pki/ca.crt"
+	delete(cfg.ClusterFiles, "cluster-info.yaml")
+	err := cfg.Validate(knownTestFlag)
+	if err == nil {
+		t.Fatalf("expect error")
+	}
+	for _, message := range []string{"unknown flag bucket", "pki.ca.crt must be an absolute path", "clusterFiles.cluster-info.yaml is missing"} {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("expect error containing %q, got %v", message, err)
+		}
+	}
+}
+
+func TestFlagEnvName(t *testing.T) {
+	if e, a := "K8SINIT_CLUSTER_NAME", FlagEnvName("cluster-name"); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
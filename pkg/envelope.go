@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+//Metadata keys that mark an object as envelope encrypted
+const (
+	EncryptionMetadataKey  = "K8sinit-Encryption"
+	KeyProviderMetadataKey = "K8sinit-Key-Provider"
+	WrappedKeyMetadataKey  = "K8sinit-Wrapped-Key"
+	envelopeAlgorithm      = "envelope-aes256-gcm"
+	dataKeySize            = 32
+)
+
+//ErrPlaintext is returned when an object isn't encrypted although a key
+//provider is configured
+var ErrPlaintext = errors.New("object is stored unencrypted, but a key provider is configured")
+
+//KeyProvider wraps and unwraps the data keys used for envelope encryption,
+//name is the object the data key encrypts
+type KeyProvider interface {
+	Name() string
+	WrapKey(name string, dataKey []byte) ([]byte, error)
+	UnwrapKey(name string, wrapped []byte) ([]byte, error)
+}
+
+//plaintextMigration is a KeyProvider that also opens plaintext objects
+type plaintextMigration struct {
+	KeyProvider
+}
+
+//AllowPlaintext lets Open return plaintext objects although kp is set. It is
+//only meant to migrate a store to envelope encryption, the objects written
+//meanwhile are encrypted.
+func AllowPlaintext(kp KeyProvider) KeyProvider {
+	return plaintextMigration{KeyProvider: kp}
+}
+
+//Seal encrypts plaintext with a fresh data key and wraps the data key with
+//the key provider. The name of the object is authenticated with the
+//ciphertext, the object can't be opened under another name. The returned
+//metadata has to be stored with the object.
+func Seal(kp KeyProvider, name string, plaintext []byte) ([]byte, map[string]*string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := gcmSeal(dataKey, plaintext, []byte(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := kp.WrapKey(name, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata := map[string]*string{
+		EncryptionMetadataKey:  aws.String(envelopeAlgorithm),
+		KeyProviderMetadataKey: aws.String(kp.Name()),
+		WrappedKeyMetadataKey:  aws.String(base64.StdEncoding.EncodeToString(wrapped)),
+	}
+	return ciphertext, metadata, nil
+}
+
+//Open decrypts an object written by Seal under the same name. Objects
+//without the encryption metadata are legacy plaintext objects, they are
+//refused with ErrPlaintext if kp is set, unless AllowPlaintext migrates them.
+func Open(kp KeyProvider, name string, body []byte, metadata map[string]*string) ([]byte, error) {
+	algorithm := metadataValue(metadata, EncryptionMetadataKey)
+	if algorithm == "" {
+		if _, migrate := kp.(plaintextMigration); kp != nil && !migrate {
+			return nil, ErrPlaintext
+		}
+		return body, nil
+	}
+	if algorithm != envelopeAlgorithm {
+		return nil, errors.New("unsupported encryption " + algorithm)
+	}
+	if kp == nil {
+		return nil, errors.New("object is encrypted but no key provider is configured")
+	}
+	if name := metadataValue(metadata, KeyProviderMetadataKey); name != kp.Name() {
+		return nil, errors.New("object is encrypted with key provider " + name + " not " + kp.Name())
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadataValue(metadata, WrappedKeyMetadataKey))
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := kp.UnwrapKey(name, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dataKey, body, []byte(name))
+}
+
+//IsEncrypted reports if the metadata marks an object as envelope encrypted
+func IsEncrypted(metadata map[string]*string) bool {
+	return metadataValue(metadata, EncryptionMetadataKey) != ""
+}
+
+//KeyFileProvider wraps data keys with a local AES-256 key file
+type KeyFileProvider struct {
+	key []byte
+}
+
+//NewKeyFileProvider reads a base64 encoded 32 byte key from path
+func NewKeyFileProvider(path string) (*KeyFileProvider, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(dat)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != dataKeySize {
+		return nil, errors.New("key file must contain a base64 encoded 32 byte key")
+	}
+	return &KeyFileProvider{key: key}, nil
+}
+
+//Name returns the name stored with objects wrapped by this provider
+func (p *KeyFileProvider) Name() string {
+	return "keyfile"
+}
+
+//WrapKey encrypts the data key with the key file, the name is already
+//authenticated with the ciphertext of the object
+func (p *KeyFileProvider) WrapKey(name string, dataKey []byte) ([]byte, error) {
+	return gcmSeal(p.key, dataKey, nil)
+}
+
+//UnwrapKey decrypts a data key wrapped with the key file
+func (p *KeyFileProvider) UnwrapKey(name string, wrapped []byte) ([]byte, error) {
+	return gcmOpen(p.key, wrapped, nil)
+}
+
+//KMSProvider wraps data keys with an AWS KMS key. The encryption context
+//names the cluster and the object, so a wrapped key only unwraps for the
+//object it was made for and shows up in CloudTrail with both.
+type KMSProvider struct {
+	svc     kmsiface.KMSAPI
+	keyID   string
+	cluster string
+}
+
+//NewKMSProvider creates a key provider for the KMS key id, arn or alias of
+//the cluster
+func NewKMSProvider(svc kmsiface.KMSAPI, keyID string, cluster string) *KMSProvider {
+	return &KMSProvider{svc: svc, keyID: keyID, cluster: cluster}
+}
+
+//Name returns the name stored with objects wrapped by this provider
+func (p *KMSProvider) Name() string {
+	return "kms"
+}
+
+//WrapKey encrypts the data key with KMS
+func (p *KMSProvider) WrapKey(name string, dataKey []byte) ([]byte, error) {
+	out, err := p.svc.Encrypt(
+		&kms.EncryptInput{
+			KeyId:             aws.String(p.keyID),
+			Plaintext:         dataKey,
+			EncryptionContext: p.encryptionContext(name),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+//UnwrapKey decrypts a data key wrapped by KMS
+func (p *KMSProvider) UnwrapKey(name string, wrapped []byte) ([]byte, error) {
+	out, err := p.svc.Decrypt(
+		&kms.DecryptInput{
+			CiphertextBlob:    wrapped,
+			EncryptionContext: p.encryptionContext(name),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+//encryptionContext binds a wrapped key to the object and the cluster, the
+//cluster is left out if the store isn't namespaced by one
+func (p *KMSProvider) encryptionContext(name string) map[string]*string {
+	context := map[string]*string{
+		"k8sinit": aws.String(envelopeAlgorithm),
+		"object":  aws.String(name),
+	}
+	if p.cluster != "" {
+		context["cluster"] = aws.String(p.cluster)
+	}
+	return context
+}
+
+//gcmSeal encrypts plaintext and authenticates it together with the
+//additional data, the random nonce is prepended to the ciphertext
+func gcmSeal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+//gcmOpen decrypts a ciphertext of gcmSeal, it fails if the additional data
+//differs from the sealed one
+func gcmOpen(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func metadataValue(metadata map[string]*string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,298 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//EtcdClientCertTTL is how long the client certificates issued by
+//EtcdClientTLS are valid
+const EtcdClientCertTTL = time.Hour
+
+//etcdRequestTimeout limits the requests of the member api, snapshots are
+//only limited by their context
+const etcdRequestTimeout = time.Second * 30
+
+//etcdAPIPrefixes are the paths of the grpc gateway, etcd 3.3 only serves
+//v3beta, etcd 3.4 both and etcd 3.5 only v3
+var etcdAPIPrefixes = []string{"/v3", "/v3beta"}
+
+//EtcdMember is a member of the etcd cluster
+type EtcdMember struct {
+	ID         uint64   `json:"ID,string"`
+	Name       string   `json:"name"`
+	PeerURLs   []string `json:"peerURLs"`
+	ClientURLs []string `json:"clientURLs"`
+	IsLearner  bool     `json:"isLearner,omitempty"`
+}
+
+//EtcdStatus is the status a member reports about itself
+type EtcdStatus struct {
+	Header struct {
+		MemberID uint64 `json:"member_id,string"`
+	} `json:"header"`
+	Version   string   `json:"version"`
+	Leader    uint64   `json:"leader,string"`
+	RaftIndex uint64   `json:"raftIndex,string"`
+	Errors    []string `json:"errors"`
+	IsLearner bool     `json:"isLearner"`
+}
+
+//EtcdClient talks to the grpc gateway of an etcd member
+type EtcdClient struct {
+	endpoint string
+	client   *http.Client
+	prefix   string
+}
+
+//NewEtcdClient creates a client for the member at endpoint, e.g.
+//https://127.0.0.1:2379. Without tlsConfig plain http is used.
+func NewEtcdClient(endpoint string, tlsConfig *tls.Config) *EtcdClient {
+	client := &http.Client{}
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return &EtcdClient{endpoint: strings.TrimSuffix(endpoint, "/"), client: client}
+}
+
+//WithEndpoint returns a client for the member at endpoint with the same
+//credentials
+func (c *EtcdClient) WithEndpoint(endpoint string) *EtcdClient {
+	return &EtcdClient{endpoint: strings.TrimSuffix(endpoint, "/"), client: c.client}
+}
+
+//EtcdClientTLS issues a short lived client certificate with the PEM encoded
+//etcd CA and returns a TLS config that uses it and trusts the CA
+func EtcdClientTLS(caCert []byte, caKey []byte) (*tls.Config, error) {
+	ca, err := tls.X509KeyPair(caCert, caKey)
+	if err != nil {
+		return nil, errors.New("invalid etcd ca: " + err.Error())
+	}
+	caX509, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "k8sinit", Organization: []string{"system:masters"}},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(EtcdClientCertTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caX509, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, errors.New("could not issue the etcd client certificate: " + err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caX509)
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: roots}, nil
+}
+
+//MemberList returns the members of the cluster
+func (c *EtcdClient) MemberList(ctx context.Context) ([]EtcdMember, error) {
+	out := struct {
+		Members []EtcdMember `json:"members"`
+	}{}
+	if err := c.call(ctx, "/cluster/member/list", struct{}{}, &out); err != nil {
+		return nil, errors.New("could not list the etcd members: " + err.Error())
+	}
+	return out.Members, nil
+}
+
+//MemberRemove removes the member with id from the cluster
+func (c *EtcdClient) MemberRemove(ctx context.Context, id uint64) error {
+	in := struct {
+		ID uint64 `json:"ID,string"`
+	}{ID: id}
+	if err := c.call(ctx, "/cluster/member/remove", in, &struct{}{}); err != nil {
+		return errors.New("could not remove etcd member " + strconv.FormatUint(id, 16) + ": " + err.Error())
+	}
+	return nil
+}
+
+//MemberAddLearner adds a learner with peerURLs to the cluster, it doesn't
+//vote till it is promoted. Learners need etcd 3.4, see EtcdSupportsLearners.
+func (c *EtcdClient) MemberAddLearner(ctx context.Context, peerURLs []string) (*EtcdMember, error) {
+	in := struct {
+		PeerURLs  []string `json:"peerURLs"`
+		IsLearner bool     `json:"isLearner"`
+	}{PeerURLs: peerURLs, IsLearner: true}
+	out := struct {
+		Member *EtcdMember `json:"member"`
+	}{}
+	if err := c.call(ctx, "/cluster/member/add", in, &out); err != nil {
+		return nil, errors.New("could not add the etcd learner " + strings.Join(peerURLs, ",") + ": " + err.Error())
+	}
+	if out.Member == nil {
+		return nil, errors.New("etcd didn't return the added learner")
+	}
+	return out.Member, nil
+}
+
+//MemberPromote makes the learner with id a voting member. etcd refuses it
+//till the learner caught up with the leader. Like learners it needs etcd 3.4.
+func (c *EtcdClient) MemberPromote(ctx context.Context, id uint64) error {
+	in := struct {
+		ID uint64 `json:"ID,string"`
+	}{ID: id}
+	if err := c.call(ctx, "/cluster/member/promote", in, &struct{}{}); err != nil {
+		return errors.New("could not promote etcd member " + strconv.FormatUint(id, 16) + ": " + err.Error())
+	}
+	return nil
+}
+
+//EtcdSupportsLearners tells if the etcd version a member reports knows
+//learners, they were added in etcd 3.4
+func EtcdSupportsLearners(version string) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return major > 3 || major == 3 && minor >= 4
+}
+
+//Status returns the status of the member the client talks to
+func (c *EtcdClient) Status(ctx context.Context) (*EtcdStatus, error) {
+	status := &EtcdStatus{}
+	if err := c.call(ctx, "/maintenance/status", struct{}{}, status); err != nil {
+		return nil, errors.New("could not get the etcd status of " + c.endpoint + ": " + err.Error())
+	}
+	return status, nil
+}
+
+//Snapshot streams a snapshot of the backend database of the member to w
+func (c *EtcdClient) Snapshot(ctx context.Context, w io.Writer) error {
+	resp, err := c.post(ctx, "/maintenance/snapshot", struct{}{})
+	if err != nil {
+		return errors.New("could not take an etcd snapshot: " + err.Error())
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		chunk := struct {
+			Result *struct {
+				Blob []byte `json:"blob"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		if err := dec.Decode(&chunk); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.New("could not read the etcd snapshot: " + err.Error())
+		}
+		if chunk.Error != nil {
+			return errors.New("etcd snapshot failed: " + chunk.Error.Message)
+		}
+		if chunk.Result != nil {
+			if _, err := w.Write(chunk.Result.Blob); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//call posts in to the gateway and decodes the answer to out
+func (c *EtcdClient) call(ctx context.Context, path string, in interface{}, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, etcdRequestTimeout)
+	defer cancel()
+	resp, err := c.post(ctx, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+//post sends in to the gateway and returns the response if it succeeded. The
+//api prefix the member serves is detected on the first request.
+func (c *EtcdClient) post(ctx context.Context, path string, in interface{}) (*http.Response, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := etcdAPIPrefixes
+	if c.prefix != "" {
+		prefixes = []string{c.prefix}
+	}
+	for _, prefix := range prefixes {
+		req, err := http.NewRequest(http.MethodPost, c.endpoint+prefix+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			c.prefix = prefix
+			return resp, nil
+		}
+		dat, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound && c.prefix == "" {
+			continue
+		}
+		gwErr := struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(dat, &gwErr) == nil && gwErr.Message != "" {
+			return nil, errors.New(gwErr.Message)
+		} else if gwErr.Error != "" {
+			return nil, errors.New(gwErr.Error)
+		}
+		return nil, errors.New(resp.Status + ": " + string(dat))
+	}
+	return nil, errors.New("etcd at " + c.endpoint + " serves no known grpc gateway")
+}
@@ -0,0 +1,200 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeEtcd serves the member api of the etcd 3.4 grpc gateway under v3beta
+//only, so the client has to fall back to it. etcd 3.3 serves v3beta as well
+//but doesn't know learners. Status paths with a member name in front get the
+//status of that member.
+type fakeEtcd struct {
+	mu       sync.Mutex
+	members  []EtcdMember
+	statuses map[string]EtcdStatus
+	paths    []string
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.URL.Path)
+	name, path := "", r.URL.Path
+	if strings.HasSuffix(path, "/maintenance/status") {
+		parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+		name, path = parts[0], "/"+parts[len(parts)-1]
+	}
+	switch path {
+	case "/v3beta/maintenance/status":
+		status, ok := f.statuses[name]
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"etcdserver: request timed out","code":14}`))
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	case "/v3beta/cluster/member/add":
+		in := struct {
+			PeerURLs  []string `json:"peerURLs"`
+			IsLearner bool     `json:"isLearner"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&in)
+		m := EtcdMember{ID: uint64(len(f.members) + 1), PeerURLs: in.PeerURLs, IsLearner: in.IsLearner}
+		f.members = append(f.members, m)
+		json.NewEncoder(w).Encode(map[string]interface{}{"member": m, "members": f.members})
+	case "/v3beta/cluster/member/promote":
+		in := struct {
+			ID uint64 `json:"ID,string"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&in)
+		for i := range f.members {
+			if f.members[i].ID == in.ID {
+				f.members[i].IsLearner = false
+			}
+		}
+		w.Write([]byte("{}"))
+	case "/v3beta/cluster/member/list":
+		json.NewEncoder(w).Encode(map[string]interface{}{"members": f.members})
+	case "/v3beta/cluster/member/remove":
+		in := struct {
+			ID uint64 `json:"ID,string"`
+		}{}
+		dat, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(dat, &in)
+		for i, m := range f.members {
+			if m.ID == in.ID {
+				f.members = append(f.members[:i], f.members[i+1:]...)
+				w.Write([]byte("{}"))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"etcdserver: member not found","code":5}`))
+	case "/v3beta/maintenance/snapshot":
+		for _, blob := range []string{"etcd ", "snapshot"} {
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"blob": []byte(blob)}})
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestEtcdClient(t *testing.T) {
+	fake := &fakeEtcd{members: []EtcdMember{
+		{ID: 0x8e9e05c52164694d, Name: "ip-10-0-1-10", PeerURLs: []string{"https://10.0.1.10:2380"}},
+		{ID: 0x91bc3c398fb3c146, Name: "ip-10-0-2-10", PeerURLs: []string{"https://10.0.2.10:2380"}},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := NewEtcdClient(srv.URL, nil)
+
+	members, err := client.MemberList(context.Background())
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := fake.members, members; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if err := client.MemberRemove(context.Background(), 0x8e9e05c52164694d); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := 1, len(fake.members); e != a {
+		t.Errorf("expect %v member, got %v", e, a)
+	}
+	err = client.MemberRemove(context.Background(), 0x8e9e05c52164694d)
+	if err == nil || !strings.Contains(err.Error(), "member not found") {
+		t.Errorf("expect the gateway error, got %v", err)
+	}
+	var snapshot bytes.Buffer
+	if err := client.Snapshot(context.Background(), &snapshot); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "etcd snapshot", snapshot.String(); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	expected := []string{
+		"/v3/cluster/member/list",
+		"/v3beta/cluster/member/list",
+		"/v3beta/cluster/member/remove",
+		"/v3beta/cluster/member/remove",
+		"/v3beta/maintenance/snapshot",
+	}
+	if e, a := expected, fake.paths; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect the api prefix to be detected once, expect %v, got %v", e, a)
+	}
+
+	if _, err := NewEtcdClient(srv.URL+"/missing", nil).MemberList(context.Background()); err == nil {
+		t.Errorf("expect error without a grpc gateway")
+	}
+}
+
+func TestEtcdSupportsLearners(t *testing.T) {
+	cases := []struct {
+		version  string
+		expected bool
+	}{
+		{"3.3.15", false},
+		{"3.4.0", true},
+		{"3.5.9", true},
+		{"4.0.0", true},
+		{"2.3.8", false},
+		{"", false},
+		{"unknown", false},
+	}
+	for _, c := range cases {
+		if e, a := c.expected, EtcdSupportsLearners(c.version); e != a {
+			t.Errorf("%v: expect %v, got %v", c.version, e, a)
+		}
+	}
+}
+
+func TestEtcdClientTLS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "etcd-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	caKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	cfg, err := EtcdClientTLS(caCert, caKey)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: cfg.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Errorf("expect a client certificate signed by the etcd ca, got %v", err)
+	}
+
+	if _, err := EtcdClientTLS(caCert, []byte("broken")); err == nil {
+		t.Errorf("expect error for an invalid ca key")
+	}
+}
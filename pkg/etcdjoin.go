@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//EtcdJoinCheck describes the member that wants to join the cluster
+type EtcdJoinCheck struct {
+	//PeerURL of the joining member, a learner with it was left by an
+	//interrupted join and isn't checked
+	PeerURL string
+	//Target is the number of members the cluster grows to, an even member
+	//count on the way to it is accepted
+	Target int
+	//AllowEven accepts that the join leaves an even number of members
+	AllowEven bool
+}
+
+//HasPeerURL tells if the member listens on peerURL
+func (m EtcdMember) HasPeerURL(peerURL string) bool {
+	for _, u := range m.PeerURLs {
+		if u == peerURL {
+			return true
+		}
+	}
+	return false
+}
+
+func (m EtcdMember) label() string {
+	return m.Name + " " + strconv.FormatUint(m.ID, 16)
+}
+
+//memberHealth gets the status of the member and fails unless it is healthy
+//and has a leader
+func (c *EtcdClient) memberHealth(ctx context.Context, m EtcdMember) (*EtcdStatus, error) {
+	if len(m.ClientURLs) == 0 {
+		return nil, errors.New("etcd member " + m.label() + " hasn't started")
+	}
+	status, err := c.WithEndpoint(m.ClientURLs[0]).Status(ctx)
+	if err != nil {
+		return nil, errors.New("etcd member " + m.label() + " is unhealthy: " + err.Error())
+	}
+	if len(status.Errors) > 0 {
+		return nil, errors.New("etcd member " + m.label() + " is unhealthy: " + strings.Join(status.Errors, ", "))
+	}
+	if status.Leader == 0 {
+		return nil, errors.New("etcd member " + m.label() + " has no leader")
+	}
+	return status, nil
+}
+
+//CheckEtcdJoin confirms a member can join: every voting member is healthy
+//and follows the same leader, no other learner is catching up and the
+//cluster doesn't end with an even number of members. It returns the members.
+func CheckEtcdJoin(ctx context.Context, client *EtcdClient, check EtcdJoinCheck) ([]EtcdMember, error) {
+	members, err := client.MemberList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	voters := 0
+	var leader uint64
+	for _, m := range members {
+		if check.PeerURL != "" && m.HasPeerURL(check.PeerURL) {
+			continue
+		}
+		if m.IsLearner {
+			return nil, errors.New("etcd member " + m.label() + " is a learner, another member is still joining")
+		}
+		status, err := client.memberHealth(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		if leader != 0 && status.Leader != leader {
+			return nil, errors.New("etcd members disagree on the leader")
+		}
+		leader = status.Leader
+		voters++
+	}
+	if voters == 0 {
+		return nil, errors.New("etcd has no voting members")
+	}
+	leaderIsMember := false
+	for _, m := range members {
+		leaderIsMember = leaderIsMember || m.ID == leader
+	}
+	if !leaderIsMember {
+		return nil, errors.New("the etcd leader " + strconv.FormatUint(leader, 16) + " isn't a member")
+	}
+	if size := voters + 1; size%2 == 0 && size >= check.Target && !check.AllowEven {
+		return nil, &EvenMembersError{Members: size}
+	}
+	return members, nil
+}
+
+//EvenMembersError tells that a join would leave an even number of members,
+//which tolerate as many failures as one member less
+type EvenMembersError struct {
+	Members int
+}
+
+func (e *EvenMembersError) Error() string {
+	return "joining would leave " + strconv.Itoa(e.Members) + " etcd members, which tolerate no more failures than " + strconv.Itoa(e.Members-1)
+}
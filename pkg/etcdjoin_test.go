@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckEtcdJoin(t *testing.T) {
+	healthy := EtcdStatus{Leader: 1}
+	cases := []struct {
+		name     string
+		members  []string
+		learners int
+		statuses map[string]EtcdStatus
+		check    EtcdJoinCheck
+		fails    bool
+		even     bool
+	}{
+		{
+			name:     "healthy cluster",
+			members:  []string{"a", "b"},
+			statuses: map[string]EtcdStatus{"a": healthy, "b": healthy},
+			check:    EtcdJoinCheck{Target: 3},
+		},
+		{
+			name:     "second member on the way to three",
+			members:  []string{"a"},
+			statuses: map[string]EtcdStatus{"a": healthy},
+			check:    EtcdJoinCheck{Target: 3},
+		},
+		{
+			name:     "even member count",
+			members:  []string{"a", "b", "c"},
+			statuses: map[string]EtcdStatus{"a": healthy, "b": healthy, "c": healthy},
+			check:    EtcdJoinCheck{Target: 3},
+			fails:    true,
+			even:     true,
+		},
+		{
+			name:     "even member count with an override",
+			members:  []string{"a", "b", "c"},
+			statuses: map[string]EtcdStatus{"a": healthy, "b": healthy, "c": healthy},
+			check:    EtcdJoinCheck{Target: 3, AllowEven: true},
+		},
+		{
+			name:     "unreachable member",
+			members:  []string{"a", "b"},
+			statuses: map[string]EtcdStatus{"a": healthy},
+			check:    EtcdJoinCheck{Target: 3},
+			fails:    true,
+		},
+		{
+			name:     "member with an alarm",
+			members:  []string{"a", "b"},
+			statuses: map[string]EtcdStatus{"a": healthy, "b": {Leader: 1, Errors: []string{"NOSPACE"}}},
+			check:    EtcdJoinCheck{Target: 3},
+			fails:    true,
+		},
+		{
+			name:     "no leader",
+			members:  []string{"a", "b"},
+			statuses: map[string]EtcdStatus{"a": {}, "b": {}},
+			check:    EtcdJoinCheck{Target: 3},
+			fails:    true,
+		},
+		{
+			name:     "split leadership",
+			members:  []string{"a", "b"},
+			statuses: map[string]EtcdStatus{"a": healthy, "b": {Leader: 2}},
+			check:    EtcdJoinCheck{Target: 3},
+			fails:    true,
+		},
+		{
+			name:     "another learner",
+			members:  []string{"a", "b"},
+			learners: 1,
+			statuses: map[string]EtcdStatus{"a": healthy, "b": healthy},
+			check:    EtcdJoinCheck{Target: 3},
+			fails:    true,
+		},
+		{
+			name:     "own learner of an interrupted join",
+			members:  []string{"a", "b"},
+			learners: 1,
+			statuses: map[string]EtcdStatus{"a": healthy, "b": healthy},
+			check:    EtcdJoinCheck{PeerURL: "https://10.0.3.10:2380", Target: 3},
+		},
+	}
+	for _, tc := range cases {
+		fake := &fakeEtcd{statuses: tc.statuses}
+		srv := httptest.NewServer(fake)
+		for i, name := range tc.members {
+			fake.members = append(fake.members, EtcdMember{ID: uint64(i + 1), Name: name, ClientURLs: []string{srv.URL + "/" + name}})
+		}
+		for i := 0; i < tc.learners; i++ {
+			fake.members = append(fake.members, EtcdMember{ID: 10, PeerURLs: []string{"https://10.0.3.10:2380"}, IsLearner: true})
+		}
+		members, err := CheckEtcdJoin(context.Background(), NewEtcdClient(srv.URL, nil), tc.check)
+		if tc.fails && err == nil {
+			t.Errorf("%s: expect error", tc.name)
+		} else if !tc.fails && err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		} else if !tc.fails && len(members) != len(tc.members)+tc.learners {
+			t.Errorf("%s: expect %v members, got %v", tc.name, len(tc.members)+tc.learners, members)
+		}
+		if _, even := err.(*EvenMembersError); even != tc.even {
+			t.Errorf("%s: expect an even member error %v, got %v", tc.name, tc.even, err)
+		}
+		srv.Close()
+	}
+}
+
+func TestEtcdLearner(t *testing.T) {
+	fake := &fakeEtcd{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := NewEtcdClient(srv.URL, nil)
+
+	learner, err := client.MemberAddLearner(context.Background(), []string{"https://10.0.3.10:2380"})
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if !learner.IsLearner || !learner.HasPeerURL("https://10.0.3.10:2380") {
+		t.Errorf("expect a learner with the peer url, got %v", learner)
+	}
+	if err := client.MemberPromote(context.Background(), learner.ID); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if fake.members[0].IsLearner {
+		t.Errorf("expect the learner to be promoted")
+	}
+}
@@ -0,0 +1,42 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+)
+
+//CheckEtcdLeave confirms the member named name can leave: enough of the
+//voting members that stay are healthy to keep a quorum without it. A member
+//that is already gone or the last member always pass, the last one is kept.
+func CheckEtcdLeave(ctx context.Context, client *EtcdClient, name string) error {
+	members, err := client.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	found := false
+	staying := []EtcdMember{}
+	for _, m := range members {
+		if m.Name == name {
+			found = true
+		} else if !m.IsLearner {
+			staying = append(staying, m)
+		}
+	}
+	if !found || len(staying) == 0 {
+		return nil
+	}
+	healthy := 0
+	for _, m := range staying {
+		if _, err := client.memberHealth(ctx, m); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		healthy++
+	}
+	if healthy < Quorum(len(staying)) {
+		return errors.New("only " + strconv.Itoa(healthy) + " of the " + strconv.Itoa(len(staying)) + " etcd members that stay are healthy, leaving would lose the quorum")
+	}
+	return nil
+}
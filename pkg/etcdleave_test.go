@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckEtcdLeave(t *testing.T) {
+	healthy := EtcdStatus{Leader: 1}
+	cases := []struct {
+		name     string
+		members  []string
+		statuses map[string]EtcdStatus
+		fails    bool
+	}{
+		{name: "healthy cluster", members: []string{"a", "b", "c"}, statuses: map[string]EtcdStatus{"b": healthy, "c": healthy}},
+		{name: "one of three unhealthy", members: []string{"a", "b", "c"}, statuses: map[string]EtcdStatus{"b": healthy}, fails: true},
+		{name: "one of five unhealthy", members: []string{"a", "b", "c", "d", "e"}, statuses: map[string]EtcdStatus{"b": healthy, "c": healthy, "d": healthy}},
+		{name: "member with an alarm", members: []string{"a", "b", "c"}, statuses: map[string]EtcdStatus{"b": healthy, "c": {Leader: 1, Errors: []string{"NOSPACE"}}}, fails: true},
+		{name: "already removed", members: []string{"b", "c"}},
+		{name: "last member", members: []string{"a"}},
+	}
+	for _, tc := range cases {
+		fake := &fakeEtcd{statuses: tc.statuses}
+		srv := httptest.NewServer(fake)
+		for i, name := range tc.members {
+			fake.members = append(fake.members, EtcdMember{ID: uint64(i + 1), Name: name, ClientURLs: []string{srv.URL + "/" + name}})
+		}
+		err := CheckEtcdLeave(context.Background(), NewEtcdClient(srv.URL, nil), "a")
+		if tc.fails && err == nil {
+			t.Errorf("%s: expect error", tc.name)
+		} else if !tc.fails && err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		srv.Close()
+	}
+}
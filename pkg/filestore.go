@@ -0,0 +1,323 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	fileStoreMetaDir = ".meta"
+	fileStoreLock    = ".lock"
+	//fileStoreLockTimeout limits the wait for the lock of the writers
+	fileStoreLockTimeout = time.Second * 10
+)
+
+//fileMetadata is kept next to a blob with the metadata of each content by its
+//hash. It is written before the blob, so the rename of the blob commits both,
+//and the metadata of the replaced content is kept till the blob was renamed.
+type fileMetadata struct {
+	Contents map[string]map[string]*string `json:"contents"`
+}
+
+//FileStore is a SecretStore that keeps blobs in a local directory, for tests
+//and bare metal hosts that share the directory
+type FileStore struct {
+	dir string
+}
+
+//NewFileStore creates a store rooted at dir
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (s *FileStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *FileStore) metaPath(name string) string {
+	return filepath.Join(s.dir, fileStoreMetaDir, filepath.FromSlash(name)+".json")
+}
+
+//Exists determines if the blob is in the directory
+func (s *FileStore) Exists(name string) (bool, error) {
+	_, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//Get reads a blob from the directory
+func (s *FileStore) Get(name string) ([]byte, error) {
+	dat, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return dat, err
+}
+
+//GetWithMetadata reads a blob and the metadata kept next to it
+func (s *FileStore) GetWithMetadata(name string) ([]byte, map[string]*string, error) {
+	dat, err := s.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := s.readMetadata(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dat, meta.Contents[contentHash(dat)], nil
+}
+
+//Put writes a blob to the directory
+func (s *FileStore) Put(name string, data []byte) error {
+	return s.PutWithMetadata(name, data, nil)
+}
+
+//PutWithMetadata writes a blob and keeps the metadata next to it
+func (s *FileStore) PutWithMetadata(name string, data []byte, metadata map[string]*string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.write(name, data, metadata)
+}
+
+//write stages the metadata of data next to the one of the current content,
+//renames the blob and drops the metadata of the replaced content. A crash
+//in between leaves the metadata of the blob that is in place.
+func (s *FileStore) write(name string, data []byte, metadata map[string]*string) error {
+	meta, err := s.readMetadata(name)
+	if err != nil {
+		return err
+	}
+	staged := fileMetadata{Contents: map[string]map[string]*string{}}
+	if current, err := ioutil.ReadFile(s.path(name)); err == nil {
+		hash := contentHash(current)
+		if m, ok := meta.Contents[hash]; ok {
+			staged.Contents[hash] = m
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	committed := fileMetadata{Contents: map[string]map[string]*string{}}
+	if len(metadata) > 0 {
+		staged.Contents[contentHash(data)] = metadata
+		committed.Contents[contentHash(data)] = metadata
+	}
+	if err := s.writeMetadata(name, staged); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(name), data); err != nil {
+		return err
+	}
+	return s.writeMetadata(name, committed)
+}
+
+func (s *FileStore) readMetadata(name string) (fileMetadata, error) {
+	meta := fileMetadata{}
+	raw, err := ioutil.ReadFile(s.metaPath(name))
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return meta, errors.New("invalid metadata of " + name + ": " + err.Error())
+	}
+	return meta, nil
+}
+
+func (s *FileStore) writeMetadata(name string, meta fileMetadata) error {
+	if len(meta.Contents) == 0 {
+		if err := os.Remove(s.metaPath(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.metaPath(name), raw)
+}
+
+//Delete removes a blob and its metadata from the directory
+func (s *FileStore) Delete(name string) error {
+	for _, p := range []string{s.path(name), s.metaPath(name)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//List lists the names of all blobs in the directory
+func (s *FileStore) List() ([]string, error) {
+	names := []string{}
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == fileStoreMetaDir || info.Name() == fileStoreLock {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	return names, err
+}
+
+//GetVersion reads a blob together with a hash of its content as version
+func (s *FileStore) GetVersion(name string) ([]byte, string, error) {
+	dat, _, version, err := s.GetVersionWithMetadata(name)
+	return dat, version, err
+}
+
+//GetVersionWithMetadata reads a blob and its metadata together with a hash
+//of both as version
+func (s *FileStore) GetVersionWithMetadata(name string) ([]byte, map[string]*string, string, error) {
+	dat, metadata, err := s.GetWithMetadata(name)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	version, err := contentVersion(dat, metadata)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return dat, metadata, version, nil
+}
+
+//PutIfVersion writes a blob if its content still has version, or if it does
+//not exist yet when version is empty. Writers are serialized with a flock on
+//a lock file so the check and the write are atomic between processes, the
+//lock of a crashed process is released by the kernel.
+func (s *FileStore) PutIfVersion(name string, data []byte, version string) (string, error) {
+	return s.PutIfVersionWithMetadata(name, data, nil, version)
+}
+
+//PutIfVersionWithMetadata writes a blob and its metadata like PutIfVersion
+func (s *FileStore) PutIfVersionWithMetadata(name string, data []byte, metadata map[string]*string, version string) (string, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	_, _, current, err := s.GetVersionWithMetadata(name)
+	if err == ErrNotFound {
+		if version != "" {
+			return "", ErrConditionFailed
+		}
+	} else if err != nil {
+		return "", err
+	} else if version != current {
+		return "", ErrConditionFailed
+	}
+	if err := s.write(name, data, metadata); err != nil {
+		return "", err
+	}
+	return contentVersion(data, metadata)
+}
+
+//lock takes an exclusive flock on the lock file of the store. A lock
+//directory of an older version is removed, it was never released if its
+//writer crashed.
+func (s *FileStore) lock() (func(), error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.dir, fileStoreLock)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(fileStoreLockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return func() {
+				syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+				f.Close()
+			}, nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, errors.New("could not lock " + path + ": " + err.Error())
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, errors.New("timed out waiting for " + path)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func contentHash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+//contentVersion hashes a blob and its metadata, a blob without metadata is
+//versioned by the hash of its content alone
+func contentVersion(data []byte, metadata map[string]*string) (string, error) {
+	h := sha256.New()
+	h.Write(data)
+	if len(metadata) > 0 {
+		raw, err := json.Marshal(metadata)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+		h.Write(raw)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,257 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+//DefaultIMDSEndpoint is the address of the instance metadata service
+const DefaultIMDSEndpoint = "http://169.254.169.254"
+
+//IMDSTokenTTL is how long the IMDSv2 session tokens are valid
+const IMDSTokenTTL = time.Hour * 6
+
+//imdsTokenTimeout limits the token request. With a hop limit of 1 the
+//answer never reaches a container, the request runs into the timeout.
+const imdsTokenTimeout = time.Second * 2
+
+//errMetadataNotFound is returned for metadata the instance doesn't have
+var errMetadataNotFound = errors.New("not found in the instance metadata")
+
+//InstanceIdentity describes the instance from its identity document
+type InstanceIdentity struct {
+	InstanceID       string `json:"instanceId"`
+	Region           string `json:"region"`
+	AvailabilityZone string `json:"availabilityZone"`
+	PrivateIP        string `json:"privateIp"`
+	InstanceType     string `json:"instanceType"`
+	AccountID        string `json:"accountId"`
+	MAC              string `json:"-"`
+	//Tags are only available if tags are enabled in the instance metadata
+	Tags map[string]string `json:"-"`
+}
+
+//IMDS reads the instance metadata service with IMDSv2 session tokens. If no
+//token can be had, e.g. on old instances or in containers behind a hop limit
+//of 1, it falls back to IMDSv1.
+type IMDS struct {
+	endpoint    string
+	client      *http.Client
+	tokenClient *http.Client
+	now         func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	//v1 is why IMDSv1 is used, empty as long as tokens are used
+	v1 string
+}
+
+//NewIMDS creates a client for the metadata service at endpoint, the default
+//one is used if endpoint is empty
+func NewIMDS(endpoint string) *IMDS {
+	if endpoint == "" {
+		endpoint = DefaultIMDSEndpoint
+	}
+	return &IMDS{
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		client:      &http.Client{Timeout: time.Second * 5},
+		tokenClient: &http.Client{Timeout: imdsTokenTimeout},
+		now:         time.Now,
+	}
+}
+
+//sessionToken returns a valid session token, a new one is requested a minute
+//before the last one expires. An empty token means IMDSv1 is used.
+func (m *IMDS) sessionToken(refresh bool) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.v1 != "" {
+		return "", nil
+	}
+	if !refresh && m.token != "" && m.now().Add(time.Minute).Before(m.expires) {
+		return m.token, nil
+	}
+	req, err := http.NewRequest(http.MethodPut, m.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(IMDSTokenTTL.Seconds())))
+	resp, err := m.tokenClient.Do(req)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		m.v1 = "the IMDSv2 token request timed out, the hop limit of the instance metadata may be too low"
+		return "", nil
+	} else if err != nil {
+		return "", errors.New("could not request an IMDSv2 token: " + err.Error())
+	}
+	defer resp.Body.Close()
+	dat, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		m.token = string(dat)
+		m.expires = m.now().Add(IMDSTokenTTL)
+		return m.token, nil
+	case http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed:
+		m.v1 = "the instance metadata doesn't support IMDSv2"
+		return "", nil
+	}
+	return "", errors.New("could not request an IMDSv2 token: " + resp.Status)
+}
+
+//get reads path below /latest. An expired token is replaced once.
+func (m *IMDS) get(path string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := m.sessionToken(attempt > 0)
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequest(http.MethodGet, m.endpoint+"/latest/"+path, nil)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		resp, err := m.client.Do(req)
+		if err != nil {
+			return "", errors.New("could not read " + path + " from the instance metadata: " + err.Error())
+		}
+		dat, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return string(dat), nil
+		case resp.StatusCode == http.StatusNotFound:
+			return "", errMetadataNotFound
+		case resp.StatusCode == http.StatusUnauthorized && token != "" && attempt == 0:
+			continue
+		case resp.StatusCode == http.StatusUnauthorized && token == "":
+			return "", errors.New("the instance metadata requires IMDSv2, but " + m.v1)
+		}
+		return "", errors.New("could not read " + path + " from the instance metadata: " + resp.Status)
+	}
+}
+
+//GetMetadata reads path below /latest/meta-data
+func (m *IMDS) GetMetadata(path string) (string, error) {
+	return m.get("meta-data/" + path)
+}
+
+//GetTags reads the tags of the instance, nil is returned if the tags aren't
+//enabled in the instance metadata
+func (m *IMDS) GetTags() (map[string]string, error) {
+	keys, err := m.GetMetadata("tags/instance")
+	if err == errMetadataNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, key := range strings.Fields(keys) {
+		value, err := m.GetMetadata("tags/instance/" + key)
+		if err != nil {
+			return nil, err
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+//GetIdentityDocument reads only the identity document, MAC and tags are
+//left empty
+func (m *IMDS) GetIdentityDocument() (*InstanceIdentity, error) {
+	doc, err := m.get("dynamic/instance-identity/document")
+	if err != nil {
+		return nil, err
+	}
+	identity := &InstanceIdentity{}
+	if err := json.Unmarshal([]byte(doc), identity); err != nil {
+		return nil, errors.New("invalid instance identity document: " + err.Error())
+	}
+	return identity, nil
+}
+
+//GetInstanceIdentity reads the identity document, the MAC and the tags of
+//the instance
+func (m *IMDS) GetInstanceIdentity() (*InstanceIdentity, error) {
+	identity, err := m.GetIdentityDocument()
+	if err != nil {
+		return nil, err
+	}
+	if identity.MAC, err = m.GetMetadata("mac"); err != nil {
+		return nil, err
+	}
+	if identity.Tags, err = m.GetTags(); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+//GetTargetLifecycleState returns the lifecycle state the autoscaling group
+//moves the instance to, e.g. InService or Terminated
+func (m *IMDS) GetTargetLifecycleState() (string, error) {
+	return m.GetMetadata("autoscaling/target-lifecycle-state")
+}
+
+//IMDSRoleProvider gets the credentials of the instance role with IMDSv2, the
+//provider of the sdk only knows IMDSv1
+type IMDSRoleProvider struct {
+	credentials.Expiry
+	imds *IMDS
+}
+
+//NewIMDSRoleProvider creates a provider that reads the credentials from imds
+func NewIMDSRoleProvider(imds *IMDS) *IMDSRoleProvider {
+	return &IMDSRoleProvider{imds: imds}
+}
+
+//Retrieve reads the credentials of the first role of the instance profile
+func (p *IMDSRoleProvider) Retrieve() (credentials.Value, error) {
+	roles, err := p.imds.GetMetadata("iam/security-credentials/")
+	if err != nil {
+		return credentials.Value{}, errors.New("could not get the instance role: " + err.Error())
+	}
+	fields := strings.Fields(roles)
+	if len(fields) == 0 {
+		return credentials.Value{}, errors.New("the instance has no role")
+	}
+	dat, err := p.imds.GetMetadata("iam/security-credentials/" + fields[0])
+	if err != nil {
+		return credentials.Value{}, errors.New("could not get the credentials of the instance role: " + err.Error())
+	}
+	creds := struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}{}
+	if err := json.Unmarshal([]byte(dat), &creds); err != nil {
+		return credentials.Value{}, errors.New("invalid instance role credentials: " + err.Error())
+	}
+	if creds.Code != "" && creds.Code != "Success" {
+		return credentials.Value{}, errors.New("the instance role credentials aren't available: " + creds.Code)
+	}
+	p.SetExpiration(creds.Expiration, time.Minute*5)
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		ProviderName:    "IMDSRoleProvider",
+	}, nil
+}
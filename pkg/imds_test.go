@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeIMDS serves the metadata of paths below /latest, the token api answers
+//like the IMDSv2 of an instance
+type fakeIMDS struct {
+	mu       sync.Mutex
+	metadata map[string]string
+	//v1Only answers token requests like an old metadata service
+	v1Only bool
+	//requireToken refuses requests without a valid token like IMDSv2 only
+	requireToken bool
+	//tokenDelay holds the token answer back like a hop limit that is too low
+	tokenDelay time.Duration
+	tokens     []string
+	//expireTokens invalidates the tokens issued so far after as many requests
+	expireTokens int
+	expired      int
+	requests     int
+}
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && r.URL.Path == "/latest/api/token" {
+		f.mu.Lock()
+		delay := f.tokenDelay
+		f.mu.Unlock()
+		time.Sleep(delay)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.v1Only {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") != "21600" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token := "token-" + strconv.Itoa(len(f.tokens))
+		f.tokens = append(f.tokens, token)
+		w.Write([]byte(token))
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if f.expireTokens > 0 && f.requests > f.expireTokens {
+		f.expired = len(f.tokens)
+		f.expireTokens = 0
+	}
+	token := r.Header.Get("X-aws-ec2-metadata-token")
+	valid := false
+	for _, t := range f.tokens[f.expired:] {
+		valid = valid || t == token
+	}
+	if (f.requireToken || token != "") && !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	value, ok := f.metadata[strings.TrimPrefix(r.URL.Path, "/latest/")]
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(value))
+}
+
+func newFakeIMDS() *fakeIMDS {
+	return &fakeIMDS{metadata: map[string]string{
+		"dynamic/instance-identity/document":           instanceIdentityDocument,
+		"meta-data/mac":                                "0e:49:61:0f:c3:11",
+		"meta-data/tags/instance":                      "Name\nk8s-role",
+		"meta-data/tags/instance/Name":                 "controller",
+		"meta-data/tags/instance/k8s-role":             "controller",
+		"meta-data/autoscaling/target-lifecycle-state": "Terminated",
+	}}
+}
+
+func TestGetInstanceIdentity(t *testing.T) {
+	expected := &InstanceIdentity{
+		InstanceID:       "i-9242867120lbndef1",
+		Region:           "eu-west-1",
+		AvailabilityZone: "eu-west-1a",
+		PrivateIP:        "10.240.0.10",
+		InstanceType:     "t3.small",
+		AccountID:        "123456789012",
+		MAC:              "0e:49:61:0f:c3:11",
+		Tags:             map[string]string{"Name": "controller", "k8s-role": "controller"},
+	}
+	cases := []struct {
+		name    string
+		prepare func(f *fakeIMDS)
+		tokens  int
+		fails   bool
+	}{
+		{name: "IMDSv2", prepare: func(f *fakeIMDS) { f.requireToken = true }, tokens: 1},
+		{name: "IMDSv1", prepare: func(f *fakeIMDS) { f.v1Only = true }},
+		{name: "expired token", prepare: func(f *fakeIMDS) { f.requireToken, f.expireTokens = true, 2 }, tokens: 2},
+		{name: "hop limit with IMDSv1", prepare: func(f *fakeIMDS) { f.tokenDelay = time.Millisecond * 50 }, tokens: 1},
+		{name: "hop limit with IMDSv2 only", prepare: func(f *fakeIMDS) { f.requireToken, f.tokenDelay = true, time.Millisecond*50 }, fails: true},
+		{name: "tags aren't enabled", prepare: func(f *fakeIMDS) { delete(f.metadata, "meta-data/tags/instance") }, tokens: 1},
+	}
+	for _, tc := range cases {
+		fake := newFakeIMDS()
+		tc.prepare(fake)
+		srv := httptest.NewServer(fake)
+		imds := NewIMDS(srv.URL)
+		imds.tokenClient.Timeout = time.Millisecond * 20
+
+		identity, err := imds.GetInstanceIdentity()
+		if tc.fails {
+			if err == nil || !strings.Contains(err.Error(), "hop limit") {
+				t.Errorf("%s: expect a hop limit error, got %v", tc.name, err)
+			}
+			srv.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		want := *expected
+		if _, ok := fake.metadata["meta-data/tags/instance"]; !ok {
+			want.Tags = nil
+		}
+		if e, a := &want, identity; !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expect %v, got %v", tc.name, e, a)
+		}
+		//the delayed token answers finish before the requests are counted
+		srv.Close()
+		fake.mu.Lock()
+		if e, a := tc.tokens, len(fake.tokens); e != a {
+			t.Errorf("%s: expect %v token requests, got %v", tc.name, e, a)
+		}
+		fake.mu.Unlock()
+	}
+}
+
+func TestGetTargetLifecycleState(t *testing.T) {
+	fake := newFakeIMDS()
+	fake.requireToken = true
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	state, err := NewIMDS(srv.URL).GetTargetLifecycleState()
+	if err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if e, a := "Terminated", state; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestIMDSRoleProvider(t *testing.T) {
+	fake := newFakeIMDS()
+	fake.requireToken = true
+	fake.metadata["meta-data/iam/security-credentials/"] = "controller-role"
+	fake.metadata["meta-data/iam/security-credentials/controller-role"] = `{
+		"Code": "Success",
+		"Type": "AWS-HMAC",
+		"AccessKeyId": "ASIAEXAMPLE",
+		"SecretAccessKey": "secret",
+		"Token": "session",
+		"Expiration": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"
+	}`
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	p := NewIMDSRoleProvider(NewIMDS(srv.URL))
+	creds, err := p.Retrieve()
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if creds.AccessKeyID != "ASIAEXAMPLE" || creds.SecretAccessKey != "secret" || creds.SessionToken != "session" {
+		t.Errorf("expect the role credentials, got %v", creds)
+	}
+	if p.IsExpired() {
+		t.Errorf("expect the credentials to be valid")
+	}
+}
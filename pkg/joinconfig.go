@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//JoinConfigKey is the key of the published join config in the secret store
+const JoinConfigKey = "join-config.json"
+
+//ErrJoinConfigStale is returned for a join config whose token expires too soon
+var ErrJoinConfigStale = errors.New("the join config is stale")
+
+var bootstrapTokenRegexp = regexp.MustCompile(`^[a-z0-9]{6}\.[a-z0-9]{16}$`)
+
+//JoinConfig is what a node needs to join with a bootstrap token. It is
+//published by the controllers and rendered to a kubeadm JoinConfiguration
+//on the joining node.
+type JoinConfig struct {
+	APIEndpoint string    `json:"apiEndpoint"`
+	Token       string    `json:"token"`
+	CACertHash  string    `json:"caCertHash"`
+	Expires     time.Time `json:"expires"`
+}
+
+//CACertHash returns the sha256 hash of the public key of a PEM encoded CA
+//certificate, as used by kubeadm for --discovery-token-ca-cert-hash
+func CACertHash(caCert []byte) (string, error) {
+	block, _ := pem.Decode(caCert)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.New("no PEM encoded certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+//CreateBootstrapToken creates a bootstrap token that is valid for ttl with kubeadm
+func CreateBootstrapToken(runner Runner, kubeconfig string, ttl time.Duration) (string, error) {
+	out, err := runner.Run("kubeadm", "token", "create", "--kubeconfig", kubeconfig, "--ttl", ttl.String())
+	if err != nil {
+		return "", errors.New("could not create a bootstrap token: " + err.Error())
+	}
+	token := strings.TrimSpace(string(out))
+	if !bootstrapTokenRegexp.MatchString(token) {
+		return "", errors.New("kubeadm returned an invalid bootstrap token: " + token)
+	}
+	return token, nil
+}
+
+//PublishJoinConfig puts the join config to the store
+func PublishJoinConfig(store SecretStore, cfg *JoinConfig) error {
+	dat, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return store.Put(JoinConfigKey, dat)
+}
+
+//GetJoinConfig reads the join config from the store. ErrJoinConfigStale is
+//returned together with the config if it expires within minValidity.
+func GetJoinConfig(store SecretStore, minValidity time.Duration, now time.Time) (*JoinConfig, error) {
+	dat, err := store.Get(JoinConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &JoinConfig{}
+	if err := json.Unmarshal(dat, cfg); err != nil {
+		return nil, errors.New("invalid join config: " + err.Error())
+	}
+	if cfg.Expires.Before(now.Add(minValidity)) {
+		return cfg, ErrJoinConfigStale
+	}
+	return cfg, nil
+}
+
+//Render creates the kubeadm JoinConfiguration, the control plane section
+//is added for controllers
+func (c *JoinConfig) Render(controlPlane bool) ([]byte, error) {
+	doc := map[string]interface{}{
+		"apiVersion": "kubeadm.k8s.io/v1beta1",
+		"kind":       "JoinConfiguration",
+		"discovery": map[string]interface{}{
+			"bootstrapToken": map[string]interface{}{
+				"apiServerEndpoint": c.APIEndpoint,
+				"token":             c.Token,
+				"caCertHashes":      []string{c.CACertHash},
+			},
+		},
+	}
+	if controlPlane {
+		doc["controlPlane"] = map[string]interface{}{}
+	}
+	return yaml.Marshal(doc)
+}
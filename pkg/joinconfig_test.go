@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+//testCACert is a self signed certificate, its hash was computed with
+//openssl x509 -pubkey | openssl pkey -pubin -outform der | sha256sum
+const testCACert = `-----BEGIN CERTIFICATE-----
+MIIBgjCCASegAwIBAgIUDciP4x4A7vZHz+ujpkKVuvrYFMMwCgYIKoZIzj0EAwIw
+FTETMBEGA1UEAwwKa3ViZXJuZXRlczAgFw0yNjEwMTcwNTQwMDBaGA8yMTI2MDky
+MzA1NDAwMFowFTETMBEGA1UEAwwKa3ViZXJuZXRlczBZMBMGByqGSM49AgEGCCqG
+SM49AwEHA0IABJxYKXO+V7tsc++sSAENtQW+5C7TjFjKkI+gMULx04efgTqNveli
+EcOA0HAcmumpeCIVGwtRxDDI47AyQtzzntmjUzBRMB0GA1UdDgQWBBRF0bPb1R42
+2ZT++x7v9Vx4xGOFKTAfBgNVHSMEGDAWgBRF0bPb1R422ZT++x7v9Vx4xGOFKTAP
+BgNVHRMBAf8EBTADAQH/MAoGCCqGSM49BAMCA0kAMEYCIQD7fKMJbrAF76/9Ms9V
+pl5obmFZMcJEHEC70ALsgH6JNQIhAJTbOtemmPBhrobQKg5XLpTETPmYEC8SJ9PA
+fu53PiRD
+-----END CERTIFICATE-----
+`
+
+func TestCACertHash(t *testing.T) {
+	hash, err := CACertHash([]byte(testCACert))
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "sha256:60a4bab0e1ad36c1424d6a662ea850f7ca1be29ed28ba790388c9708fed9a510", hash; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if _, err := CACertHash([]byte("ca.crt")); err == nil {
+		t.Errorf("expect error for a file without certificate")
+	}
+}
+
+func TestCreateBootstrapToken(t *testing.T) {
+	runner := pkgtest.NewScriptedRunner(
+		pkgtest.FakeCall{Command: []string{"kubeadm", "token", "create"}, Output: []byte("abcdef.0123456789abcdef\n"), Times: 1},
+		pkgtest.FakeCall{Command: []string{"kubeadm", "token", "create"}, Output: []byte("[warning] something went wrong\n")},
+	)
+	token, err := CreateBootstrapToken(runner, "/etc/kubernetes/admin.conf", time.Hour)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "abcdef.0123456789abcdef", token; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := "kubeadm token create --kubeconfig /etc/kubernetes/admin.conf --ttl 1h0m0s", strings.Join(runner.Calls()[0], " "); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if _, err := CreateBootstrapToken(runner, "/etc/kubernetes/admin.conf", time.Hour); err == nil {
+		t.Errorf("expect error for an invalid token")
+	}
+}
+
+func TestJoinConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(dir)
+	now := time.Now()
+
+	if _, err := GetJoinConfig(store, time.Minute, now); err != ErrNotFound {
+		t.Errorf("expect %v, got %v", ErrNotFound, err)
+	}
+	cfg := &JoinConfig{
+		APIEndpoint: "api.k8s.local:6443",
+		Token:       "abcdef.0123456789abcdef",
+		CACertHash:  "sha256:60a4",
+		Expires:     now.Add(time.Hour),
+	}
+	if err := PublishJoinConfig(store, cfg); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if _, err := GetJoinConfig(store, time.Minute, now); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	stale, err := GetJoinConfig(store, time.Minute, now.Add(time.Hour))
+	if err != ErrJoinConfigStale {
+		t.Errorf("expect %v, got %v", ErrJoinConfigStale, err)
+	}
+	if e, a := cfg.Token, stale.Token; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	dat, err := cfg.Render(true)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	rendered := struct {
+		Kind      string `yaml:"kind"`
+		Discovery struct {
+			BootstrapToken struct {
+				APIServerEndpoint string   `yaml:"apiServerEndpoint"`
+				Token             string   `yaml:"token"`
+				CACertHashes      []string `yaml:"caCertHashes"`
+			} `yaml:"bootstrapToken"`
+		} `yaml:"discovery"`
+		ControlPlane *struct{} `yaml:"controlPlane"`
+	}{}
+	if err := yaml.Unmarshal(dat, &rendered); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "JoinConfiguration", rendered.Kind; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := cfg.Token, rendered.Discovery.BootstrapToken.Token; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := cfg.CACertHash, rendered.Discovery.BootstrapToken.CACertHashes[0]; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if rendered.ControlPlane == nil {
+		t.Errorf("expect a control plane section")
+	}
+	if dat, _ := cfg.Render(false); strings.Contains(string(dat), "controlPlane") {
+		t.Errorf("expect no control plane section for workers, got %s", dat)
+	}
+}
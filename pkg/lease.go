@@ -0,0 +1,309 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+)
+
+//ErrLeaseLost is returned when the lease is no longer held by this holder
+var ErrLeaseLost = errors.New("leader lease lost")
+
+//ErrStaleToken is returned by a FencedStore when a blob was written with a
+//newer fencing token
+var ErrStaleToken = errors.New("stale fencing token, a newer leader wrote the blob")
+
+//FencingTokenMetadataKey holds the fencing token a blob was written with
+const FencingTokenMetadataKey = "K8sinit-Fencing-Token"
+
+//fencedWriteAttempts limits how often a fenced write is retried when another
+//writer changed the blob between the check and the write
+const fencedWriteAttempts = 5
+
+//Lease is the content of the lock object in the bucket
+type Lease struct {
+	Holder  string    `json:"holder"`
+	Token   int64     `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+//LeaderLock elects a single leader through a lock object in a LockStore.
+//The object is only ever written with a conditional request, either when it
+//does not exist yet or when it still has the last seen version, so two
+//holders can never both believe they own an unexpired lease.
+type LeaderLock struct {
+	store  LockStore
+	key    string
+	holder string
+	ttl    time.Duration
+	now    func() time.Time
+	//mu guards the lease and its version, the renewals of KeepAlive run
+	//next to the holder
+	mu      sync.Mutex
+	lease   Lease
+	version string
+}
+
+//NewLeaderLock creates a lock stored under key for the given holder identity
+func NewLeaderLock(store LockStore, key string, holder string, ttl time.Duration) *LeaderLock {
+	return &LeaderLock{
+		store:  store,
+		key:    key,
+		holder: holder,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+//TryAcquire tries once to take the lease. It returns false without an error
+//if another holder owns an unexpired lease or won the race for it.
+func (l *LeaderLock) TryAcquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current, version, err := readLease(l.store, l.key)
+	if err != nil {
+		return false, err
+	}
+	now := l.now()
+	lease := Lease{Holder: l.holder, Token: 1, Expires: now.Add(l.ttl)}
+	if current != nil {
+		if current.Holder != l.holder && now.Before(current.Expires) {
+			return false, nil
+		}
+		lease.Token = current.Token + 1
+	}
+	newVersion, err := l.write(lease, version)
+	if err == ErrConditionFailed {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	l.lease = lease
+	l.version = newVersion
+	return true, nil
+}
+
+//Renew extends the lease held by this holder. It returns ErrLeaseLost if the
+//lock object was changed by somebody else since it was last written. A
+//renewal that was written although its request failed is taken over, the
+//lock object then still has the holder and token of this lease.
+func (l *LeaderLock) Renew() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.version == "" {
+		return ErrLeaseLost
+	}
+	lease := l.lease
+	lease.Expires = l.now().Add(l.ttl)
+	newVersion, err := l.write(lease, l.version)
+	if err == ErrConditionFailed {
+		current, version, rerr := readLease(l.store, l.key)
+		if rerr != nil {
+			return rerr
+		}
+		if current == nil || current.Holder != l.holder || current.Token != l.lease.Token {
+			l.version = ""
+			return ErrLeaseLost
+		}
+		newVersion, err = l.write(lease, version)
+	}
+	if err == ErrConditionFailed {
+		l.version = ""
+		return ErrLeaseLost
+	} else if err != nil {
+		return err
+	}
+	l.lease = lease
+	l.version = newVersion
+	return nil
+}
+
+//Release gives up the lease by writing it back as expired. The fencing token
+//is kept so that the next holder continues the sequence.
+func (l *LeaderLock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.version == "" {
+		return ErrLeaseLost
+	}
+	lease := l.lease
+	lease.Expires = l.now()
+	_, err := l.write(lease, l.version)
+	l.version = ""
+	if err == ErrConditionFailed {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+//KeepAlive renews the lease every interval until stop is closed. A failed
+//renewal is retried with a backoff till the lease expires, only a lost or
+//expired lease is sent on the returned lost channel and ends the renewal.
+//Both channels are closed once the renewal stopped, wait for done before
+//the lease is released.
+func (l *LeaderLock) KeepAlive(interval time.Duration, stop <-chan struct{}) (lost <-chan error, done <-chan struct{}) {
+	errc := make(chan error, 1)
+	donec := make(chan struct{})
+	backoff := retry.Backoff{Initial: interval / 4, Max: interval, Factor: 2, Jitter: 0.2}
+	go func() {
+		defer close(donec)
+		defer close(errc)
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		failures := 0
+		for {
+			select {
+			case <-stop:
+				return
+			case <-timer.C:
+			}
+			err := l.Renew()
+			if err == nil {
+				failures = 0
+				timer.Reset(interval)
+				continue
+			}
+			if err == ErrLeaseLost {
+				errc <- err
+				return
+			}
+			remaining := l.expires().Sub(l.now())
+			if remaining <= 0 {
+				errc <- errors.New(ErrLeaseLost.Error() + ", it expired while the renewal failed: " + err.Error())
+				return
+			}
+			failures++
+			delay := backoff.Delay(failures)
+			if delay > remaining {
+				delay = remaining
+			}
+			log.Println("Could not renew the lease, retry in " + delay.String() + ": " + err.Error())
+			timer.Reset(delay)
+		}
+	}()
+	return errc, donec
+}
+
+//Token returns the fencing token of the currently held lease
+func (l *LeaderLock) Token() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lease.Token
+}
+
+func (l *LeaderLock) expires() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lease.Expires
+}
+
+//LeaseToken returns the fencing token of the last lease taken under key, 0
+//if none was taken yet. Writers that don't hold the lease fence their writes
+//with it, so a leader that lost its lease can't overwrite them either.
+func LeaseToken(store LockStore, key string) (int64, error) {
+	lease, _, err := readLease(store, key)
+	if err != nil || lease == nil {
+		return 0, err
+	}
+	return lease.Token, nil
+}
+
+func readLease(store LockStore, key string) (*Lease, string, error) {
+	dat, version, err := store.GetVersion(key)
+	if err == ErrNotFound {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	lease := Lease{}
+	if err := json.Unmarshal(dat, &lease); err != nil {
+		return nil, "", err
+	}
+	return &lease, version, nil
+}
+
+func (l *LeaderLock) write(lease Lease, version string) (string, error) {
+	dat, err := json.Marshal(lease)
+	if err != nil {
+		return "", err
+	}
+	return l.store.PutIfVersion(l.key, dat, version)
+}
+
+//FencedStore writes blobs with a fencing token in their metadata and never
+//overwrites a blob that was written with a newer token. The token is checked
+//and the blob written with a conditional put, so a leader that lost its lease
+//can't overwrite what its successor published.
+type FencedStore struct {
+	SecretStore
+	store ConditionalMetadataStore
+	token int64
+}
+
+//NewFencedStore creates a store that fences the writes to store with token
+func NewFencedStore(store SecretStore, token int64) (*FencedStore, error) {
+	cstore, ok := store.(ConditionalMetadataStore)
+	if !ok {
+		return nil, errors.New("secret store does not support fenced writes")
+	}
+	return &FencedStore{SecretStore: store, store: cstore, token: token}, nil
+}
+
+//GetWithMetadata reads a blob and its metadata
+func (s *FencedStore) GetWithMetadata(name string) ([]byte, map[string]*string, error) {
+	dat, metadata, _, err := s.store.GetVersionWithMetadata(name)
+	return dat, metadata, err
+}
+
+//Put writes a blob with the fencing token
+func (s *FencedStore) Put(name string, data []byte) error {
+	return s.PutWithMetadata(name, data, nil)
+}
+
+//PutWithMetadata writes a blob with the fencing token added to its metadata.
+//ErrStaleToken is returned if the blob was written with a newer token.
+func (s *FencedStore) PutWithMetadata(name string, data []byte, metadata map[string]*string) error {
+	fenced := map[string]*string{}
+	for k, v := range metadata {
+		if !strings.EqualFold(k, FencingTokenMetadataKey) {
+			fenced[k] = v
+		}
+	}
+	fenced[FencingTokenMetadataKey] = aws.String(strconv.FormatInt(s.token, 10))
+	for attempt := 0; attempt < fencedWriteAttempts; attempt++ {
+		_, current, version, err := s.store.GetVersionWithMetadata(name)
+		if err == ErrNotFound {
+			version = ""
+		} else if err != nil {
+			return err
+		} else if token, ok := FencingToken(current); ok && token > s.token {
+			return ErrStaleToken
+		}
+		_, err = s.store.PutIfVersionWithMetadata(name, data, fenced, version)
+		if err != ErrConditionFailed {
+			return err
+		}
+	}
+	return errors.New("could not write " + name + ", it changed during every attempt")
+}
+
+//FencingToken returns the fencing token a blob was written with
+func FencingToken(metadata map[string]*string) (int64, bool) {
+	raw := metadataValue(metadata, FencingTokenMetadataKey)
+	if raw == "" {
+		return 0, false
+	}
+	token, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return token, true
+}
@@ -0,0 +1,247 @@
+package pkg
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaderLockAcquire(t *testing.T) {
+	mockSvc := newMockS3Client()
+	first := NewLeaderLock(NewS3Store(mockSvc, "bucket", ""), "leader.lock", "i-143adsf", time.Minute)
+	second := NewLeaderLock(NewS3Store(mockSvc, "bucket", ""), "leader.lock", "i-423adsf", time.Minute)
+
+	ok, err := first.TryAcquire()
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if !ok {
+		t.Errorf("expect first holder to acquire the lease")
+	}
+	if e, a := int64(1), first.Token(); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	ok, err = second.TryAcquire()
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if ok {
+		t.Errorf("expect second holder not to acquire a held lease")
+	}
+
+	if err := first.Renew(); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if err := first.Release(); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+
+	ok, err = second.TryAcquire()
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if !ok {
+		t.Errorf("expect second holder to acquire a released lease")
+	}
+	if e, a := int64(2), second.Token(); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestLeaderLockExpired(t *testing.T) {
+	mockSvc := newMockS3Client()
+	now := time.Now()
+	first := NewLeaderLock(NewS3Store(mockSvc, "bucket", ""), "leader.lock", "i-143adsf", time.Minute)
+	first.now = func() time.Time { return now }
+	second := NewLeaderLock(NewS3Store(mockSvc, "bucket", ""), "leader.lock", "i-423adsf", time.Minute)
+	second.now = func() time.Time { return now.Add(2 * time.Minute) }
+
+	if ok, err := first.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expect first holder to acquire the lease, got %v %v", ok, err)
+	}
+	if ok, err := second.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expect second holder to take over an expired lease, got %v %v", ok, err)
+	}
+	if err := first.Renew(); err != ErrLeaseLost {
+		t.Errorf("expect %v, got %v", ErrLeaseLost, err)
+	}
+}
+
+func TestLeaderLockKeepAlive(t *testing.T) {
+	mockSvc := newMockS3Client()
+	lock := NewLeaderLock(NewS3Store(mockSvc, "bucket", ""), "leader.lock", "i-143adsf", time.Minute)
+	if ok, err := lock.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expect to acquire the lease, got %v %v", ok, err)
+	}
+
+	stop := make(chan struct{})
+	errc, done := lock.KeepAlive(time.Millisecond*10, stop)
+	time.Sleep(time.Millisecond * 50)
+	close(stop)
+	<-done
+	if err, ok := <-errc; ok {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("expect the lease to be released after the renewal stopped, got %v", err)
+	}
+	if ok, err := lock.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expect to acquire the lease again, got %v %v", ok, err)
+	}
+
+	other := NewLeaderLock(NewS3Store(mockSvc, "bucket", ""), "leader.lock", "i-423adsf", time.Minute)
+	other.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if ok, err := other.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expect other holder to take over, got %v %v", ok, err)
+	}
+	errc, _ = lock.KeepAlive(time.Millisecond*10, make(chan struct{}))
+	if err := <-errc; err != ErrLeaseLost {
+		t.Errorf("expect %v, got %v", ErrLeaseLost, err)
+	}
+}
+
+//flakyLockStore fails the conditional writes while failing is set, like a
+//store that times out. With applied the write is done before it fails.
+type flakyLockStore struct {
+	LockStore
+	mu      sync.Mutex
+	failing bool
+	applied bool
+	failed  int
+}
+
+func (s *flakyLockStore) fail(failing bool, applied bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing, s.applied = failing, applied
+}
+
+func (s *flakyLockStore) PutIfVersion(name string, data []byte, version string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.failing {
+		return s.LockStore.PutIfVersion(name, data, version)
+	}
+	s.failed++
+	if s.applied {
+		s.LockStore.PutIfVersion(name, data, version)
+	}
+	return "", errors.New("RequestTimeout: request timed out")
+}
+
+func TestLeaderLockKeepAliveTransientErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		ttl     time.Duration
+		applied bool
+		lost    bool
+	}{
+		{name: "retry till the store recovers", ttl: time.Minute},
+		{name: "take over a renewal written by a failed request", ttl: time.Minute, applied: true},
+		{name: "lose the lease once it expired", ttl: time.Millisecond * 100, lost: true},
+	}
+	for _, c := range cases {
+		store := &flakyLockStore{LockStore: NewS3Store(newMockS3Client(), "bucket", "")}
+		lock := NewLeaderLock(store, "leader.lock", "i-143adsf", c.ttl)
+		if ok, err := lock.TryAcquire(); err != nil || !ok {
+			t.Fatalf("%s: expect to acquire the lease, got %v %v", c.name, ok, err)
+		}
+		store.fail(true, c.applied)
+		stop := make(chan struct{})
+		errc, done := lock.KeepAlive(time.Millisecond*10, stop)
+		time.Sleep(time.Millisecond * 200)
+		store.fail(false, false)
+		time.Sleep(time.Millisecond * 50)
+		close(stop)
+		<-done
+		err, ok := <-errc
+		if c.lost && (!ok || !strings.Contains(err.Error(), "expired")) {
+			t.Errorf("%s: expect the expired lease to be lost, got %v", c.name, err)
+		}
+		if !c.lost && ok {
+			t.Errorf("%s: expect the lease to be kept, got %v", c.name, err)
+		}
+		if store.failed < 2 {
+			t.Errorf("%s: expect the renewal to be retried, it failed %v times", c.name, store.failed)
+		}
+		if !c.lost {
+			if err := lock.Release(); err != nil {
+				t.Errorf("%s: expect to release the kept lease, got %v", c.name, err)
+			}
+		}
+	}
+}
+
+func TestFencedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := NewKMSProvider(newMockKMSClient(), "alias/k8sinit", "prod")
+	stores := map[string]SecretStore{
+		"s3":   NewS3Store(newMockS3Client(), "bucket", ""),
+		"file": NewFileStore(filepath.Join(dir, "store")),
+	}
+	for name, store := range stores {
+		old := NewLeaderLock(store.(LockStore), "leader.lock", "i-143adsf", time.Minute)
+		old.now = func() time.Time { return time.Now().Add(-2 * time.Minute) }
+		if ok, err := old.TryAcquire(); err != nil || !ok {
+			t.Fatalf("%s: expect to acquire the lease, got %v %v", name, ok, err)
+		}
+		current := NewLeaderLock(store.(LockStore), "leader.lock", "i-423adsf", time.Minute)
+		if ok, err := current.TryAcquire(); err != nil || !ok {
+			t.Fatalf("%s: expect to take over the expired lease, got %v %v", name, ok, err)
+		}
+		stale, err := NewFencedStore(store, old.Token())
+		if err != nil {
+			t.Fatalf("%s: expect no error, got %v", name, err)
+		}
+		fenced, err := NewFencedStore(store, current.Token())
+		if err != nil {
+			t.Fatalf("%s: expect no error, got %v", name, err)
+		}
+
+		if err := stale.Put("join-config.json", []byte("stale")); err != nil {
+			t.Errorf("%s: expect a blob without token to be written, got %v", name, err)
+		}
+		if err := fenced.Put("join-config.json", []byte("current")); err != nil {
+			t.Errorf("%s: expect no error, got %v", name, err)
+		}
+		if err := fenced.Put("join-config.json", []byte("refreshed")); err != nil {
+			t.Errorf("%s: expect the holder of the token to overwrite its blob, got %v", name, err)
+		}
+		if err := stale.Put("join-config.json", []byte("stale")); err != ErrStaleToken {
+			t.Errorf("%s: expect %v, got %v", name, ErrStaleToken, err)
+		}
+		if dat, _ := store.Get("join-config.json"); string(dat) != "refreshed" {
+			t.Errorf("%s: expect the blob of the current leader to be kept, got %s", name, dat)
+		}
+
+		if err := PutSecret(fenced, "ca.key", []byte("key"), kp); err != nil {
+			t.Errorf("%s: expect no error, got %v", name, err)
+		}
+		if err := PutSecret(stale, "ca.key", []byte("stale"), kp); err != ErrStaleToken {
+			t.Errorf("%s: expect %v, got %v", name, ErrStaleToken, err)
+		}
+		dat, metadata, err := store.(MetadataStore).GetWithMetadata("ca.key")
+		if err != nil {
+			t.Fatalf("%s: expect no error, got %v", name, err)
+		}
+		if token, ok := FencingToken(metadata); !ok || token != current.Token() {
+			t.Errorf("%s: expect the fencing token %v, got %v %v", name, current.Token(), token, ok)
+		}
+		if dat, err := Open(kp, "ca.key", dat, metadata); err != nil || string(dat) != "key" {
+			t.Errorf("%s: expect the envelope to be kept, got %s %v", name, dat, err)
+		}
+	}
+	if _, err := NewFencedStore(NewSSMStore(nil, "/k8sinit"), 1); err == nil {
+		t.Errorf("expect error for a store without conditional writes")
+	}
+}
@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+//LeaveRequestPrefix is the prefix of the leave requests in the secret store
+const LeaveRequestPrefix = "leave/"
+
+const leaveRequestSuffix = ".json"
+
+//LeaveRequest asks the controllers to drain and delete the node of a worker.
+//Workers have no rights to drain or delete nodes, a controller does it with
+//the admin credentials and marks the request as done.
+type LeaveRequest struct {
+	Node       string    `json:"node"`
+	InstanceID string    `json:"instanceId,omitempty"`
+	Requested  time.Time `json:"requested"`
+	Done       bool      `json:"done"`
+	Error      string    `json:"error,omitempty"`
+}
+
+//LeaveRequestKey returns the key of the leave request of a node
+func LeaveRequestKey(node string) string {
+	return LeaveRequestPrefix + node + leaveRequestSuffix
+}
+
+//PutLeaveRequest writes a leave request
+func PutLeaveRequest(store SecretStore, req *LeaveRequest) error {
+	if req.Node == "" || strings.Contains(req.Node, "/") {
+		return errors.New("invalid node name " + req.Node + " in the leave request")
+	}
+	dat, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := store.Put(LeaveRequestKey(req.Node), dat); err != nil {
+		return errors.New("could not write the leave request of " + req.Node + ": " + err.Error())
+	}
+	return nil
+}
+
+//GetLeaveRequest reads the leave request of a node, ErrNotFound is returned
+//if the node didn't ask to leave
+func GetLeaveRequest(store SecretStore, node string) (*LeaveRequest, error) {
+	dat, err := store.Get(LeaveRequestKey(node))
+	if err != nil {
+		return nil, err
+	}
+	req := &LeaveRequest{}
+	if err := json.Unmarshal(dat, req); err != nil {
+		return nil, errors.New("invalid leave request of " + node + ": " + err.Error())
+	}
+	if req.Node != node {
+		return nil, errors.New("the leave request of " + node + " names the node " + req.Node)
+	}
+	return req, nil
+}
+
+//PendingLeaveRequests returns the leave requests that aren't done, sorted by
+//node name
+func PendingLeaveRequests(store SecretStore) ([]*LeaveRequest, error) {
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	pending := []*LeaveRequest{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, LeaveRequestPrefix) || !strings.HasSuffix(name, leaveRequestSuffix) {
+			continue
+		}
+		req, err := GetLeaveRequest(store, strings.TrimSuffix(strings.TrimPrefix(name, LeaveRequestPrefix), leaveRequestSuffix))
+		if err != nil {
+			log.Println("Skip the leave request " + name + ": " + err.Error())
+			continue
+		}
+		if !req.Done {
+			pending = append(pending, req)
+		}
+	}
+	return pending, nil
+}
+
+//DeleteLeaveRequest deletes the leave request of a node once it left, stores
+//that can't delete keep it as done
+func DeleteLeaveRequest(store SecretStore, node string) error {
+	dstore, ok := store.(DeleteStore)
+	if !ok {
+		return nil
+	}
+	return dstore.Delete(LeaveRequestKey(node))
+}
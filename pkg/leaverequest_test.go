@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeaveRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(filepath.Join(dir, "store"))
+	if _, err := GetLeaveRequest(store, "ip-10-0-9-10"); err != ErrNotFound {
+		t.Errorf("expect %v, got %v", ErrNotFound, err)
+	}
+	if err := PutLeaveRequest(store, &LeaveRequest{Node: "../admin.conf"}); err == nil {
+		t.Errorf("expect error for a node name with a slash")
+	}
+	now := time.Date(2026, 10, 1, 3, 0, 0, 0, time.UTC)
+	for _, req := range []*LeaveRequest{
+		{Node: "ip-10-0-9-10", InstanceID: "i-943adsf", Requested: now},
+		{Node: "ip-10-0-8-10", Requested: now, Done: true},
+		{Node: "ip-10-0-7-10", Requested: now, Error: "drain failed"},
+	} {
+		if err := PutLeaveRequest(store, req); err != nil {
+			t.Fatalf("expect no error, got %v", err)
+		}
+	}
+	store.Put(LeaveRequestPrefix+"ip-10-0-6-10.json", []byte("{"))
+	store.Put(LeaveRequestKey("ip-10-0-5-10"), []byte(`{"node": "ip-10-0-1-10"}`))
+
+	pending, err := PendingLeaveRequests(store)
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	nodes := []string{}
+	for _, req := range pending {
+		nodes = append(nodes, req.Node)
+	}
+	if e, a := "[ip-10-0-7-10 ip-10-0-9-10]", fmt.Sprint(nodes); e != a {
+		t.Errorf("expect the pending requests %v, got %v", e, a)
+	}
+	if e, a := "i-943adsf", pending[1].InstanceID; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	if err := DeleteLeaveRequest(store, "ip-10-0-9-10"); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if _, err := GetLeaveRequest(store, "ip-10-0-9-10"); err != ErrNotFound {
+		t.Errorf("expect %v, got %v", ErrNotFound, err)
+	}
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+)
+
+//The results a lifecycle action is completed with
+const (
+	LifecycleActionContinue = "CONTINUE"
+	LifecycleActionAbandon  = "ABANDON"
+)
+
+//LifecycleAction is the pending action of a lifecycle hook that holds an
+//instance in Pending:Wait or Terminating:Wait till it is completed
+type LifecycleAction struct {
+	svc        autoscalingiface.AutoScalingAPI
+	group      string
+	hook       string
+	instanceID string
+}
+
+//NewLifecycleAction creates the action of the named hook of the group for an instance
+func NewLifecycleAction(svc autoscalingiface.AutoScalingAPI, group string, hook string, instanceID string) *LifecycleAction {
+	return &LifecycleAction{svc: svc, group: group, hook: hook, instanceID: instanceID}
+}
+
+//Heartbeat restarts the heartbeat timeout of the hook
+func (a *LifecycleAction) Heartbeat() error {
+	_, err := a.svc.RecordLifecycleActionHeartbeat(&autoscaling.RecordLifecycleActionHeartbeatInput{
+		AutoScalingGroupName: aws.String(a.group),
+		LifecycleHookName:    aws.String(a.hook),
+		InstanceId:           aws.String(a.instanceID),
+	})
+	if err != nil {
+		return errors.New("could not record a heartbeat for lifecycle hook " + a.hook + ": " + err.Error())
+	}
+	return nil
+}
+
+//KeepAlive records a heartbeat every interval until stop is closed. Failed
+//heartbeats are logged, the hook only times out if they keep failing. The
+//returned channel is closed once the goroutine returns.
+func (a *LifecycleAction) KeepAlive(interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := a.Heartbeat(); err != nil {
+					log.Println(err.Error())
+				}
+			}
+		}
+	}()
+	return done
+}
+
+//Complete ends the action with LifecycleActionContinue or
+//LifecycleActionAbandon
+func (a *LifecycleAction) Complete(result string) error {
+	_, err := a.svc.CompleteLifecycleAction(&autoscaling.CompleteLifecycleActionInput{
+		AutoScalingGroupName:  aws.String(a.group),
+		LifecycleHookName:     aws.String(a.hook),
+		InstanceId:            aws.String(a.instanceID),
+		LifecycleActionResult: aws.String(result),
+	})
+	if err != nil {
+		return errors.New("could not complete lifecycle hook " + a.hook + " with " + result + ": " + err.Error())
+	}
+	return nil
+}
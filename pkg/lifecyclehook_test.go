@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestLifecycleAction(t *testing.T) {
+	mockSvc := newMockAutoScalingClient()
+	action := NewLifecycleAction(mockSvc, "auto-test-group", "launch", "i-143adsf")
+
+	stop := make(chan struct{})
+	done := action.KeepAlive(time.Millisecond, stop)
+	time.Sleep(time.Millisecond * 20)
+	close(stop)
+	<-done
+	mockSvc.mu.Lock()
+	heartbeats := len(mockSvc.heartbeats)
+	mockSvc.mu.Unlock()
+	if heartbeats == 0 {
+		t.Fatalf("expect heartbeats to be recorded")
+	}
+	hb := mockSvc.heartbeats[0]
+	if aws.StringValue(hb.AutoScalingGroupName) != "auto-test-group" || aws.StringValue(hb.LifecycleHookName) != "launch" || aws.StringValue(hb.InstanceId) != "i-143adsf" {
+		t.Errorf("expect a heartbeat for the launch hook of i-143adsf, got %v", hb)
+	}
+	time.Sleep(time.Millisecond * 5)
+	if e, a := heartbeats, len(mockSvc.heartbeats); e != a {
+		t.Errorf("expect no heartbeats after stop, got %v more", a-e)
+	}
+
+	if err := action.Complete(LifecycleActionAbandon); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := 1, len(mockSvc.completions); e != a {
+		t.Fatalf("expect %v completion, got %v", e, a)
+	}
+	if e, a := LifecycleActionAbandon, aws.StringValue(mockSvc.completions[0].LifecycleActionResult); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
@@ -0,0 +1,153 @@
+package pkgtest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//FakeS3 is an in-process S3 compatible service for tests. It speaks the path
+//style API the S3Store uses, including the conditional puts of the leases.
+type FakeS3 struct {
+	//AccessKeyID is the key requests have to be signed with, any if empty
+	AccessKeyID string
+
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	requests []string
+}
+
+type fakeObject struct {
+	data     []byte
+	metadata http.Header
+	etag     string
+}
+
+//NewFakeS3 creates an empty service
+func NewFakeS3() *FakeS3 {
+	return &FakeS3{objects: map[string]fakeObject{}}
+}
+
+//Requests returns the method and path of all requests, e.g. PUT /bucket/key
+func (f *FakeS3) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+//Objects returns the bucket/key of all objects
+func (f *FakeS3) Objects() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+func (f *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if f.AccessKeyID != "" && !strings.Contains(r.Header.Get("Authorization"), "Credential="+f.AccessKeyID+"/") {
+		writeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.Contains(path, "/") {
+		f.list(w, r, path)
+		return
+	}
+	obj, exists := f.objects[path]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !exists {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, v := range obj.metadata {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", obj.etag)
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != obj.etag) {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		dat, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		sum := md5.Sum(dat)
+		obj = fakeObject{data: dat, metadata: http.Header{}, etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+				obj.metadata[k] = v
+			}
+		}
+		f.objects[path] = obj
+		w.Header().Set("ETag", obj.etag)
+	case http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+//list answers ListObjectsV2 with all keys of the bucket below the prefix on
+//one page
+func (f *FakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	if r.Method != http.MethodGet {
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		return
+	}
+	type content struct {
+		Key  string
+		ETag string
+		Size int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: r.URL.Query().Get("prefix")}
+	for k, obj := range f.objects {
+		key := strings.TrimPrefix(k, bucket+"/")
+		if key != k && strings.HasPrefix(key, result.Prefix) {
+			result.Contents = append(result.Contents, content{Key: key, ETag: obj.etag, Size: len(obj.data)})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
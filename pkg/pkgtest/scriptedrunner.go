@@ -0,0 +1,119 @@
+//Package pkgtest has the fakes the tests of the bootstrap share, like a
+//runner with canned results. Only tests import it.
+package pkgtest
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//ExitError is returned by the ScriptedRunner for calls with a non zero exit code
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "exit status " + strconv.Itoa(e.Code)
+}
+
+//FakeCall is a canned result of a ScriptedRunner. It is used for every call
+//whose command line starts with Command, Times times or always if Times is 0.
+//Do is called with the arguments before the result is returned, which lets
+//tests write the files a real binary would create.
+type FakeCall struct {
+	Command  []string
+	Output   []byte
+	ExitCode int
+	Times    int
+	Do       func(args []string)
+}
+
+//ScriptedRunner is a Runner for tests that returns canned results and
+//records all calls
+type ScriptedRunner struct {
+	mu     sync.Mutex
+	script []*scriptedCall
+	calls  [][]string
+}
+
+type scriptedCall struct {
+	FakeCall
+	used int
+}
+
+//NewScriptedRunner creates a runner that answers with the first matching call of the script
+func NewScriptedRunner(script ...FakeCall) *ScriptedRunner {
+	r := &ScriptedRunner{}
+	r.Add(script...)
+	return r
+}
+
+//Add appends calls to the script
+func (r *ScriptedRunner) Add(script ...FakeCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, call := range script {
+		r.script = append(r.script, &scriptedCall{FakeCall: call})
+	}
+}
+
+//Run records the call and returns the result of the first matching script entry
+func (r *ScriptedRunner) Run(name string, args ...string) ([]byte, error) {
+	cmdline := append([]string{name}, args...)
+	r.mu.Lock()
+	r.calls = append(r.calls, cmdline)
+	var match *scriptedCall
+	for _, call := range r.script {
+		if (call.Times == 0 || call.used < call.Times) && hasPrefix(cmdline, call.Command) {
+			match = call
+			call.used++
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if match == nil {
+		return nil, errors.New("unexpected command: " + strings.Join(cmdline, " "))
+	}
+	if match.Do != nil {
+		match.Do(args)
+	}
+	if match.ExitCode != 0 {
+		return match.Output, &ExitError{Code: match.ExitCode}
+	}
+	return match.Output, nil
+}
+
+//Calls returns the command lines of all calls so far
+func (r *ScriptedRunner) Calls() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([][]string, len(r.calls))
+	copy(calls, r.calls)
+	return calls
+}
+
+//Called counts the calls whose command line starts with prefix
+func (r *ScriptedRunner) Called(prefix ...string) int {
+	count := 0
+	for _, call := range r.Calls() {
+		if hasPrefix(call, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func hasPrefix(cmdline []string, prefix []string) bool {
+	if len(prefix) > len(cmdline) {
+		return false
+	}
+	for i := range prefix {
+		if cmdline[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package pkgtest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScriptedRunner(t *testing.T) {
+	r := NewScriptedRunner(
+		FakeCall{Command: []string{"kubectl", "version"}, ExitCode: 1, Times: 2},
+		FakeCall{Command: []string{"kubectl", "version"}, Output: []byte("v1.14.0")},
+		FakeCall{Command: []string{"kubeadm", "init"}},
+	)
+	for i := 0; i < 2; i++ {
+		if _, err := r.Run("kubectl", "version"); err == nil {
+			t.Errorf("expect error for call %d", i)
+		} else if exitErr, ok := err.(*ExitError); !ok || exitErr.Code != 1 {
+			t.Errorf("expect exit code 1, got %v", err)
+		}
+	}
+	out, err := r.Run("kubectl", "version")
+	if err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if e, a := "v1.14.0", string(out); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if _, err := r.Run("kubeadm", "init", "--config", "/tmp/cluster-cfg.yaml"); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if _, err := r.Run("kubeadm", "reset"); err == nil {
+		t.Errorf("expect error for an unexpected command")
+	}
+	if e, a := 3, r.Called("kubectl", "version"); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := []string{"kubeadm", "reset"}, r.Calls()[4]; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
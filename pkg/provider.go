@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+)
+
+//CloudProvider tells a node who it is, which controllers are its peers and
+//how many controllers the cluster should have
+type CloudProvider interface {
+	//Name is the name the provider is selected with
+	Name() string
+	//Self returns the address of the node k8sinit runs on
+	Self(ctx context.Context) (InstanceAddress, error)
+	//Peers returns the active controllers including this node
+	Peers(ctx context.Context) ([]InstanceAddress, error)
+	//DesiredCapacity returns how many controllers the cluster should have
+	DesiredCapacity(ctx context.Context) (int, error)
+}
+
+//WaitTillCapacityReached asks the provider every interval till as many peers
+//are active as it desires
+func WaitTillCapacityReached(ctx context.Context, provider CloudProvider, interval time.Duration, timeout time.Duration) error {
+	b := retry.Backoff{Initial: interval, Max: interval, Factor: 1, Timeout: timeout}
+	return retry.Do(ctx, "wait for the capacity of the "+provider.Name()+" controllers", b, func(ctx context.Context) error {
+		desired, err := provider.DesiredCapacity(ctx)
+		if err != nil {
+			return err
+		}
+		peers, err := provider.Peers(ctx)
+		if err != nil {
+			return err
+		}
+		if len(peers) < desired {
+			return fmt.Errorf("%d of %d controllers are active", len(peers), desired)
+		}
+		return nil
+	})
+}
+
+//findSelf returns the peer that is named name or has one of the local
+//addresses
+func findSelf(peers []InstanceAddress, name string, localIPs []string) (InstanceAddress, error) {
+	for _, p := range peers {
+		if p.owns(name, localIPs) {
+			return p, nil
+		}
+	}
+	return InstanceAddress{}, errors.New("node " + name + " is none of the peers, name it like its peer with --node-name")
+}
+
+//LocalIPs returns the addresses of the network interfaces of the node
+func LocalIPs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return ips, nil
+}
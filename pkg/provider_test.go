@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParsePeers(t *testing.T) {
+	cases := []struct {
+		spec     string
+		expected []InstanceAddress
+		fails    bool
+	}{
+		{
+			spec: "ctrl-a=10.0.1.10,ctrl-b=10.0.1.11",
+			expected: []InstanceAddress{
+				{ID: "ctrl-a", PrivateIP: "10.0.1.10", PrivateDNS: "ctrl-a"},
+				{ID: "ctrl-b", PrivateIP: "10.0.1.11", PrivateDNS: "ctrl-b"},
+			},
+		},
+		{
+			spec: "# lab controllers\nctrl-a=10.0.1.10\n\n10.0.1.11 \n",
+			expected: []InstanceAddress{
+				{ID: "ctrl-a", PrivateIP: "10.0.1.10", PrivateDNS: "ctrl-a"},
+				{ID: "10.0.1.11", PrivateIP: "10.0.1.11", PrivateDNS: "10.0.1.11"},
+			},
+		},
+		{spec: "", expected: []InstanceAddress{}},
+		{spec: "ctrl-a", fails: true},
+		{spec: "=10.0.1.10", fails: true},
+	}
+	for _, tc := range cases {
+		peers, err := ParsePeers(tc.spec)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%q: expect error", tc.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expect no error, got %v", tc.spec, err)
+		}
+		if e, a := tc.expected, peers; !reflect.DeepEqual(e, a) {
+			t.Errorf("%q: expect %v, got %v", tc.spec, e, a)
+		}
+	}
+}
+
+func TestStaticProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "peers")
+	ioutil.WriteFile(file, []byte("ctrl-b=10.0.1.11\n"), 0600)
+
+	p := NewStaticProvider("ctrl-a=10.0.1.10", file, "ctrl-a")
+	p.localIPs = func() ([]string, error) { return []string{"192.168.0.2"}, nil }
+	self, err := p.Self(context.Background())
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "10.0.1.10", self.PrivateIP; e != a {
+		t.Errorf("expect self %v, got %v", e, a)
+	}
+	ioutil.WriteFile(file, []byte("ctrl-b=10.0.1.11\nctrl-c=10.0.1.12\n"), 0600)
+	if desired, err := p.DesiredCapacity(context.Background()); err != nil || desired != 3 {
+		t.Errorf("expect the file to be read again and 3 peers, got %v, %v", desired, err)
+	}
+
+	p = NewStaticProvider("", file, "localhost")
+	p.localIPs = func() ([]string, error) { return []string{"10.0.1.12"}, nil }
+	if self, err := p.Self(context.Background()); err != nil || self.ID != "ctrl-c" {
+		t.Errorf("expect ctrl-c to be found by its address, got %v, %v", self, err)
+	}
+	p.localIPs = func() ([]string, error) { return []string{"10.0.9.9"}, nil }
+	if _, err := p.Self(context.Background()); err == nil {
+		t.Errorf("expect error for a node that is no peer")
+	}
+	if _, err := NewStaticProvider("", filepath.Join(dir, "missing"), "ctrl-a").Peers(context.Background()); err == nil {
+		t.Errorf("expect error for a missing peers file")
+	}
+}
+
+type fakeResolver struct {
+	mu    sync.Mutex
+	srv   []*net.SRV
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) setHost(host string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts[host] = addrs
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if name != "_k8sinit._tcp.lab.local" {
+		return "", nil, errors.New("no such host")
+	}
+	return "", r.srv, nil
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestSRVProvider(t *testing.T) {
+	resolver := &fakeResolver{
+		srv: []*net.SRV{
+			{Target: "ctrl-b.lab.local.", Port: 6443},
+			{Target: "ctrl-a.lab.local.", Port: 6443},
+			{Target: "ctrl-c.lab.local.", Port: 6443},
+			{Target: "CTRL-A.lab.local.", Port: 2379},
+		},
+		hosts: map[string][]string{
+			"ctrl-a.lab.local": {"10.0.1.10"},
+			"ctrl-b.lab.local": {"10.0.1.11"},
+		},
+	}
+	p := NewSRVProvider("_k8sinit._tcp.lab.local", "ctrl-b", resolver)
+	p.localIPs = func() ([]string, error) { return nil, nil }
+
+	peers, err := p.Peers(context.Background())
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	expected := []InstanceAddress{
+		{ID: "ctrl-a.lab.local", PrivateIP: "10.0.1.10", PrivateDNS: "ctrl-a.lab.local"},
+		{ID: "ctrl-b.lab.local", PrivateIP: "10.0.1.11", PrivateDNS: "ctrl-b.lab.local"},
+	}
+	if e, a := expected, peers; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if desired, err := p.DesiredCapacity(context.Background()); err != nil || desired != 3 {
+		t.Errorf("expect 3 desired peers, got %v, %v", desired, err)
+	}
+	if self, err := p.Self(context.Background()); err != nil || self.ID != "ctrl-b.lab.local" {
+		t.Errorf("expect ctrl-b to be found by its host name, got %v, %v", self, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		resolver.setHost("ctrl-c.lab.local", "10.0.1.12")
+	}()
+	if err := WaitTillCapacityReached(ctx, p, time.Millisecond*5, time.Second); err != nil {
+		t.Errorf("expect the capacity to be reached once ctrl-c resolves, got %v", err)
+	}
+
+	if _, err := NewSRVProvider("_missing._tcp.lab.local", "ctrl-a", resolver).Peers(context.Background()); err == nil {
+		t.Errorf("expect error for a missing record")
+	}
+}
+
+func TestAWSProviderCapacity(t *testing.T) {
+	autoSvc := newMockAutoScalingClient()
+	group := autoSvc.describeAutoScalingGroupsOutput.AutoScalingGroups[0]
+	group.AutoScalingGroupName = stringAddress("auto-test-group")
+	group.DesiredCapacity = aws.Int64(4)
+	group.Instances = append(group.Instances,
+		&autoscaling.Instance{InstanceId: stringAddress("i-000ads1"), LifecycleState: stringAddress("Terminating")},
+		&autoscaling.Instance{InstanceId: stringAddress("i-543ads4"), LifecycleState: stringAddress("Pending")},
+	)
+	autoSvc.groupPages = []*autoscaling.DescribeAutoScalingGroupsOutput{{AutoScalingGroups: []*autoscaling.Group{group}}}
+	ec2Svc := &mockEC2Client{}
+	for i, id := range []string{"i-143adsf", "i-423adsf", "i-143ads4", "i-000ads1", "i-543ads4"} {
+		ec2Svc.instances = append(ec2Svc.instances, &ec2.Instance{
+			InstanceId:       aws.String(id),
+			PrivateIpAddress: aws.String(fmt.Sprintf("10.0.%d.10", i+1)),
+		})
+	}
+	p := NewAWSProvider(autoSvc, ec2Svc, InstanceAddress{ID: "i-143adsf", PrivateIP: "10.0.1.10"})
+
+	peers, err := p.Peers(context.Background())
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	ids := []string{}
+	for _, peer := range peers {
+		ids = append(ids, peer.ID)
+	}
+	sort.Strings(ids)
+	if e, a := []string{"i-143ads4", "i-143adsf", "i-423adsf"}, ids; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect the in service and Pending:Wait instances %v, got %v", e, a)
+	}
+	if err := WaitTillCapacityReached(context.Background(), p, time.Millisecond, time.Millisecond*20); err == nil {
+		t.Errorf("expect error, the pending and the terminating instance don't count")
+	}
+
+	autoSvc.describes = 0
+	autoSvc.onDescribe = func(n int) {
+		if n == 5 {
+			group.Instances[len(group.Instances)-1].LifecycleState = stringAddress("InService")
+		}
+	}
+	if err := WaitTillCapacityReached(context.Background(), p, time.Millisecond, time.Second); err != nil {
+		t.Errorf("expect no error once the pending instance is in service, got %v", err)
+	}
+	if e, a := 6, autoSvc.describes; e != a {
+		t.Errorf("expect the group to be described %v times, got %v", e, a)
+	}
+}
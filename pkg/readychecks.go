@@ -1,37 +1,165 @@
 package pkg
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg/retry"
+)
+
+//DNSResolves waits till the domain resolves
+func DNSResolves(ctx context.Context, apiDNS string) error {
+	return retry.Do(ctx, "resolve "+apiDNS, retry.Default, func(ctx context.Context) error {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, apiDNS)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			log.Printf("%s IN A %s\n", apiDNS, ip.String())
+		}
+		return nil
+	})
+}
+
+//APIHealth is the result of probing an api server
+type APIHealth int
+
+const (
+	//APIUnreachable means nothing answered with TLS, e.g. the connection was
+	//refused or a load balancer without backends closed it
+	APIUnreachable APIHealth = iota
+	//APITLSFailure means the server answered, but its certificate isn't
+	//signed by the cluster CA or the server doesn't speak TLS
+	APITLSFailure
+	//APIUnhealthy means the api server answered, but isn't ready or live
+	APIUnhealthy
+	//APIHealthy means the api server is ready and live
+	APIHealthy
 )
 
-//DNSResolves checks if the domain resultion works
-func DNSResolves(apiDNS string) {
-	for {
-		ips, err := net.LookupIP(apiDNS)
-		if err == nil {
-			for _, ip := range ips {
-				log.Println("%s IN A %s", apiDNS, ip.String())
+func (h APIHealth) String() string {
+	switch h {
+	case APIUnreachable:
+		return "unreachable"
+	case APITLSFailure:
+		return "tls failure"
+	case APIUnhealthy:
+		return "unhealthy"
+	case APIHealthy:
+		return "healthy"
+	}
+	return "unknown"
+}
+
+//apiHealthPaths are the health endpoints an api server has to pass
+var apiHealthPaths = []string{"/readyz", "/livez"}
+
+//APIProbe probes the health endpoints of an api server
+type APIProbe struct {
+	//CAFile is the cluster CA, the certificate of the server isn't verified
+	//as long as it doesn't exist
+	CAFile  string
+	Timeout time.Duration
+	//Retries is how often an unreachable server is probed again
+	Retries int
+}
+
+//NewAPIProbe creates a probe that verifies the servers against caFile
+func NewAPIProbe(caFile string) *APIProbe {
+	return &APIProbe{CAFile: caFile, Timeout: time.Second * 2, Retries: 2}
+}
+
+//tlsConfig trusts the cluster CA if it is available. The certificate of the
+//api server doesn't contain the loopback address, local servers are
+//verified by the kubernetes service name instead.
+func (p *APIProbe) tlsConfig(apiDNS string) *tls.Config {
+	caCert, err := ioutil.ReadFile(p.CAFile)
+	if err != nil {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+	serverName := apiDNS
+	if ip := net.ParseIP(apiDNS); apiDNS == "" || ip != nil && ip.IsLoopback() {
+		serverName = "kubernetes"
+	}
+	return &tls.Config{RootCAs: pool, ServerName: serverName}
+}
+
+//Probe gets the health endpoints of the api server at apiDNS:apiPort
+func (p *APIProbe) Probe(apiDNS string, apiPort int) APIHealth {
+	client := &http.Client{
+		Timeout: p.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   p.tlsConfig(apiDNS),
+			DisableKeepAlives: true,
+		},
+	}
+	host := net.JoinHostPort(apiDNS, strconv.Itoa(apiPort))
+	health := APIUnreachable
+	for retry := 0; retry <= p.Retries; retry++ {
+		if retry > 0 {
+			time.Sleep(time.Millisecond * 100)
+		}
+		if health = probe(client, host); health != APIUnreachable {
+			break
+		}
+	}
+	return health
+}
+
+func probe(client *http.Client, host string) APIHealth {
+	for _, path := range apiHealthPaths {
+		resp, err := client.Get("https://" + host + path)
+		if err != nil {
+			if isTLSFailure(err) {
+				log.Println("TLS handshake with " + host + " failed: " + err.Error())
+				return APITLSFailure
 			}
-			return
+			return APIUnreachable
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Println(host + path + " returned " + resp.Status)
+			return APIUnhealthy
 		}
 	}
+	return APIHealthy
 }
 
-//KubeUp checks if kubernetes is running
-func KubeUp(apiDNS string, apiPort int) bool {
-	retry := 0
-	for {
-		_, err := net.Dial("tcp", apiDNS+":"+strconv.Itoa(apiPort))
-		if err == nil {
+//isTLSFailure tells if the server answered, but couldn't be verified or
+//didn't speak TLS. Closed connections count as unreachable. net/http
+//replaces the record header error of plain http servers by its own error.
+//The causes are unwrapped by hand, errors.As needs go 1.13.
+func isTLSFailure(err error) bool {
+	if strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
+		return true
+	}
+	for err != nil {
+		switch e := err.(type) {
+		case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError, tls.RecordHeaderError:
 			return true
-		}
-		if retry > 2 {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
 			return false
 		}
-		retry++
-		time.Sleep(time.Millisecond * 100)
 	}
+	return false
 }
@@ -1,20 +1,103 @@
 package pkg
 
 import (
-	"net"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
-func TestKubeUp(t *testing.T) {
-	if KubeUp("", 6443) {
-		t.Errorf("expect no error, tcp server should be down")
+//selfSignedCert issues a certificate for the kubernetes service name that
+//is its own CA
+func selfSignedCert(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kube-apiserver"},
+		DNSNames:              []string{"kubernetes"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
 	}
-	l, err := net.Listen("tcp", ":6443")
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestAPIProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer l.Close()
-	if !KubeUp("", 6443) {
-		t.Errorf("expect no error, tcp server should be up")
+	defer os.RemoveAll(dir)
+	cert, caCert := selfSignedCert(t)
+	_, otherCA := selfSignedCert(t)
+	ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caCert, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "other-ca.crt"), otherCA, 0644)
+
+	serve := func(readyz int) *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/readyz" {
+				w.WriteHeader(readyz)
+			}
+			w.Write([]byte("ok"))
+		}))
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		srv.StartTLS()
+		return srv
+	}
+	healthy := serve(http.StatusOK)
+	defer healthy.Close()
+	unhealthy := serve(http.StatusInternalServerError)
+	defer unhealthy.Close()
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cases := []struct {
+		name     string
+		url      string
+		caFile   string
+		expected APIHealth
+	}{
+		{name: "healthy", url: healthy.URL, caFile: "ca.crt", expected: APIHealthy},
+		{name: "without ca", url: healthy.URL, caFile: "missing.crt", expected: APIHealthy},
+		{name: "unhealthy", url: unhealthy.URL, caFile: "ca.crt", expected: APIUnhealthy},
+		{name: "other ca", url: healthy.URL, caFile: "other-ca.crt", expected: APITLSFailure},
+		{name: "plain http", url: plain.URL, caFile: "ca.crt", expected: APITLSFailure},
+		{name: "unreachable", url: closed.URL, caFile: "ca.crt", expected: APIUnreachable},
+	}
+	for _, tc := range cases {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiPort, _ := strconv.Atoi(u.Port())
+		probe := &APIProbe{CAFile: filepath.Join(dir, tc.caFile), Timeout: time.Second}
+		if e, a := tc.expected, probe.Probe(u.Hostname(), apiPort); e != a {
+			t.Errorf("%s: expect %v, got %v", tc.name, e, a)
+		}
 	}
 }
@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+//InstanceAddress is how an instance is known to etcd and kubernetes
+type InstanceAddress struct {
+	ID         string
+	PrivateIP  string
+	PrivateDNS string
+}
+
+//KubeNode is a node of the cluster
+type KubeNode struct {
+	Name         string
+	InternalIP   string
+	ProviderID   string
+	ControlPlane bool
+}
+
+//DescribeInstanceAddresses gets the private addresses of the instances,
+//terminated instances are left out
+func DescribeInstanceAddresses(svc ec2iface.EC2API, ids []string) ([]InstanceAddress, error) {
+	addresses := []InstanceAddress{}
+	if len(ids) == 0 {
+		return addresses, nil
+	}
+	err := svc.DescribeInstancesPages(
+		&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(ids)},
+		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, r := range page.Reservations {
+				for _, i := range r.Instances {
+					if i.State != nil && aws.StringValue(i.State.Name) == ec2.InstanceStateNameTerminated {
+						continue
+					}
+					addresses = append(addresses, InstanceAddress{
+						ID:         aws.StringValue(i.InstanceId),
+						PrivateIP:  aws.StringValue(i.PrivateIpAddress),
+						PrivateDNS: aws.StringValue(i.PrivateDnsName),
+					})
+				}
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+//owns tells if a member or node with name and addresses runs on the
+//instance. Names are matched against the instance id and the private DNS
+//name with or without domain, addresses against the private IP.
+func (a InstanceAddress) owns(name string, addresses []string) bool {
+	name = strings.ToLower(name)
+	host := strings.SplitN(a.PrivateDNS, ".", 2)[0]
+	if name != "" && (name == a.ID || name == strings.ToLower(a.PrivateDNS) || name == strings.ToLower(host)) {
+		return true
+	}
+	for _, addr := range addresses {
+		if addr != "" && (addr == a.PrivateIP || strings.HasSuffix(addr, "/"+a.ID)) {
+			return true
+		}
+	}
+	return false
+}
+
+func urlHosts(urls []string) []string {
+	hosts := []string{}
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err == nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+//StaleMembers returns the etcd members that run on none of the instances
+func StaleMembers(members []EtcdMember, instances []InstanceAddress) []EtcdMember {
+	stale := []EtcdMember{}
+	for _, m := range members {
+		hosts := urlHosts(append(append([]string{}, m.PeerURLs...), m.ClientURLs...))
+		owned := false
+		for _, i := range instances {
+			owned = owned || i.owns(m.Name, hosts)
+		}
+		if !owned {
+			stale = append(stale, m)
+		}
+	}
+	return stale
+}
+
+//StaleNodes returns the control plane nodes that run on none of the instances
+func StaleNodes(nodes []KubeNode, instances []InstanceAddress) []KubeNode {
+	stale := []KubeNode{}
+	for _, n := range nodes {
+		if !n.ControlPlane {
+			continue
+		}
+		owned := false
+		for _, i := range instances {
+			owned = owned || i.owns(n.Name, []string{n.InternalIP, n.ProviderID})
+		}
+		if !owned {
+			stale = append(stale, n)
+		}
+	}
+	return stale
+}
+
+//Quorum returns how many members of a cluster of size members have to agree
+func Quorum(members int) int {
+	return members/2 + 1
+}
+
+//GetNodes lists the nodes of the cluster with kubectl
+func GetNodes(runner Runner, kubeconfig string) ([]KubeNode, error) {
+	out, err := runner.Run("kubectl", "--kubeconfig", kubeconfig, "get", "nodes", "-o", "json")
+	if err != nil {
+		return nil, errors.New("could not list the nodes: " + err.Error())
+	}
+	list := struct {
+		Items []struct {
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Spec struct {
+				ProviderID string `json:"providerID"`
+			} `json:"spec"`
+			Status struct {
+				Addresses []struct {
+					Type    string `json:"type"`
+					Address string `json:"address"`
+				} `json:"addresses"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, errors.New("invalid node list: " + err.Error())
+	}
+	nodes := []KubeNode{}
+	for _, item := range list.Items {
+		node := KubeNode{Name: item.Metadata.Name, ProviderID: item.Spec.ProviderID}
+		for _, role := range []string{"node-role.kubernetes.io/master", "node-role.kubernetes.io/control-plane"} {
+			if _, ok := item.Metadata.Labels[role]; ok {
+				node.ControlPlane = true
+			}
+		}
+		for _, addr := range item.Status.Addresses {
+			if addr.Type == "InternalIP" {
+				node.InternalIP = addr.Address
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
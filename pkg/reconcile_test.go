@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+type mockEC2Client struct {
+	ec2iface.EC2API
+	instances []*ec2.Instance
+}
+
+func (m *mockEC2Client) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	instances := []*ec2.Instance{}
+	for _, instance := range m.instances {
+		for _, id := range input.InstanceIds {
+			if aws.StringValue(id) == aws.StringValue(instance.InstanceId) {
+				instances = append(instances, instance)
+			}
+		}
+	}
+	for i, instance := range instances {
+		page := &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{instance}}}}
+		if !fn(page, i == len(instances)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestDescribeInstanceAddresses(t *testing.T) {
+	mockSvc := &mockEC2Client{instances: []*ec2.Instance{
+		{InstanceId: aws.String("i-143adsf"), PrivateIpAddress: aws.String("10.0.1.10"), PrivateDnsName: aws.String("ip-10-0-1-10.ec2.internal")},
+		{InstanceId: aws.String("i-423adsf"), State: &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameTerminated)}},
+	}}
+	addresses, err := DescribeInstanceAddresses(mockSvc, []string{"i-143adsf", "i-423adsf"})
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	expected := []InstanceAddress{{ID: "i-143adsf", PrivateIP: "10.0.1.10", PrivateDNS: "ip-10-0-1-10.ec2.internal"}}
+	if e, a := expected, addresses; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestStaleMembers(t *testing.T) {
+	instances := []InstanceAddress{
+		{ID: "i-143adsf", PrivateIP: "10.0.1.10", PrivateDNS: "ip-10-0-1-10.eu-central-1.compute.internal"},
+		{ID: "i-423adsf", PrivateIP: "10.0.2.10", PrivateDNS: "ip-10-0-2-10.eu-central-1.compute.internal"},
+	}
+	members := []EtcdMember{
+		{ID: 1, Name: "ip-10-0-1-10"},
+		{ID: 2, Name: "controller-b", PeerURLs: []string{"https://10.0.2.10:2380"}},
+		{ID: 3, PeerURLs: []string{"https://10.0.3.10:2380"}},
+		{ID: 4, Name: "ip-10-0-4-10.eu-central-1.compute.internal"},
+	}
+	stale := StaleMembers(members, instances)
+	if e, a := []EtcdMember{members[2], members[3]}, stale; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	nodes := []KubeNode{
+		{Name: "ip-10-0-1-10.eu-central-1.compute.internal", ControlPlane: true},
+		{Name: "controller-b", ProviderID: "aws:///eu-central-1b/i-423adsf", ControlPlane: true},
+		{Name: "controller-c", InternalIP: "10.0.3.10", ControlPlane: true},
+		{Name: "worker", InternalIP: "10.0.9.10"},
+	}
+	if e, a := []KubeNode{nodes[2]}, StaleNodes(nodes, instances); !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+
+	for members, quorum := range map[int]int{1: 1, 2: 2, 3: 2, 4: 3, 5: 3} {
+		if e, a := quorum, Quorum(members); e != a {
+			t.Errorf("expect a quorum of %v for %v members, got %v", e, members, a)
+		}
+	}
+}
+
+func TestGetNodes(t *testing.T) {
+	runner := pkgtest.NewScriptedRunner(pkgtest.FakeCall{Command: []string{"kubectl"}, Output: []byte(`{"items": [
+		{"metadata": {"name": "a", "labels": {"node-role.kubernetes.io/control-plane": ""}}, "spec": {"providerID": "aws:///az/i-1"}, "status": {"addresses": [{"type": "Hostname", "address": "a"}, {"type": "InternalIP", "address": "10.0.1.10"}]}},
+		{"metadata": {"name": "b"}}
+	]}`)})
+	nodes, err := GetNodes(runner, "admin.conf")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	expected := []KubeNode{{Name: "a", InternalIP: "10.0.1.10", ProviderID: "aws:///az/i-1", ControlPlane: true}, {Name: "b"}}
+	if e, a := expected, nodes; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := [][]string{{"kubectl", "--kubeconfig", "admin.conf", "get", "nodes", "-o", "json"}}, runner.Calls(); !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
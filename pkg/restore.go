@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//RestoreRecordKey is the key of the record of the last restore decision
+const RestoreRecordKey = BackupPrefix + "restore.json"
+
+//The decisions a controller records when it inits a cluster
+const (
+	RestoreDecisionRestored = "restored"
+	RestoreDecisionSkipped  = "skipped"
+	RestoreDecisionNoBackup = "no-backup"
+)
+
+//RestoreRecord documents if and from which backup a cluster was restored
+type RestoreRecord struct {
+	Decision   string    `json:"decision"`
+	Policy     string    `json:"policy"`
+	Backup     string    `json:"backup,omitempty"`
+	InstanceID string    `json:"instanceID"`
+	Time       time.Time `json:"time"`
+}
+
+//RecordRestore puts the record of a restore decision to the store
+func RecordRestore(store SecretStore, record *RestoreRecord) error {
+	dat, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return store.Put(RestoreRecordKey, dat)
+}
+
+//LocalEtcd is how kubeadm runs the etcd member of the first controller
+type LocalEtcd struct {
+	Name    string
+	DataDir string
+	PeerURL string
+}
+
+//LocalEtcdConfig reads the etcd member kubeadm creates from a kubeadm
+//config file. The node name and advertise address default to name and ip
+//like they do for kubeadm.
+func LocalEtcdConfig(kubeadmConfig []byte, name string, ip string) (LocalEtcd, error) {
+	member := LocalEtcd{Name: name, DataDir: "/var/lib/etcd"}
+	decoder := yaml.NewDecoder(bytes.NewReader(kubeadmConfig))
+	for {
+		doc := struct {
+			Kind             string `yaml:"kind"`
+			NodeRegistration struct {
+				Name string `yaml:"name"`
+			} `yaml:"nodeRegistration"`
+			LocalAPIEndpoint struct {
+				AdvertiseAddress string `yaml:"advertiseAddress"`
+			} `yaml:"localAPIEndpoint"`
+			Etcd struct {
+				Local struct {
+					DataDir string `yaml:"dataDir"`
+				} `yaml:"local"`
+				External map[string]interface{} `yaml:"external"`
+			} `yaml:"etcd"`
+		}{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return member, err
+		}
+		switch doc.Kind {
+		case "InitConfiguration":
+			if doc.NodeRegistration.Name != "" {
+				member.Name = doc.NodeRegistration.Name
+			}
+			if doc.LocalAPIEndpoint.AdvertiseAddress != "" {
+				ip = doc.LocalAPIEndpoint.AdvertiseAddress
+			}
+		case "ClusterConfiguration":
+			if doc.Etcd.External != nil {
+				return member, errors.New("the cluster uses an external etcd")
+			}
+			if doc.Etcd.Local.DataDir != "" {
+				member.DataDir = doc.Etcd.Local.DataDir
+			}
+		}
+	}
+	if ip == "" {
+		return member, errors.New("no advertise address for the etcd member")
+	}
+	member.PeerURL = "https://" + net.JoinHostPort(ip, "2380")
+	return member, nil
+}
+
+//PreflightCheck returns the name of the kubeadm preflight check that fails
+//for a non empty data dir
+func (e LocalEtcd) PreflightCheck() string {
+	return "DirAvailable-" + strings.Replace(e.DataDir, "/", "-", -1)
+}
+
+//EtcdRestoreTool returns the command line of the tool that restores a
+//snapshot on this host. etcdutl restores since etcd 3.5, etcdctl of etcd 3.3
+//and 3.4 restores with the v3 api. kubeadm runs etcd as a static pod, so
+//one of them has to be installed on the host.
+func EtcdRestoreTool(runner Runner) ([]string, error) {
+	if _, err := runner.Run("etcdutl", "version"); err == nil {
+		return []string{"etcdutl"}, nil
+	}
+	etcdctl := []string{"env", "ETCDCTL_API=3", "etcdctl"}
+	if _, err := runner.Run(etcdctl[0], append(etcdctl[1:], "version")...); err == nil {
+		return etcdctl, nil
+	}
+	return nil, errors.New("neither etcdutl nor etcdctl is installed, install the client of the etcd version of the cluster to restore it")
+}
+
+//RestoreSnapshot creates the data dir of a single member cluster from a
+//snapshot file with the tool of EtcdRestoreTool
+func RestoreSnapshot(runner Runner, tool []string, snapshot string, member LocalEtcd) error {
+	args := append(append([]string{}, tool[1:]...),
+		"snapshot",
+		"restore",
+		snapshot,
+		"--data-dir",
+		member.DataDir,
+		"--name",
+		member.Name,
+		"--initial-cluster",
+		member.Name+"="+member.PeerURL,
+		"--initial-advertise-peer-urls",
+		member.PeerURL,
+	)
+	if _, err := runner.Run(tool[0], args...); err != nil {
+		return errors.New("could not restore the etcd snapshot: " + err.Error())
+	}
+	return nil
+}
+
+//OutboundIP returns the local address used to reach target, which is the
+//address kubeadm advertises by default
+func OutboundIP(target string) (string, error) {
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
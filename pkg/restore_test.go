@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+func TestLocalEtcdConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   string
+		ip       string
+		expected LocalEtcd
+		fails    bool
+	}{
+		{
+			name:     "defaults",
+			config:   "kind: ClusterConfiguration\n",
+			ip:       "10.0.1.10",
+			expected: LocalEtcd{Name: "ip-10-0-1-10", DataDir: "/var/lib/etcd", PeerURL: "https://10.0.1.10:2380"},
+		},
+		{
+			name: "init configuration",
+			config: `kind: InitConfiguration
+nodeRegistration:
+  name: controller-a
+localAPIEndpoint:
+  advertiseAddress: 10.0.2.10
+---
+kind: ClusterConfiguration
+etcd:
+  local:
+    dataDir: /data/etcd
+`,
+			ip:       "10.0.1.10",
+			expected: LocalEtcd{Name: "controller-a", DataDir: "/data/etcd", PeerURL: "https://10.0.2.10:2380"},
+		},
+		{
+			name:   "external etcd",
+			config: "kind: ClusterConfiguration\netcd:\n  external:\n    endpoints: [https://10.0.0.5:2379]\n",
+			ip:     "10.0.1.10",
+			fails:  true,
+		},
+		{
+			name:   "no address",
+			config: "kind: ClusterConfiguration\n",
+			fails:  true,
+		},
+	}
+	for _, tc := range cases {
+		member, err := LocalEtcdConfig([]byte(tc.config), "ip-10-0-1-10", tc.ip)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s: expect error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		if e, a := tc.expected, member; !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expect %v, got %v", tc.name, e, a)
+		}
+	}
+	if e, a := "DirAvailable--data-etcd", (LocalEtcd{DataDir: "/data/etcd"}).PreflightCheck(); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestEtcdRestoreTool(t *testing.T) {
+	member := LocalEtcd{Name: "ip-10-0-1-10", DataDir: "/var/lib/etcd", PeerURL: "https://10.0.1.10:2380"}
+	restoreArgs := []string{"snapshot", "restore", "/tmp/snapshot", "--data-dir", "/var/lib/etcd", "--name", "ip-10-0-1-10", "--initial-cluster", "ip-10-0-1-10=https://10.0.1.10:2380", "--initial-advertise-peer-urls", "https://10.0.1.10:2380"}
+	cases := []struct {
+		name     string
+		script   []pkgtest.FakeCall
+		expected []string
+	}{
+		{
+			name:     "etcdutl of etcd 3.5",
+			script:   []pkgtest.FakeCall{{Command: []string{"etcdutl"}}, {Command: []string{"env"}}},
+			expected: []string{"etcdutl"},
+		},
+		{
+			name:     "etcdctl of etcd 3.3 and 3.4",
+			script:   []pkgtest.FakeCall{{Command: []string{"etcdutl"}, ExitCode: 127}, {Command: []string{"env", "ETCDCTL_API=3", "etcdctl"}}},
+			expected: []string{"env", "ETCDCTL_API=3", "etcdctl"},
+		},
+		{
+			name:   "no etcd client",
+			script: []pkgtest.FakeCall{{Command: []string{"etcdutl"}, ExitCode: 127}, {Command: []string{"env"}, ExitCode: 127}},
+		},
+	}
+	for _, c := range cases {
+		runner := pkgtest.NewScriptedRunner(c.script...)
+		tool, err := EtcdRestoreTool(runner)
+		if c.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expect error, got %v", c.name, tool)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(c.expected, tool) {
+			t.Errorf("%s: expect %v, got %v %v", c.name, c.expected, tool, err)
+			continue
+		}
+		if err := RestoreSnapshot(runner, tool, "/tmp/snapshot", member); err != nil {
+			t.Errorf("%s: expect no error, got %v", c.name, err)
+		}
+		calls := runner.Calls()
+		if e, a := append(append([]string{}, tool...), restoreArgs...), calls[len(calls)-1]; !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expect %v, got %v", c.name, e, a)
+		}
+	}
+}
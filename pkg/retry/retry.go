@@ -0,0 +1,111 @@
+//Package retry runs operations again with a jittered exponential backoff till
+//they succeed, time out or their context is cancelled
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+//Backoff describes the delays between the attempts of an operation
+type Backoff struct {
+	//Initial is the delay after the first failed attempt
+	Initial time.Duration
+	//Max caps the delay
+	Max time.Duration
+	//Factor multiplies the delay after every attempt
+	Factor float64
+	//Jitter randomizes each delay by up to this fraction
+	Jitter float64
+	//Timeout bounds the whole operation, no timeout if 0
+	Timeout time.Duration
+}
+
+//Default is the backoff for waits on the network
+var Default = Backoff{
+	Initial: time.Second,
+	Max:     time.Second * 30,
+	Factor:  2,
+	Jitter:  0.2,
+}
+
+//WithTimeout returns a copy of the backoff with a timeout for the operation
+func (b Backoff) WithTimeout(timeout time.Duration) Backoff {
+	b.Timeout = timeout
+	return b
+}
+
+//Delay returns the delay after the given failed attempt, starting at 1
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 1; i < attempt && delay < float64(b.Max); i++ {
+		delay *= b.Factor
+	}
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+//Permanent marks an error that no further attempt can fix, Do returns it
+//right away
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+//Do calls fn till it returns nil. It gives up on a Permanent error, once the
+//timeout of the backoff passed or when ctx is done, and returns the last
+//error together with the number of attempts. Every failed attempt is logged.
+func Do(ctx context.Context, name string, b Backoff, fn func(ctx context.Context) error) error {
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if p, ok := err.(*permanentError); ok {
+			return fmt.Errorf("%s: %s", name, p.err.Error())
+		}
+		delay := b.Delay(attempt)
+		log.Printf("%s: attempt %d failed: %s, retry in %s\n", name, attempt, err.Error(), delay.Round(time.Millisecond))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s: gave up after %d attempts (%s): %s", name, attempt, ctx.Err().Error(), err.Error())
+		case <-timer.C:
+		}
+	}
+}
+
+//ErrNotReady is the error of conditions that are not met yet
+var ErrNotReady = errors.New("not ready yet")
+
+//Until waits till cond is true, see Do
+func Until(ctx context.Context, name string, b Backoff, cond func(ctx context.Context) bool) error {
+	return Do(ctx, name, b, func(ctx context.Context) error {
+		if cond(ctx) {
+			return nil
+		}
+		return ErrNotReady
+	})
+}
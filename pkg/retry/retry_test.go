@@ -0,0 +1,63 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fast = Backoff{Initial: time.Millisecond, Max: time.Millisecond * 4, Factor: 2}
+
+func TestDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: time.Second * 10, Factor: 2}
+	for attempt, e := range []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 10, time.Second * 10} {
+		if a := b.Delay(attempt + 1); e != a {
+			t.Errorf("attempt %d: expect %v, got %v", attempt+1, e, a)
+		}
+	}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.Delay(1); d < time.Millisecond*500 || d > time.Millisecond*1500 {
+			t.Errorf("expect the delay to be jittered by 50%%, got %v", d)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	attempts := 0
+	err := Do(context.Background(), "test", fast, func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("fail")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expect success after 3 attempts, got %v %v", attempts, err)
+	}
+
+	attempts = 0
+	err = Do(context.Background(), "test", fast, func(ctx context.Context) error {
+		attempts++
+		return Permanent(errors.New("broken"))
+	})
+	if err == nil || attempts != 1 || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expect a permanent error to stop, got %v %v", attempts, err)
+	}
+
+	err = Do(context.Background(), "test", fast.WithTimeout(time.Millisecond*20), func(ctx context.Context) error {
+		return errors.New("still down")
+	})
+	if err == nil || !strings.Contains(err.Error(), "still down") || !strings.Contains(err.Error(), "attempts") {
+		t.Errorf("expect the last error and the attempts after the timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Until(ctx, "test", fast, func(ctx context.Context) bool { return false })
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("expect a cancelled context to stop, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+)
+
+//Runner runs the external binaries such as kubeadm and kubectl
+type Runner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+//ExecRunner runs binaries with os/exec and returns their standard output.
+//The output is also streamed to Stdout and Stderr if they are set.
+type ExecRunner struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+//Run runs the binary and waits for it to exit
+func (r *ExecRunner) Run(name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if r.Stdout != nil {
+		cmd.Stdout = io.MultiWriter(r.Stdout, &out)
+	}
+	cmd.Stderr = r.Stderr
+	err := cmd.Run()
+	return out.Bytes(), err
+}
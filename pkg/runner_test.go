@@ -0,0 +1,23 @@
+package pkg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExecRunner(t *testing.T) {
+	var stdout bytes.Buffer
+	out, err := (&ExecRunner{Stdout: &stdout}).Run("echo", "k8sinit")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "k8sinit\n", string(out); e != a {
+		t.Errorf("expect %q, got %q", e, a)
+	}
+	if e, a := "k8sinit\n", stdout.String(); e != a {
+		t.Errorf("expect output to be streamed, expect %q, got %q", e, a)
+	}
+	if _, err := (&ExecRunner{}).Run("false"); err == nil {
+		t.Errorf("expect error for a failing command")
+	}
+}
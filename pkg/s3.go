@@ -2,16 +2,14 @@ package pkg
 
 import (
 	"bytes"
-	"errors"
-	"io"
 	"io/ioutil"
-	"log"
-	"os"
+	"net/http"
 	"sort"
-	"time"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -19,8 +17,8 @@ import (
 )
 
 //GetInstanceID returns the EC2 instance name
-func GetInstanceID(svc *ec2metadata.EC2Metadata) (string, error) {
-	doc, err := svc.GetInstanceIdentityDocument()
+func GetInstanceID(svc *IMDS) (string, error) {
+	doc, err := svc.GetIdentityDocument()
 	if err != nil {
 		return "", err
 	}
@@ -28,8 +26,8 @@ func GetInstanceID(svc *ec2metadata.EC2Metadata) (string, error) {
 }
 
 //GetRegion returns the region the instance is running in
-func GetRegion(svc *ec2metadata.EC2Metadata) (string, error) {
-	doc, err := svc.GetInstanceIdentityDocument()
+func GetRegion(svc *IMDS) (string, error) {
+	doc, err := svc.GetIdentityDocument()
 	if err != nil {
 		return "", err
 	}
@@ -66,118 +64,194 @@ func GetAutoscalingGroup(svc autoscalingiface.AutoScalingAPI, groupName string)
 	return groups.AutoScalingGroups[0], nil
 }
 
-//WaitTillCapacityReached waits until the autoscaling group is up and running
-func WaitTillCapacityReached(group *autoscaling.Group, timeout time.Duration) error {
-
-	c1 := make(chan bool, 1)
-	go func() {
-		for {
-			if int64(len(group.Instances)) == *group.DesiredCapacity {
-				c1 <- true
-				break
-			}
-			time.Sleep(time.Second * 5)
-		}
-	}()
-	select {
-	case <-c1:
-		return nil
-	case <-time.After(timeout * time.Second):
-		return errors.New("AutoScalingGroup did not reach capacity")
-	}
-}
-
-//GetAutoscalingInstances gets all instances in an autoscaling group
+//GetAutoscalingInstances gets the sorted instances of an autoscaling group,
+//without those that are terminating or in standby
 func GetAutoscalingInstances(group *autoscaling.Group) []string {
-	instances := make([]string, len(group.Instances))
-	for i, v := range group.Instances {
-		instances[i] = *v.InstanceId
+	instances := []string{}
+	for _, v := range group.Instances {
+		if !isLeaving(v) {
+			instances = append(instances, *v.InstanceId)
+		}
 	}
 	sort.Strings(instances)
 	return instances
 }
 
-//ExistsOnS3 determines if the kube pki is on s3
-func ExistsOnS3(svc s3iface.S3API, bucket string, keyPath *map[string]string) (bool, error) {
+//S3Store is a SecretStore that keeps blobs in a S3 bucket below a prefix
+type S3Store struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+}
 
-	resp, err := svc.ListObjects(&s3.ListObjectsInput{Bucket: aws.String(bucket)})
-	if err != nil {
-		return false, err
-	}
+//NewS3Store creates a store for the bucket, prefix may be empty
+func NewS3Store(svc s3iface.S3API, bucket string, prefix string) *S3Store {
+	return &S3Store{svc: svc, bucket: bucket, prefix: strings.Trim(prefix, "/")}
+}
 
-	mapObj := map[string]bool{}
-	for _, item := range resp.Contents {
-		mapObj[*item.Key] = true
+func (s *S3Store) key(name string) string {
+	if s.prefix == "" {
+		return name
 	}
+	return s.prefix + "/" + name
+}
 
-	for f := range *keyPath {
-		if _, ok := mapObj[f]; !ok {
-			return false, nil
-		}
+//Exists determines if the blob is on s3
+func (s *S3Store) Exists(name string) (bool, error) {
+	_, err := s.svc.HeadObject(
+		&s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key(name)),
+		},
+	)
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
 	}
-
 	return true, nil
 }
 
-//DownloadMapFromS3 gets a map describing keys from s3 and downloads them to a path
-func DownloadMapFromS3(svc s3iface.S3API, bucket string, keyPath *map[string]string) error {
-	for k, p := range *keyPath {
-		err := DownloadFromS3(svc, bucket, k, p)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+//Get gets a blob from s3
+func (s *S3Store) Get(name string) ([]byte, error) {
+	dat, _, err := s.GetWithMetadata(name)
+	return dat, err
 }
 
-//DownloadFromS3 gets the kube pki from s3
-func DownloadFromS3(svc s3iface.S3API, bucket string, key string, path string) error {
-	result, err := svc.GetObject(
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
+//GetWithMetadata gets a blob and its user metadata from s3
+func (s *S3Store) GetWithMetadata(name string) ([]byte, map[string]*string, error) {
+	dat, metadata, _, err := s.get(name)
+	return dat, metadata, err
+}
+
+//Put puts a blob to s3
+func (s *S3Store) Put(name string, data []byte) error {
+	return s.PutWithMetadata(name, data, nil)
+}
+
+//PutWithMetadata puts a blob with user metadata to s3
+func (s *S3Store) PutWithMetadata(name string, data []byte, metadata map[string]*string) error {
+	_, err := s.svc.PutObject(
+		&s3.PutObjectInput{
+			Body:     bytes.NewReader(data),
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(s.key(name)),
+			Metadata: metadata,
 		},
 	)
-	if err != nil {
-		return err
-	}
-	outfile, err := os.Create(path)
-	if err != nil {
-		return err
+	return err
+}
+
+//Delete deletes a blob from s3
+func (s *S3Store) Delete(name string) error {
+	_, err := s.svc.DeleteObject(
+		&s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key(name)),
+		},
+	)
+	return err
+}
+
+//List lists the names of all blobs below the prefix, following all pages
+func (s *S3Store) List() ([]string, error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
 	}
-	defer func() {
-		err := outfile.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
-	_, err = io.Copy(outfile, result.Body)
+	names := []string{}
+	err := s.svc.ListObjectsV2Pages(
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(prefix),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, item := range page.Contents {
+				names = append(names, strings.TrimPrefix(*item.Key, prefix))
+			}
+			return true
+		},
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return names, nil
 }
 
-//UploadMapToS3 puts a map of files to S3
-func UploadMapToS3(svc s3iface.S3API, bucket string, keyPath *map[string]string) error {
-	for k, p := range *keyPath {
-		err := UploadToS3(svc, bucket, k, p)
-		if err != nil {
-			return err
-		}
+//GetVersion gets a blob together with its ETag
+func (s *S3Store) GetVersion(name string) ([]byte, string, error) {
+	dat, _, etag, err := s.get(name)
+	return dat, etag, err
+}
+
+//GetVersionWithMetadata gets a blob together with its user metadata and ETag
+func (s *S3Store) GetVersionWithMetadata(name string) ([]byte, map[string]*string, string, error) {
+	return s.get(name)
+}
+
+//PutIfVersion puts a blob if its ETag still matches version, or if it does
+//not exist yet when version is empty, and returns the new ETag
+func (s *S3Store) PutIfVersion(name string, data []byte, version string) (string, error) {
+	return s.PutIfVersionWithMetadata(name, data, nil, version)
+}
+
+//PutIfVersionWithMetadata puts a blob with user metadata like PutIfVersion
+func (s *S3Store) PutIfVersionWithMetadata(name string, data []byte, metadata map[string]*string, version string) (string, error) {
+	header, value := "If-Match", version
+	if version == "" {
+		header, value = "If-None-Match", "*"
+	}
+	resp, err := s.svc.PutObjectWithContext(
+		aws.BackgroundContext(),
+		&s3.PutObjectInput{
+			Body:     bytes.NewReader(data),
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(s.key(name)),
+			Metadata: metadata,
+		},
+		func(r *request.Request) {
+			r.HTTPRequest.Header.Set(header, value)
+		},
+	)
+	if isConditionFailed(err) {
+		return "", ErrConditionFailed
+	} else if err != nil {
+		return "", err
 	}
-	return nil
+	return aws.StringValue(resp.ETag), nil
 }
 
-//UploadToS3 puts a file to s3
-func UploadToS3(svc s3iface.S3API, bucket string, key string, path string) error {
-	dat, err := ioutil.ReadFile(path)
+func (s *S3Store) get(name string) ([]byte, map[string]*string, string, error) {
+	result, err := s.svc.GetObject(
+		&s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key(name)),
+		},
+	)
+	if isNotFound(err) {
+		return nil, nil, "", ErrNotFound
+	} else if err != nil {
+		return nil, nil, "", err
+	}
+	defer result.Body.Close()
+	dat, err := ioutil.ReadAll(result.Body)
 	if err != nil {
-		return err
+		return nil, nil, "", err
 	}
-	if _, err := svc.PutObject(&s3.PutObjectInput{Body: bytes.NewReader(dat), Bucket: aws.String(bucket), Key: aws.String(key)}); err != nil {
-		return err
+	return dat, result.Metadata, aws.StringValue(result.ETag), nil
+}
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
 	}
+	return false
+}
 
-	return nil
+func isConditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusPreconditionFailed ||
+			reqErr.StatusCode() == http.StatusConflict
+	}
+	return false
 }
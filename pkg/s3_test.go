@@ -1,17 +1,26 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 const instanceIdentityDocument = `{
@@ -50,6 +59,15 @@ type mockAutoScalingClient struct {
 	autoscalingiface.AutoScalingAPI
 	describeAutoScalingInstancesOutput *autoscaling.DescribeAutoScalingInstancesOutput
 	describeAutoScalingGroupsOutput    *autoscaling.DescribeAutoScalingGroupsOutput
+	//groupPages are returned by DescribeAutoScalingGroupsPagesWithContext,
+	//onDescribe is called with the number of the describe before
+	groupPages []*autoscaling.DescribeAutoScalingGroupsOutput
+	onDescribe func(n int)
+	describes  int
+	//heartbeats and completions record the lifecycle action calls
+	mu          sync.Mutex
+	heartbeats  []*autoscaling.RecordLifecycleActionHeartbeatInput
+	completions []*autoscaling.CompleteLifecycleActionInput
 }
 
 func newMockAutoScalingClient() *mockAutoScalingClient {
@@ -67,13 +85,16 @@ func newMockAutoScalingClient() *mockAutoScalingClient {
 			{
 				Instances: []*autoscaling.Instance{
 					{
-						InstanceId: stringAddress("i-143adsf"),
+						InstanceId:     stringAddress("i-143adsf"),
+						LifecycleState: stringAddress("InService"),
 					},
 					{
-						InstanceId: stringAddress("i-423adsf"),
+						InstanceId:     stringAddress("i-423adsf"),
+						LifecycleState: stringAddress("InService"),
 					},
 					{
-						InstanceId: stringAddress("i-143ads4"),
+						InstanceId:     stringAddress("i-143ads4"),
+						LifecycleState: stringAddress("Pending:Wait"),
 					},
 				},
 			},
@@ -93,35 +114,266 @@ func (m *mockAutoScalingClient) DescribeAutoScalingGroups(input *autoscaling.Des
 	return m.describeAutoScalingGroupsOutput, nil
 }
 
-func TestGetInstanceID(t *testing.T) {
-	server := initTestServer(
-		"/latest/dynamic/instance-identity/document",
-		instanceIdentityDocument,
-	)
-	defer server.Close()
-	c := ec2metadata.New(unit.Session, &aws.Config{Endpoint: aws.String(server.URL + "/latest")})
-	id, err := GetInstanceID(c)
+func (m *mockAutoScalingClient) DescribeAutoScalingGroupsPagesWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool, opts ...request.Option) error {
+	m.describes++
+	if m.onDescribe != nil {
+		m.onDescribe(m.describes)
+	}
+	for i, page := range m.groupPages {
+		if !fn(page, i == len(m.groupPages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockAutoScalingClient) RecordLifecycleActionHeartbeat(input *autoscaling.RecordLifecycleActionHeartbeatInput) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heartbeats = append(m.heartbeats, input)
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+func (m *mockAutoScalingClient) CompleteLifecycleAction(input *autoscaling.CompleteLifecycleActionInput) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.completions = append(m.completions, input)
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+const mockS3PageSize = 2
+
+type mockS3Object struct {
+	body     []byte
+	etag     string
+	metadata map[string]*string
+}
+
+type mockS3Client struct {
+	s3iface.S3API
+	mu      sync.Mutex
+	objects map[string]*mockS3Object
+	version int
+}
+
+func newMockS3Client() *mockS3Client {
+	return &mockS3Client{objects: map[string]*mockS3Object{}}
+}
+
+func (m *mockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "not found", nil), http.StatusNotFound, "")
+	}
+	return &s3.GetObjectOutput{
+		Body:     ioutil.NopCloser(bytes.NewReader(obj.body)),
+		ETag:     aws.String(obj.etag),
+		Metadata: obj.metadata,
+	}, nil
+}
+
+func (m *mockS3Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	req := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	for _, opt := range opts {
+		opt(req)
+	}
+	dat, err := ioutil.ReadAll(input.Body)
 	if err != nil {
-		t.Errorf("expect no error, got %v", err)
+		return nil, err
 	}
-	if e, a := id, "i-9242867120lbndef1"; e != a {
-		t.Errorf("expect %v, got %v", e, a)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, exists := m.objects[*input.Key]
+	if v := req.HTTPRequest.Header.Get("If-None-Match"); v == "*" && exists {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "object exists", nil), http.StatusPreconditionFailed, "")
+	}
+	if v := req.HTTPRequest.Header.Get("If-Match"); v != "" && (!exists || obj.etag != v) {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "etag mismatch", nil), http.StatusPreconditionFailed, "")
 	}
+	m.version++
+	etag := fmt.Sprintf("\"%d\"", m.version)
+	m.objects[*input.Key] = &mockS3Object{body: dat, etag: etag, metadata: input.Metadata}
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
 }
-func TestGetRegion(t *testing.T) {
-	server := initTestServer(
-		"/latest/dynamic/instance-identity/document",
-		instanceIdentityDocument,
-	)
-	defer server.Close()
-	c := ec2metadata.New(unit.Session, &aws.Config{Endpoint: aws.String(server.URL + "/latest")})
-	id, err := GetRegion(c)
+
+func (m *mockS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), http.StatusNotFound, "")
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(obj.etag), Metadata: obj.metadata}, nil
+}
+
+func (m *mockS3Client) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	m.mu.Lock()
+	keys := []string{}
+	for k := range m.objects {
+		if strings.HasPrefix(k, aws.StringValue(input.Prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(keys)
+	for i := 0; i == 0 || i < len(keys); i += mockS3PageSize {
+		page := &s3.ListObjectsV2Output{}
+		for _, k := range keys[i:minInt(i+mockS3PageSize, len(keys))] {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(k)})
+		}
+		lastPage := i+mockS3PageSize >= len(keys)
+		if !fn(page, lastPage) || lastPage {
+			break
+		}
+	}
+	return nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (m *mockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(m.objects, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return m.PutObjectWithContext(aws.BackgroundContext(), input)
+}
+
+func TestS3Store(t *testing.T) {
+	mockSvc := newMockS3Client()
+	store := NewS3Store(mockSvc, "bucket", "/clusters/test/")
+	if err := store.Put("ca.crt", []byte("cert")); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if _, ok := mockSvc.objects["clusters/test/ca.crt"]; !ok {
+		t.Errorf("expect object to be stored below the prefix")
+	}
+	if ok, err := store.Exists("ca.crt"); err != nil || !ok {
+		t.Errorf("expect ca.crt to exist, got %v %v", ok, err)
+	}
+	if ok, err := store.Exists("ca.key"); err != nil || ok {
+		t.Errorf("expect ca.key not to exist, got %v %v", ok, err)
+	}
+	if _, err := store.Get("ca.key"); err != ErrNotFound {
+		t.Errorf("expect %v, got %v", ErrNotFound, err)
+	}
+	for _, name := range []string{"ca.key", "sa.key", "sa.pub"} {
+		store.Put(name, []byte(name))
+	}
+	NewS3Store(mockSvc, "bucket", "clusters/other").Put("ca.crt", []byte("cert"))
+	names, err := store.List()
 	if err != nil {
 		t.Errorf("expect no error, got %v", err)
 	}
-	if e, a := id, "eu-west-1"; e != a {
+	if e, a := []string{"ca.crt", "ca.key", "sa.key", "sa.pub"}, names; !reflect.DeepEqual(e, a) {
 		t.Errorf("expect %v, got %v", e, a)
 	}
+	if err := store.Delete("sa.pub"); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if _, ok := mockSvc.objects["clusters/test/sa.pub"]; ok {
+		t.Errorf("expect sa.pub to be deleted")
+	}
+}
+
+//identityDocumentCases serves the identity document like the metadata
+//services an instance can have
+var identityDocumentCases = []struct {
+	name   string
+	server func() *httptest.Server
+	fails  bool
+}{
+	{
+		name: "IMDSv1 fixture",
+		server: func() *httptest.Server {
+			return initTestServer("/latest/dynamic/instance-identity/document", instanceIdentityDocument)
+		},
+	},
+	{
+		name: "IMDSv2 token",
+		server: func() *httptest.Server {
+			f := newFakeIMDS()
+			f.requireToken = true
+			return httptest.NewServer(f)
+		},
+	},
+	{
+		name: "IMDSv1 fallback",
+		server: func() *httptest.Server {
+			f := newFakeIMDS()
+			f.v1Only = true
+			return httptest.NewServer(f)
+		},
+	},
+	{
+		name: "hop limit",
+		server: func() *httptest.Server {
+			f := newFakeIMDS()
+			f.tokenDelay = time.Millisecond * 50
+			return httptest.NewServer(f)
+		},
+	},
+	{
+		name: "hop limit with IMDSv2 only",
+		server: func() *httptest.Server {
+			f := newFakeIMDS()
+			f.requireToken, f.tokenDelay = true, time.Millisecond*50
+			return httptest.NewServer(f)
+		},
+		fails: true,
+	},
+}
+
+func TestGetInstanceID(t *testing.T) {
+	for _, tc := range identityDocumentCases {
+		server := tc.server()
+		c := NewIMDS(server.URL)
+		c.tokenClient.Timeout = time.Millisecond * 20
+		id, err := GetInstanceID(c)
+		server.Close()
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s: expect error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		if e, a := id, "i-9242867120lbndef1"; e != a {
+			t.Errorf("%s: expect %v, got %v", tc.name, e, a)
+		}
+	}
+}
+
+func TestGetRegion(t *testing.T) {
+	for _, tc := range identityDocumentCases {
+		server := tc.server()
+		c := NewIMDS(server.URL)
+		c.tokenClient.Timeout = time.Millisecond * 20
+		region, err := GetRegion(c)
+		server.Close()
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s: expect error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+		}
+		if e, a := region, "eu-west-1"; e != a {
+			t.Errorf("%s: expect %v, got %v", tc.name, e, a)
+		}
+	}
 }
 
 func TestGetAutoscalingGroupName(t *testing.T) {
@@ -151,30 +403,37 @@ func TestGetAutoscalingInstances(t *testing.T) {
 		t.Errorf("expect %v, got %v", e, a)
 	}
 
-}
-
-func increaseInstances(group *autoscaling.Group) {
-	time.Sleep(time.Second * 10)
-	group.Instances = append(
-		group.Instances,
-		&autoscaling.Instance{
-			InstanceId: stringAddress("i-543ads4"),
-		},
+	group.Instances = append(group.Instances,
+		&autoscaling.Instance{InstanceId: stringAddress("i-000ads1"), LifecycleState: stringAddress("Terminating:Wait")},
+		&autoscaling.Instance{InstanceId: stringAddress("i-000ads2"), LifecycleState: stringAddress("Standby")},
 	)
+	instances = GetAutoscalingInstances(group)
+	if e, a := instances, []string{"i-143ads4", "i-143adsf", "i-423adsf"}; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect terminating and standby instances to be excluded, expect %v, got %v", e, a)
+	}
 }
 
-func TestWaitTillCapacitypReached(t *testing.T) {
+func TestASGWatcherDescribe(t *testing.T) {
 	mockSvc := newMockAutoScalingClient()
-	group, _ := GetAutoscalingGroup(mockSvc, "")
-	capacity := int64(4)
-	group.DesiredCapacity = &capacity
-	go increaseInstances(group)
-	err := WaitTillCapacityReached(group, 1)
-	if err == nil {
-		t.Errorf("expect error, got %v", err)
-	}
-	err = WaitTillCapacityReached(group, 15)
+	group := mockSvc.describeAutoScalingGroupsOutput.AutoScalingGroups[0]
+	group.AutoScalingGroupName = stringAddress("auto-test-group")
+	group.Instances = append(group.Instances,
+		&autoscaling.Instance{InstanceId: stringAddress("i-000ads1"), LifecycleState: stringAddress("Terminating")},
+		&autoscaling.Instance{InstanceId: stringAddress("i-000ads2"), LifecycleState: stringAddress("Pending")},
+	)
+	mockSvc.groupPages = []*autoscaling.DescribeAutoScalingGroupsOutput{
+		{AutoScalingGroups: []*autoscaling.Group{{AutoScalingGroupName: stringAddress("other-group")}}},
+		{AutoScalingGroups: []*autoscaling.Group{group}},
+	}
+
+	described, err := NewASGWatcher(mockSvc, "auto-test-group").Describe(context.Background())
 	if err != nil {
-		t.Errorf("expect no error, got %v", err)
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := 3, len(ActiveInstances(described)); e != a {
+		t.Errorf("expect %v active instances, the pending and terminating ones don't count, got %v", e, a)
+	}
+	if _, err := NewASGWatcher(mockSvc, "missing-group").Describe(context.Background()); err == nil {
+		t.Errorf("expect error for a missing group")
 	}
 }
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+//The sources the S3 client can take its credentials from
+const (
+	//S3CredentialsDefault uses the credentials of the session
+	S3CredentialsDefault = "default"
+	//S3CredentialsStatic uses an access key
+	S3CredentialsStatic = "static"
+	//S3CredentialsProfile uses a profile of the shared credentials file
+	S3CredentialsProfile = "profile"
+	//S3CredentialsAssumeRole assumes a role with the credentials of the session
+	S3CredentialsAssumeRole = "assume-role"
+)
+
+//s3DefaultRegion signs the requests to S3 compatible services if no region
+//is known, they ignore it
+const s3DefaultRegion = "us-east-1"
+
+//S3Options points the S3 client at AWS or at a S3 compatible service like MinIO
+type S3Options struct {
+	//Endpoint is the URL of the service, empty for AWS
+	Endpoint string
+	//PathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint
+	PathStyle bool
+	//CABundle is a PEM file with the CAs the endpoint is trusted with
+	CABundle string
+	//Region overrides the region of the node
+	Region string
+	//Credentials is the source of the credentials, empty is the default
+	Credentials     string
+	AccessKeyID     string
+	SecretAccessKey string
+	Profile         string
+	RoleARN         string
+}
+
+//Config returns the config of a S3 client, region is the region of the node
+func (o S3Options) Config(sess *session.Session, region string) (*aws.Config, error) {
+	if o.Region != "" {
+		region = o.Region
+	}
+	if region == "" && o.Endpoint != "" {
+		region = s3DefaultRegion
+	}
+	config := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(o.PathStyle)
+	if o.Endpoint != "" {
+		config.WithEndpoint(o.Endpoint)
+	}
+	if o.CABundle != "" {
+		client, err := caBundleClient(o.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		config.WithHTTPClient(client)
+	}
+	creds, err := o.credentials(sess)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		config.WithCredentials(creds)
+	}
+	return config, nil
+}
+
+//credentials returns the credentials of the source, nil for the default
+func (o S3Options) credentials(sess *session.Session) (*credentials.Credentials, error) {
+	switch o.Credentials {
+	case "", S3CredentialsDefault:
+		return nil, nil
+	case S3CredentialsStatic:
+		if o.AccessKeyID == "" || o.SecretAccessKey == "" {
+			return nil, errors.New("static S3 credentials need an access key id and a secret access key")
+		}
+		return credentials.NewStaticCredentials(o.AccessKeyID, o.SecretAccessKey, ""), nil
+	case S3CredentialsProfile:
+		if o.Profile == "" {
+			return nil, errors.New("profile S3 credentials need a profile")
+		}
+		return credentials.NewSharedCredentials("", o.Profile), nil
+	case S3CredentialsAssumeRole:
+		if o.RoleARN == "" {
+			return nil, errors.New("assume-role S3 credentials need a role arn")
+		}
+		return stscreds.NewCredentials(sess, o.RoleARN), nil
+	}
+	return nil, errors.New("unknown S3 credentials " + o.Credentials + ", use " + S3CredentialsDefault + ", " + S3CredentialsStatic + ", " + S3CredentialsProfile + " or " + S3CredentialsAssumeRole)
+}
+
+//caBundleClient returns a http client that trusts only the CAs of the bundle
+func caBundleClient(file string) (*http.Client, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("could not read the S3 ca bundle: " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(dat) {
+		return nil, errors.New("the S3 ca bundle " + file + " has no PEM certificates")
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{RootCAs: pool},
+		TLSHandshakeTimeout: time.Second * 10,
+		IdleConnTimeout:     time.Second * 90,
+	}}, nil
+}
@@ -0,0 +1,134 @@
+package pkg
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bn2302/k8s-ha-controller-init/pkg/pkgtest"
+)
+
+func TestS3OptionsConfig(t *testing.T) {
+	sess := session.Must(session.NewSession())
+	cases := []struct {
+		name     string
+		options  S3Options
+		region   string
+		expected string
+		fails    bool
+	}{
+		{name: "aws", region: "eu-central-1", expected: "eu-central-1"},
+		{name: "region override", options: S3Options{Region: "us-west-2"}, region: "eu-central-1", expected: "us-west-2"},
+		{name: "endpoint without region", options: S3Options{Endpoint: "http://minio:9000"}, expected: s3DefaultRegion},
+		{name: "static credentials", options: S3Options{Credentials: S3CredentialsStatic, AccessKeyID: "AKID", SecretAccessKey: "secret"}},
+		{name: "static credentials without secret", options: S3Options{Credentials: S3CredentialsStatic, AccessKeyID: "AKID"}, fails: true},
+		{name: "profile without profile", options: S3Options{Credentials: S3CredentialsProfile}, fails: true},
+		{name: "assume role", options: S3Options{Credentials: S3CredentialsAssumeRole, RoleARN: "arn:aws:iam::123456789012:role/k8sinit"}},
+		{name: "assume role without role", options: S3Options{Credentials: S3CredentialsAssumeRole}, fails: true},
+		{name: "unknown credentials", options: S3Options{Credentials: "vault"}, fails: true},
+		{name: "missing ca bundle", options: S3Options{CABundle: "/nonexistent/ca.pem"}, fails: true},
+	}
+	for _, tc := range cases {
+		config, err := tc.options.Config(sess, tc.region)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s: expect error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expect no error, got %v", tc.name, err)
+			continue
+		}
+		if e, a := tc.expected, aws.StringValue(config.Region); e != a {
+			t.Errorf("%s: expect region %q, got %q", tc.name, e, a)
+		}
+		if tc.options.Credentials != "" && config.Credentials == nil {
+			t.Errorf("%s: expect credentials", tc.name)
+		}
+	}
+}
+
+func TestS3StoreCompatibleEndpoint(t *testing.T) {
+	fake := pkgtest.NewFakeS3()
+	fake.AccessKeyID = "AKID"
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caBundle := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	options := S3Options{
+		Endpoint:        srv.URL,
+		PathStyle:       true,
+		CABundle:        caBundle,
+		Credentials:     S3CredentialsStatic,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+	}
+	sess := session.Must(session.NewSession())
+	config, err := options.Config(sess, "")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	store := NewS3Store(s3.New(sess, config), "k8s", "lab")
+
+	if err := store.PutWithMetadata("pki.tar", []byte("pki"), map[string]*string{"Envelope": aws.String("v1")}); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	dat, metadata, err := store.GetWithMetadata("pki.tar")
+	if err != nil || string(dat) != "pki" || aws.StringValue(metadata["Envelope"]) != "v1" {
+		t.Errorf("expect pki with its metadata, got %q, %v, %v", dat, metadata, err)
+	}
+	if exists, err := store.Exists("missing"); err != nil || exists {
+		t.Errorf("expect a missing object, got %v, %v", exists, err)
+	}
+	if _, err := store.Get("missing"); err != ErrNotFound {
+		t.Errorf("expect %v, got %v", ErrNotFound, err)
+	}
+	if names, err := store.List(); err != nil || !reflect.DeepEqual([]string{"pki.tar"}, names) {
+		t.Errorf("expect pki.tar to be listed, got %v, %v", names, err)
+	}
+
+	lock := NewLeaderLock(store, "leader.lock", "ctrl-a", time.Minute)
+	if acquired, err := lock.TryAcquire(); err != nil || !acquired {
+		t.Errorf("expect the lease to be acquired, got %v, %v", acquired, err)
+	}
+	other := NewLeaderLock(store, "leader.lock", "ctrl-b", time.Minute)
+	if acquired, err := other.TryAcquire(); err != nil || acquired {
+		t.Errorf("expect the held lease to be refused, got %v, %v", acquired, err)
+	}
+	if err := store.Delete("pki.tar"); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if e, a := []string{"k8s/lab/leader.lock"}, fake.Objects(); !reflect.DeepEqual(e, a) {
+		t.Errorf("expect the objects %v, got %v", e, a)
+	}
+	if e, a := "PUT /k8s/lab/pki.tar", fake.Requests()[0]; e != a {
+		t.Errorf("expect the path style request %v, got %v", e, a)
+	}
+
+	options.AccessKeyID = "OTHER"
+	config, _ = options.Config(sess, "")
+	if _, err := NewS3Store(s3.New(sess, config), "k8s", "lab").Get("leader.lock"); err == nil {
+		t.Errorf("expect error for the wrong access key")
+	}
+	options.CABundle = ""
+	config, _ = options.Config(sess, "")
+	if _, err := NewS3Store(s3.New(sess, config), "k8s", "lab").Get("leader.lock"); err == nil {
+		t.Errorf("expect error without the ca bundle")
+	}
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+//Resolver looks up the DNS records the SRV provider needs, net.Resolver is one
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+//SRVProvider discovers the peers from the targets of a SRV record. Each
+//target is a desired controller, it is active once its name resolves.
+type SRVProvider struct {
+	record   string
+	name     string
+	resolver Resolver
+	localIPs func() ([]string, error)
+}
+
+//NewSRVProvider creates a provider for the node name with the peers of the
+//SRV record, e.g. _k8sinit._tcp.example.com
+func NewSRVProvider(record string, name string, resolver Resolver) *SRVProvider {
+	return &SRVProvider{record: record, name: name, resolver: resolver, localIPs: LocalIPs}
+}
+
+//Name returns dns-srv
+func (p *SRVProvider) Name() string {
+	return "dns-srv"
+}
+
+//targets returns the sorted host names the record points to
+func (p *SRVProvider) targets(ctx context.Context) ([]string, error) {
+	_, records, err := p.resolver.LookupSRV(ctx, "", "", p.record)
+	if err != nil {
+		return nil, errors.New("could not look up " + p.record + ": " + err.Error())
+	}
+	seen := map[string]bool{}
+	targets := []string{}
+	for _, r := range records {
+		target := strings.ToLower(strings.TrimSuffix(r.Target, "."))
+		if target != "" && !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, errors.New(p.record + " has no targets")
+	}
+	sort.Strings(targets)
+	return targets, nil
+}
+
+//Self returns the target that is named like the node or resolves to one of
+//its addresses
+func (p *SRVProvider) Self(ctx context.Context) (InstanceAddress, error) {
+	peers, err := p.Peers(ctx)
+	if err != nil {
+		return InstanceAddress{}, err
+	}
+	ips, err := p.localIPs()
+	if err != nil {
+		return InstanceAddress{}, errors.New("could not get the addresses of the node: " + err.Error())
+	}
+	return findSelf(peers, p.name, ips)
+}
+
+//Peers returns the targets that resolve, the others are left out
+func (p *SRVProvider) Peers(ctx context.Context) ([]InstanceAddress, error) {
+	targets, err := p.targets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	peers := []InstanceAddress{}
+	for _, target := range targets {
+		addrs, err := p.resolver.LookupHost(ctx, target)
+		if err != nil || len(addrs) == 0 {
+			log.Println("Peer " + target + " doesn't resolve yet")
+			continue
+		}
+		peers = append(peers, InstanceAddress{ID: target, PrivateIP: addrs[0], PrivateDNS: target})
+	}
+	return peers, nil
+}
+
+//DesiredCapacity returns the number of targets of the record
+func (p *SRVProvider) DesiredCapacity(ctx context.Context) (int, error) {
+	targets, err := p.targets(ctx)
+	return len(targets), err
+}
@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+//SSMMaxValueSize is the size limit of an advanced parameter, the base64
+//encoding of a blob has to fit into it
+const SSMMaxValueSize = 8192
+
+//SSMStore is a SecretStore that keeps blobs base64 encoded as advanced
+//SecureString parameters below a path in the SSM Parameter Store. Parameters
+//are encrypted by SSM itself. SSM has no conditional writes, so the store
+//can't hold the leader lease.
+type SSMStore struct {
+	svc    ssmiface.SSMAPI
+	prefix string
+}
+
+//NewSSMStore creates a store for the parameter path prefix such as /k8sinit/cluster
+func NewSSMStore(svc ssmiface.SSMAPI, prefix string) *SSMStore {
+	return &SSMStore{svc: svc, prefix: "/" + strings.Trim(prefix, "/")}
+}
+
+func (s *SSMStore) name(name string) string {
+	return s.prefix + "/" + name
+}
+
+//Exists determines if the parameter exists
+func (s *SSMStore) Exists(name string) (bool, error) {
+	_, err := s.Get(name)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//Get gets and decrypts a parameter
+func (s *SSMStore) Get(name string) ([]byte, error) {
+	out, err := s.svc.GetParameter(
+		&ssm.GetParameterInput{
+			Name:           aws.String(s.name(name)),
+			WithDecryption: aws.Bool(true),
+		},
+	)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	dat, err := base64.StdEncoding.DecodeString(aws.StringValue(out.Parameter.Value))
+	if err != nil {
+		return nil, errors.New("parameter " + s.name(name) + " isn't base64 encoded: " + err.Error())
+	}
+	return dat, nil
+}
+
+//Put puts a parameter as advanced SecureString, overwriting an existing one.
+//Blobs whose encoding exceeds SSMMaxValueSize are refused.
+func (s *SSMStore) Put(name string, data []byte) error {
+	value := base64.StdEncoding.EncodeToString(data)
+	if len(value) > SSMMaxValueSize {
+		return errors.New(name + " has " + strconv.Itoa(len(data)) + " bytes, its encoding exceeds the " + strconv.Itoa(SSMMaxValueSize) + " bytes of a ssm parameter")
+	}
+	_, err := s.svc.PutParameterWithContext(
+		aws.BackgroundContext(),
+		&ssm.PutParameterInput{
+			Name:      aws.String(s.name(name)),
+			Value:     aws.String(value),
+			Type:      aws.String(ssm.ParameterTypeSecureString),
+			Overwrite: aws.Bool(true),
+		},
+		advancedTier,
+	)
+	return err
+}
+
+//advancedTier asks for an advanced parameter, which holds up to 8KB. The
+//sdk doesn't know the Tier of PutParameter yet, so it is added to the built
+//request body.
+func advancedTier(r *request.Request) {
+	r.Handlers.Build.PushBack(func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(r.GetBody()).Decode(&body); err != nil {
+			r.Error = awserr.New("SerializationError", "could not add the parameter tier", err)
+			return
+		}
+		body["Tier"] = "Advanced"
+		buf, err := json.Marshal(body)
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "could not add the parameter tier", err)
+			return
+		}
+		r.SetBufferBody(buf)
+	})
+}
+
+//List lists the names of all parameters below the prefix
+func (s *SSMStore) List() ([]string, error) {
+	names := []string{}
+	err := s.svc.GetParametersByPathPages(
+		&ssm.GetParametersByPathInput{
+			Path:      aws.String(s.prefix),
+			Recursive: aws.Bool(true),
+		},
+		func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
+			for _, p := range page.Parameters {
+				names = append(names, strings.TrimPrefix(aws.StringValue(p.Name), s.prefix+"/"))
+			}
+			return true
+		},
+	)
+	return names, err
+}
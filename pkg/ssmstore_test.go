@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+type mockSSMClient struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+}
+
+func newMockSSMClient() *mockSSMClient {
+	return &mockSSMClient{parameters: map[string]string{}}
+}
+
+func (m *mockSSMClient) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	v, ok := m.parameters[*input.Name]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String(v)}}, nil
+}
+
+func (m *mockSSMClient) PutParameterWithContext(ctx aws.Context, input *ssm.PutParameterInput, opts ...request.Option) (*ssm.PutParameterOutput, error) {
+	if aws.StringValue(input.Type) != ssm.ParameterTypeSecureString {
+		return nil, awserr.New(ssm.ErrCodeUnsupportedParameterType, "expected SecureString", nil)
+	}
+	m.parameters[*input.Name] = *input.Value
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func (m *mockSSMClient) GetParametersByPathPages(input *ssm.GetParametersByPathInput, fn func(*ssm.GetParametersByPathOutput, bool) bool) error {
+	for name, v := range m.parameters {
+		if strings.HasPrefix(name, *input.Path+"/") {
+			page := &ssm.GetParametersByPathOutput{
+				Parameters: []*ssm.Parameter{{Name: aws.String(name), Value: aws.String(v)}},
+			}
+			if !fn(page, false) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func TestSSMStore(t *testing.T) {
+	mockSvc := newMockSSMClient()
+	store := NewSSMStore(mockSvc, "k8sinit/test/")
+	if err := store.Put("ca.crt", []byte("cert")); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if _, ok := mockSvc.parameters["/k8sinit/test/ca.crt"]; !ok {
+		t.Errorf("expect parameter to be stored below the prefix")
+	}
+	dat, err := store.Get("ca.crt")
+	if err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if e, a := "cert", string(dat); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if ok, err := store.Exists("ca.key"); err != nil || ok {
+		t.Errorf("expect ca.key not to exist, got %v %v", ok, err)
+	}
+	store.Put("ca.key", []byte("key"))
+	names, err := store.List()
+	if err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	sort.Strings(names)
+	if e, a := []string{"ca.crt", "ca.key"}, names; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestSSMStoreEncoding(t *testing.T) {
+	mockSvc := newMockSSMClient()
+	store := NewSSMStore(mockSvc, "k8sinit/test")
+	binary := []byte{0x00, 0xff, 0x10, 0x80, 'k', 0x00}
+	if err := store.Put("pki.tar", binary); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := "AP8QgGsA", mockSvc.parameters["/k8sinit/test/pki.tar"]; e != a {
+		t.Errorf("expect the blob to be stored base64 encoded as %v, got %v", e, a)
+	}
+	if dat, err := store.Get("pki.tar"); err != nil || !bytes.Equal(binary, dat) {
+		t.Errorf("expect %v, got %v %v", binary, dat, err)
+	}
+
+	if err := store.Put("admin.conf", make([]byte, 5632)); err != nil {
+		t.Errorf("expect an admin.conf of 5.5KB to fit, got %v", err)
+	}
+	err := store.Put("images.tar", make([]byte, 6*1024+1))
+	if err == nil || !strings.Contains(err.Error(), "exceeds the 8192 bytes") {
+		t.Errorf("expect the size limit to be reported, got %v", err)
+	}
+	if _, ok := mockSvc.parameters["/k8sinit/test/images.tar"]; ok {
+		t.Errorf("expect the oversized blob not to be written")
+	}
+
+	mockSvc.parameters["/k8sinit/test/legacy"] = "not base64!"
+	if _, err := store.Get("legacy"); err == nil {
+		t.Errorf("expect an error for a value that isn't base64 encoded")
+	}
+}
+
+func TestSSMStoreAdvancedTier(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"Version":1}`))
+	}))
+	defer srv.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(srv.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	store := NewSSMStore(ssm.New(sess), "k8sinit/test")
+	if err := store.Put("admin.conf", []byte("config")); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	expected := map[string]interface{}{
+		"Name":      "/k8sinit/test/admin.conf",
+		"Value":     "Y29uZmln",
+		"Type":      "SecureString",
+		"Tier":      "Advanced",
+		"Overwrite": true,
+	}
+	if !reflect.DeepEqual(expected, body) {
+		t.Errorf("expect %v, got %v", expected, body)
+	}
+}
@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+//Phase is a step of the bootstrap of a node
+type Phase string
+
+//The phases of the bootstrap in the order they run. Workers skip elect, cni
+//and publish.
+const (
+	PhaseDiscover Phase = "discover"
+	PhaseElect    Phase = "elect"
+	PhaseFetchPKI Phase = "fetch-pki"
+	PhaseKubeadm  Phase = "kubeadm"
+	PhaseCNI      Phase = "cni"
+	PhasePublish  Phase = "publish"
+	PhaseDone     Phase = "done"
+)
+
+//The actions a controller decides on in the elect phase
+const (
+	ActionInit = "init"
+	ActionJoin = "join"
+)
+
+//BootstrapState is the progress of the bootstrap. It is persisted after
+//every phase so a restarted process resumes at the phase it stopped at.
+type BootstrapState struct {
+	Role   string `json:"role"`
+	Action string `json:"action,omitempty"`
+	//Phase is the phase that runs next
+	Phase Phase `json:"phase"`
+	//Started is set while Phase runs, it is still set after a crash
+	Started bool      `json:"started"`
+	Updated time.Time `json:"updated"`
+
+	resumed bool
+}
+
+//Resumed tells if the running phase was interrupted by a crash or reboot
+//before and runs again
+func (s *BootstrapState) Resumed() bool {
+	return s.resumed
+}
+
+//StateFile keeps the bootstrap state on the local disk
+type StateFile struct {
+	path string
+}
+
+//NewStateFile creates a state file at path, e.g. /var/lib/k8sinit/state.json
+func NewStateFile(path string) *StateFile {
+	return &StateFile{path: path}
+}
+
+//Path returns the location of the state file
+func (f *StateFile) Path() string {
+	return f.path
+}
+
+//Load reads the state, a missing file is a new bootstrap of role
+func (f *StateFile) Load(role string) (*BootstrapState, error) {
+	dat, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return &BootstrapState{Role: role}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &BootstrapState{}
+	if err := json.Unmarshal(dat, state); err != nil {
+		return nil, errors.New("invalid state file " + f.path + ": " + err.Error())
+	}
+	if state.Role != role {
+		return nil, errors.New("state file " + f.path + " belongs to a " + state.Role + ", not a " + role)
+	}
+	return state, nil
+}
+
+//Save writes the state atomically
+func (f *StateFile) Save(state *BootstrapState) error {
+	state.Updated = time.Now()
+	dat, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, dat)
+}
+
+//Step runs a phase of the bootstrap
+type Step struct {
+	Phase Phase
+	Run   func(ctx context.Context, state *BootstrapState) error
+}
+
+//RunPhases runs the steps from the phase of the state on and saves the
+//state before and after each of them. A step ends the bootstrap early by
+//setting the phase of the state to PhaseDone. No phase is started once ctx
+//is cancelled.
+func RunPhases(ctx context.Context, file *StateFile, state *BootstrapState, steps []Step) error {
+	start := 0
+	if state.Phase != "" {
+		start = -1
+		for i, step := range steps {
+			if step.Phase == state.Phase {
+				start = i
+			}
+		}
+		if state.Phase == PhaseDone {
+			start = len(steps)
+		} else if start < 0 {
+			return errors.New("unknown bootstrap phase " + string(state.Phase))
+		}
+	}
+	for i := start; i < len(steps); i++ {
+		if err := ctx.Err(); err != nil {
+			return errors.New("phase " + string(steps[i].Phase) + " not started: " + err.Error())
+		}
+		state.Phase = steps[i].Phase
+		state.resumed = state.Started
+		if state.resumed {
+			log.Println("---- Resume phase " + string(state.Phase) + " ----")
+		} else {
+			log.Println("---- Phase " + string(state.Phase) + " ----")
+		}
+		state.Started = true
+		if err := file.Save(state); err != nil {
+			return errors.New("could not save the bootstrap state: " + err.Error())
+		}
+		if err := steps[i].Run(ctx, state); err != nil {
+			return errors.New("phase " + string(steps[i].Phase) + ": " + err.Error())
+		}
+		state.Started = false
+		if state.Phase != PhaseDone {
+			state.Phase = PhaseDone
+			if i+1 < len(steps) {
+				state.Phase = steps[i+1].Phase
+			}
+		}
+		if err := file.Save(state); err != nil {
+			return errors.New("could not save the bootstrap state: " + err.Error())
+		}
+		if state.Phase == PhaseDone {
+			return nil
+		}
+	}
+	return nil
+}
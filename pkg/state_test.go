@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRunPhases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := NewStateFile(filepath.Join(dir, "state.json"))
+
+	ran := []Phase{}
+	resumed := []bool{}
+	fail := PhaseKubeadm
+	step := func(phase Phase) Step {
+		return Step{Phase: phase, Run: func(ctx context.Context, state *BootstrapState) error {
+			ran = append(ran, phase)
+			resumed = append(resumed, state.Resumed())
+			if phase == fail {
+				return errors.New("crash")
+			}
+			return nil
+		}}
+	}
+	steps := []Step{step(PhaseDiscover), step(PhaseFetchPKI), step(PhaseKubeadm), step(PhasePublish)}
+
+	state, err := file.Load("worker")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if err := RunPhases(context.Background(), file, state, steps); err == nil {
+		t.Errorf("expect error")
+	}
+	state, err = file.Load("worker")
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := PhaseKubeadm, state.Phase; e != a || !state.Started {
+		t.Errorf("expect the started phase %v, got %v %v", e, a, state.Started)
+	}
+
+	fail = ""
+	if err := RunPhases(context.Background(), file, state, steps); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if e, a := []Phase{PhaseDiscover, PhaseFetchPKI, PhaseKubeadm, PhaseKubeadm, PhasePublish}, ran; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if e, a := []bool{false, false, false, true, false}, resumed; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	state, _ = file.Load("worker")
+	if e, a := PhaseDone, state.Phase; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	if err := RunPhases(context.Background(), file, state, steps); err != nil || len(ran) != 5 {
+		t.Errorf("expect a done bootstrap not to run again, got %v %v", ran, err)
+	}
+
+	state = &BootstrapState{Role: "worker"}
+	done := []Step{{Phase: PhaseDiscover, Run: func(ctx context.Context, state *BootstrapState) error {
+		state.Phase = PhaseDone
+		return nil
+	}}, step(PhaseKubeadm)}
+	if err := RunPhases(context.Background(), file, state, done); err != nil || len(ran) != 5 {
+		t.Errorf("expect a step to end the bootstrap early, got %v %v", ran, err)
+	}
+
+	if err := RunPhases(context.Background(), file, &BootstrapState{Role: "worker", Phase: PhaseElect}, steps); err == nil {
+		t.Errorf("expect error for a phase the role doesn't have")
+	}
+	if _, err := file.Load("controller"); err == nil {
+		t.Errorf("expect error for the state file of another role")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := []Step{{Phase: PhaseDiscover, Run: func(ctx context.Context, state *BootstrapState) error {
+		cancel()
+		return nil
+	}}, step(PhaseKubeadm)}
+	state = &BootstrapState{Role: "worker"}
+	if err := RunPhases(ctx, file, state, cancelled); err == nil || len(ran) != 5 {
+		t.Errorf("expect no phase to start after the cancel, got %v %v", ran, err)
+	}
+	if e, a := PhaseKubeadm, state.Phase; e != a || state.Started {
+		t.Errorf("expect the phase %v to be resumed from the start, got %v %v", e, a, state.Started)
+	}
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+//StaticProvider takes the peers from a list, e.g. for bare metal or local
+//VMs. All listed peers are desired and treated as active.
+type StaticProvider struct {
+	peers    string
+	file     string
+	name     string
+	localIPs func() ([]string, error)
+}
+
+//NewStaticProvider creates a provider for the node name with the peers of
+//the list and the file, the file is read again on every call
+func NewStaticProvider(peers string, file string, name string) *StaticProvider {
+	return &StaticProvider{peers: peers, file: file, name: name, localIPs: LocalIPs}
+}
+
+//ParsePeers parses peers separated by commas or white space, each peer is
+//name=ip or just the ip. Lines starting with # are comments.
+func ParsePeers(spec string) ([]InstanceAddress, error) {
+	peers := []InstanceAddress{}
+	for _, line := range strings.Split(spec, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, entry := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\r' }) {
+			name, ip := entry, entry
+			if i := strings.Index(entry, "="); i >= 0 {
+				name, ip = entry[:i], entry[i+1:]
+			}
+			if name == "" || net.ParseIP(ip) == nil {
+				return nil, errors.New("invalid peer " + entry + ", use name=ip or the ip")
+			}
+			peers = append(peers, InstanceAddress{ID: name, PrivateIP: ip, PrivateDNS: name})
+		}
+	}
+	return peers, nil
+}
+
+//Name returns static
+func (p *StaticProvider) Name() string {
+	return "static"
+}
+
+//Self returns the peer that is named like the node or has one of its
+//addresses
+func (p *StaticProvider) Self(ctx context.Context) (InstanceAddress, error) {
+	peers, err := p.Peers(ctx)
+	if err != nil {
+		return InstanceAddress{}, err
+	}
+	ips, err := p.localIPs()
+	if err != nil {
+		return InstanceAddress{}, errors.New("could not get the addresses of the node: " + err.Error())
+	}
+	return findSelf(peers, p.name, ips)
+}
+
+//Peers returns the peers of the list and the file
+func (p *StaticProvider) Peers(ctx context.Context) ([]InstanceAddress, error) {
+	spec := p.peers
+	if p.file != "" {
+		dat, err := ioutil.ReadFile(p.file)
+		if err != nil {
+			return nil, errors.New("could not read the peers: " + err.Error())
+		}
+		spec += "\n" + string(dat)
+	}
+	peers, err := ParsePeers(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return nil, errors.New("no peers are listed")
+	}
+	return peers, nil
+}
+
+//DesiredCapacity returns the number of listed peers
+func (p *StaticProvider) DesiredCapacity(ctx context.Context) (int, error) {
+	peers, err := p.Peers(ctx)
+	return len(peers), err
+}
@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+//ErrNotFound is returned when a blob does not exist in a SecretStore
+var ErrNotFound = errors.New("not found in secret store")
+
+//ErrConditionFailed is returned by a LockStore when a conditional write lost the race
+var ErrConditionFailed = errors.New("conditional write failed")
+
+//SecretStore keeps the named blobs shared by the nodes of a cluster
+type SecretStore interface {
+	Exists(name string) (bool, error)
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	List() ([]string, error)
+}
+
+//MetadataStore is implemented by stores that can keep metadata next to a
+//blob, which is needed for envelope encryption
+type MetadataStore interface {
+	GetWithMetadata(name string) ([]byte, map[string]*string, error)
+	PutWithMetadata(name string, data []byte, metadata map[string]*string) error
+}
+
+//LockStore is implemented by stores that support the conditional writes
+//needed for leader election. An empty version means the blob must not exist.
+type LockStore interface {
+	GetVersion(name string) ([]byte, string, error)
+	PutIfVersion(name string, data []byte, version string) (string, error)
+}
+
+//ConditionalMetadataStore is implemented by stores that can write a blob and
+//its metadata conditionally, which is needed to fence the writes of a leader
+type ConditionalMetadataStore interface {
+	GetVersionWithMetadata(name string) ([]byte, map[string]*string, string, error)
+	PutIfVersionWithMetadata(name string, data []byte, metadata map[string]*string, version string) (string, error)
+}
+
+//DeleteStore is implemented by stores that can delete blobs, which is
+//needed to prune backups. Deleting a missing blob is no error.
+type DeleteStore interface {
+	Delete(name string) error
+}
+
+//ExistsInStore determines if all names of keyPath are in the store
+func ExistsInStore(store SecretStore, keyPath *map[string]string) (bool, error) {
+	names, err := store.List()
+	if err != nil {
+		return false, err
+	}
+
+	mapObj := map[string]bool{}
+	for _, name := range names {
+		mapObj[name] = true
+	}
+
+	for f := range *keyPath {
+		if _, ok := mapObj[f]; !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+//ListClusters lists the clusters kept below the prefix of store. Every
+//directory holding a cluster-info.yaml is a cluster.
+func ListClusters(store SecretStore) ([]string, error) {
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	clusters := []string{}
+	for _, name := range names {
+		if path.Base(name) == "cluster-info.yaml" && path.Dir(name) != "." {
+			clusters = append(clusters, path.Dir(name))
+		}
+	}
+	sort.Strings(clusters)
+	return clusters, nil
+}
+
+//GetSecret gets a blob and decrypts it with kp if it is envelope encrypted
+func GetSecret(store SecretStore, name string, kp KeyProvider) ([]byte, error) {
+	mstore, ok := store.(MetadataStore)
+	if !ok {
+		return store.Get(name)
+	}
+	dat, metadata, err := mstore.GetWithMetadata(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, migrate := kp.(plaintextMigration); migrate && !IsEncrypted(metadata) {
+		log.Println("Secret " + name + " is stored unencrypted, it is read for the migration")
+	}
+	dat, err = Open(kp, name, dat, metadata)
+	if err != nil {
+		return nil, errors.New(name + ": " + err.Error())
+	}
+	return dat, nil
+}
+
+//PutSecret puts a blob, envelope encrypted with its own data key if kp is set
+func PutSecret(store SecretStore, name string, data []byte, kp KeyProvider) error {
+	if kp == nil {
+		return store.Put(name, data)
+	}
+	mstore, ok := store.(MetadataStore)
+	if !ok {
+		return errors.New("secret store does not support envelope encryption")
+	}
+	sealed, metadata, err := Seal(kp, name, data)
+	if err != nil {
+		return err
+	}
+	return mstore.PutWithMetadata(name, sealed, metadata)
+}
+
+//DownloadMap gets a map describing names from the store and writes them to a path
+func DownloadMap(store SecretStore, keyPath *map[string]string, kp KeyProvider) error {
+	for k, p := range *keyPath {
+		dat, err := GetSecret(store, k, kp)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, dat, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Download gets a single blob from the store and writes it to path
+func Download(store SecretStore, name string, path string) error {
+	return DownloadMap(store, &map[string]string{name: path}, nil)
+}
+
+//UploadMap puts a map of files to the store
+func UploadMap(store SecretStore, keyPath *map[string]string, kp KeyProvider) error {
+	for k, p := range *keyPath {
+		dat, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := PutSecret(store, k, dat, kp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Upload puts a single file to the store
+func Upload(store SecretStore, name string, path string) error {
+	return UploadMap(store, &map[string]string{name: path}, nil)
+}
+
+//StoreURL is the parsed location of a secret store such as s3://bucket/prefix,
+//file:///path or ssm:///prefix
+type StoreURL struct {
+	Scheme string
+	Bucket string
+	Path   string
+}
+
+//ParseStoreURL parses and validates the location of a secret store
+func ParseStoreURL(raw string) (*StoreURL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, errors.New("s3 store needs a bucket: " + raw)
+		}
+		return &StoreURL{Scheme: u.Scheme, Bucket: u.Host, Path: strings.Trim(u.Path, "/")}, nil
+	case "file", "ssm":
+		if u.Host != "" {
+			return nil, errors.New(u.Scheme + " store must not have a host, use " + u.Scheme + ":///path: " + raw)
+		}
+		if strings.Trim(u.Path, "/") == "" {
+			return nil, errors.New(u.Scheme + " store needs a path: " + raw)
+		}
+		return &StoreURL{Scheme: u.Scheme, Path: strings.TrimRight(u.Path, "/")}, nil
+	}
+	return nil, errors.New("unsupported secret store: " + raw)
+}
+
+//Join returns a copy of the store location with elem appended to its path
+func (u *StoreURL) Join(elem ...string) *StoreURL {
+	joined := *u
+	joined.Path = path.Join(append([]string{u.Path}, elem...)...)
+	return &joined
+}
@@ -0,0 +1,245 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseStoreURL(t *testing.T) {
+	cases := []struct {
+		raw      string
+		expected *StoreURL
+	}{
+		{"s3://bucket", &StoreURL{Scheme: "s3", Bucket: "bucket"}},
+		{"s3://bucket/clusters/test/", &StoreURL{Scheme: "s3", Bucket: "bucket", Path: "clusters/test"}},
+		{"file:///var/lib/k8sinit/store", &StoreURL{Scheme: "file", Path: "/var/lib/k8sinit/store"}},
+		{"ssm:///k8sinit/test/", &StoreURL{Scheme: "ssm", Path: "/k8sinit/test"}},
+		{"s3:///prefix", nil},
+		{"file://host/path", nil},
+		{"ssm:///", nil},
+		{"gs://bucket", nil},
+	}
+	for _, c := range cases {
+		u, err := ParseStoreURL(c.raw)
+		if c.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expect error, got %v", c.raw, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expect no error, got %v", c.raw, err)
+		}
+		if e, a := c.expected, u; !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expect %v, got %v", c.raw, e, a)
+		}
+	}
+}
+
+func TestStoreURLJoin(t *testing.T) {
+	u, _ := ParseStoreURL("s3://bucket")
+	if e, a := "clusters/prod", u.Join("clusters", "", "prod").Path; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	u, _ = ParseStoreURL("ssm:///k8sinit")
+	if e, a := "/k8sinit/prod", u.Join("", "prod").Path; e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestListClusters(t *testing.T) {
+	mockSvc := newMockS3Client()
+	for _, key := range []string{
+		"clusters/prod/cluster-info.yaml",
+		"clusters/prod/ca.crt",
+		"clusters/staging/cluster-info.yaml",
+		"clusters/broken/ca.crt",
+		"cluster-info.yaml",
+		"other/cluster-info.yaml",
+	} {
+		mockSvc.PutObject(&s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key), Body: bytes.NewReader(nil)})
+	}
+	clusters, err := ListClusters(NewS3Store(mockSvc, "bucket", "clusters"))
+	if err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if e, a := []string{"prod", "staging"}, clusters; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(dir)
+
+	if err := store.Put("ca.crt", []byte("cert")); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if err := PutSecret(store, "ca.key", []byte("key"), NewKMSProvider(newMockKMSClient(), "alias/k8sinit", "prod")); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if ok, err := store.Exists("ca.crt"); err != nil || !ok {
+		t.Errorf("expect ca.crt to exist, got %v %v", ok, err)
+	}
+	if _, err := store.Get("sa.key"); err != ErrNotFound {
+		t.Errorf("expect %v, got %v", ErrNotFound, err)
+	}
+	names, err := store.List()
+	if err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	sort.Strings(names)
+	if e, a := []string{"ca.crt", "ca.key"}, names; !reflect.DeepEqual(e, a) {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+	ok, err := ExistsInStore(store, &map[string]string{"ca.crt": "", "ca.key": ""})
+	if err != nil || !ok {
+		t.Errorf("expect all keys to exist, got %v %v", ok, err)
+	}
+
+	dst := filepath.Join(dir, "ca.key.out")
+	if err := DownloadMap(store, &map[string]string{"ca.key": dst}, nil); err == nil {
+		t.Errorf("expect error reading an encrypted secret without key provider")
+	}
+	if err := DownloadMap(store, &map[string]string{"ca.key": dst}, NewKMSProvider(newMockKMSClient(), "alias/k8sinit", "prod")); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	dat, _ := ioutil.ReadFile(dst)
+	if e, a := "key", string(dat); e != a {
+		t.Errorf("expect %v, got %v", e, a)
+	}
+}
+
+func TestFileStoreLeaderLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first := NewLeaderLock(NewFileStore(dir), "leader.lock", "node-1", time.Minute)
+	second := NewLeaderLock(NewFileStore(dir), "leader.lock", "node-2", time.Minute)
+
+	if ok, err := first.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expect first holder to acquire the lease, got %v %v", ok, err)
+	}
+	if ok, err := second.TryAcquire(); err != nil || ok {
+		t.Errorf("expect second holder not to acquire a held lease, got %v %v", ok, err)
+	}
+	if _, err := NewFileStore(dir).PutIfVersion("leader.lock", []byte("{}"), ""); err != ErrConditionFailed {
+		t.Errorf("expect %v, got %v", ErrConditionFailed, err)
+	}
+	if err := first.Release(); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	if ok, err := second.TryAcquire(); err != nil || !ok {
+		t.Errorf("expect second holder to acquire a released lease, got %v %v", ok, err)
+	}
+}
+
+func TestFileStoreLockRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, fileStoreLock), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PutIfVersion("leader.lock", []byte("{}"), ""); err != nil {
+		t.Errorf("expect the lock directory of a crashed writer to be removed, got %v", err)
+	}
+
+	unlock, err := store.lock()
+	if err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	released := make(chan struct{})
+	written := make(chan error)
+	go func() {
+		_, err := NewFileStore(dir).PutIfVersion("join-config.json", []byte("{}"), "")
+		select {
+		case <-released:
+		default:
+			err = errors.New("written while the lock was held")
+		}
+		written <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	close(released)
+	unlock()
+	if err := <-written; err != nil {
+		t.Errorf("expect the writer to wait for the lock, got %v", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, fileStoreLock), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := store.PutIfVersion("cluster-info.yaml", []byte("info"), ""); err != nil {
+		t.Errorf("expect the lock of a closed file to be released, got %v", err)
+	}
+}
+
+func TestFileStoreInterruptedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(dir)
+	old := map[string]*string{"K8sinit-Fencing-Token": aws.String("1")}
+	newer := map[string]*string{"K8sinit-Fencing-Token": aws.String("2")}
+	if err := store.PutWithMetadata("pki.tar", []byte("old"), old); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+
+	//a crash after the metadata was staged, before the blob was renamed
+	staged := fileMetadata{Contents: map[string]map[string]*string{
+		contentHash([]byte("old")):   old,
+		contentHash([]byte("newer")): newer,
+	}}
+	if err := store.writeMetadata("pki.tar", staged); err != nil {
+		t.Fatal(err)
+	}
+	dat, metadata, err := store.GetWithMetadata("pki.tar")
+	if err != nil || string(dat) != "old" || !reflect.DeepEqual(old, metadata) {
+		t.Errorf("expect the old blob with its metadata, got %s %v %v", dat, metadata, err)
+	}
+
+	//a crash after the blob was renamed
+	if err := writeFileAtomic(store.path("pki.tar"), []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	dat, metadata, err = store.GetWithMetadata("pki.tar")
+	if err != nil || string(dat) != "newer" || !reflect.DeepEqual(newer, metadata) {
+		t.Errorf("expect the newer blob with its metadata, got %s %v %v", dat, metadata, err)
+	}
+
+	if err := store.Put("pki.tar", []byte("plain")); err != nil {
+		t.Fatalf("expect no error, got %v", err)
+	}
+	if _, err := os.Stat(store.metaPath("pki.tar")); !os.IsNotExist(err) {
+		t.Errorf("expect the metadata to be removed with the last content that had some, got %v", err)
+	}
+}